@@ -0,0 +1,297 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package autoscaler grows PersistentVolumeClaims of DigitalOcean volumes
+// whose usage crosses a threshold.
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config configures an Autoscaler.
+type Config struct {
+	// DriverName is the provisioner of the StorageClasses whose PVCs are
+	// autoscaled.
+	DriverName string
+	// Interval is how often usage is checked.
+	Interval time.Duration
+	// DryRun only logs the resizes instead of patching PVCs.
+	DryRun bool
+}
+
+// Autoscaler periodically grows the PVCs that opted into autoscaling through
+// annotations once their usage, as reported by the kubelets, crosses a
+// threshold.
+type Autoscaler struct {
+	log    *logrus.Entry
+	client *KubeClient
+	cfg    Config
+	now    func() time.Time
+}
+
+// New returns a new Autoscaler.
+func New(log *logrus.Entry, client *KubeClient, cfg Config) *Autoscaler {
+	return &Autoscaler{
+		log:    log,
+		client: client,
+		cfg:    cfg,
+		now:    time.Now,
+	}
+}
+
+// Run checks the usage of PVCs every interval until the given context is
+// done.
+func (a *Autoscaler) Run(ctx context.Context) {
+	a.log.WithFields(logrus.Fields{
+		"driver_name": a.cfg.DriverName,
+		"interval":    a.cfg.Interval,
+		"dry_run":     a.cfg.DryRun,
+	}).Info("starting PVC autoscaler")
+
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.Sync(ctx); err != nil {
+			a.log.WithError(err).Error("failed to autoscale PVCs")
+		}
+
+		select {
+		case <-ctx.Done():
+			a.log.Info("PVC autoscaler stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// volumeUsage is the usage of a mounted PVC.
+type volumeUsage struct {
+	capacityBytes int64
+	usedBytes     int64
+}
+
+// Sync grows the PVCs whose usage crosses their threshold.
+func (a *Autoscaler) Sync(ctx context.Context) error {
+	scs, err := a.client.listStorageClasses(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list storage classes: %s", err)
+	}
+	ownSCs := map[string]storageClass{}
+	for _, sc := range scs {
+		if sc.Provisioner == a.cfg.DriverName {
+			ownSCs[sc.Metadata.Name] = sc
+		}
+	}
+
+	pvcs, err := a.client.listPersistentVolumeClaims(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list PVCs: %s", err)
+	}
+
+	type candidate struct {
+		pvc    persistentVolumeClaim
+		sc     storageClass
+		policy policy
+	}
+	var candidates []candidate
+	for _, pvc := range pvcs {
+		if pvc.Status.Phase != "Bound" || pvc.Spec.StorageClassName == nil {
+			continue
+		}
+		// block volumes report no usage
+		if pvc.Spec.VolumeMode != nil && *pvc.Spec.VolumeMode == "Block" {
+			continue
+		}
+		sc, ok := ownSCs[*pvc.Spec.StorageClassName]
+		if !ok {
+			continue
+		}
+
+		p, err := policyFor(sc.Metadata.Annotations, pvc.Metadata.Annotations)
+		if err != nil {
+			a.pvcLog(pvc).WithError(err).Warn("invalid autoscaling configuration, skipping PVC")
+			continue
+		}
+		if p.enabled {
+			candidates = append(candidates, candidate{pvc: pvc, sc: sc, policy: p})
+		}
+	}
+
+	if len(candidates) == 0 {
+		a.log.Debug("no PVCs to autoscale")
+		return nil
+	}
+
+	usage, err := a.volumeUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		key := c.pvc.Metadata.Namespace + "/" + c.pvc.Metadata.Name
+		u, ok := usage[key]
+		if !ok {
+			// unmounted PVCs do not fill up
+			a.pvcLog(c.pvc).Debug("no usage reported for PVC")
+			continue
+		}
+		if err := a.scale(ctx, c.pvc, c.sc, c.policy, u); err != nil {
+			a.pvcLog(c.pvc).WithError(err).Error("failed to autoscale PVC")
+		}
+	}
+	return nil
+}
+
+// volumeUsage returns the usage of all mounted PVCs, keyed by namespace and
+// name, as reported by the kubelets' stats summaries.
+func (a *Autoscaler) volumeUsage(ctx context.Context) (map[string]volumeUsage, error) {
+	nodes, err := a.client.listNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %s", err)
+	}
+
+	usage := map[string]volumeUsage{}
+	for _, n := range nodes {
+		summary, err := a.client.nodeStatsSummary(ctx, n.Metadata.Name)
+		if err != nil {
+			// an unreachable kubelet must not stop growing PVCs on others
+			a.log.WithError(err).WithField("node", n.Metadata.Name).Warn("failed to get stats summary of node")
+			continue
+		}
+
+		for _, pod := range summary.Pods {
+			for _, vol := range pod.Volumes {
+				if vol.PVCRef == nil || vol.CapacityBytes == nil || vol.UsedBytes == nil || *vol.CapacityBytes == 0 {
+					continue
+				}
+				usage[vol.PVCRef.Namespace+"/"+vol.PVCRef.Name] = volumeUsage{
+					capacityBytes: *vol.CapacityBytes,
+					usedBytes:     *vol.UsedBytes,
+				}
+			}
+		}
+	}
+	return usage, nil
+}
+
+// scale grows the given PVC if its usage crosses the threshold of its policy.
+func (a *Autoscaler) scale(ctx context.Context, pvc persistentVolumeClaim, sc storageClass, p policy, u volumeUsage) error {
+	usedPercent := float64(u.usedBytes) / float64(u.capacityBytes) * 100
+	log := a.pvcLog(pvc).WithFields(logrus.Fields{
+		"used_bytes":     u.usedBytes,
+		"capacity_bytes": u.capacityBytes,
+		"used_percent":   fmt.Sprintf("%.1f", usedPercent),
+		"threshold":      p.threshold,
+	})
+	if usedPercent < p.threshold {
+		log.Debug("PVC usage is below threshold")
+		return nil
+	}
+
+	if sc.AllowVolumeExpansion == nil || !*sc.AllowVolumeExpansion {
+		log.WithField("storage_class", sc.Metadata.Name).Warn("PVC usage crossed threshold, but its storage class does not allow volume expansion")
+		return nil
+	}
+
+	requested, err := parseQuantity(pvc.Spec.Resources.Requests["storage"])
+	if err != nil {
+		return fmt.Errorf("failed to parse storage request: %s", err)
+	}
+	capacity, err := parseQuantity(pvc.Status.Capacity["storage"])
+	if err != nil {
+		return fmt.Errorf("failed to parse storage capacity: %s", err)
+	}
+
+	if requested > capacity || isResizing(pvc) {
+		log.Info("PVC usage crossed threshold, but PVC is being resized already")
+		return nil
+	}
+
+	if last, ok := pvc.Metadata.Annotations[AnnotationLastResizedAt]; ok {
+		lastResizedAt, err := time.Parse(time.RFC3339, last)
+		if err != nil {
+			log.WithError(err).Warn("ignoring invalid last resize timestamp")
+		} else if since := a.now().Sub(lastResizedAt); since < p.cooldown {
+			log.WithField("cooldown_remaining", p.cooldown-since).Info("PVC usage crossed threshold, but PVC was resized recently")
+			return nil
+		}
+	}
+
+	size := max(requested, capacity)
+	newSize := p.nextSize(size)
+	log = log.WithFields(logrus.Fields{
+		"size":     size,
+		"new_size": newSize,
+		"max_size": p.maxSize,
+	})
+	if newSize <= size {
+		log.Warn("PVC usage crossed threshold, but PVC reached its maximum size")
+		return nil
+	}
+
+	if a.cfg.DryRun {
+		log.Info("would grow PVC (dry run)")
+		return nil
+	}
+
+	patch := map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				AnnotationLastResizedAt: a.now().UTC().Format(time.RFC3339),
+			},
+		},
+		"spec": map[string]any{
+			"resources": map[string]any{
+				"requests": map[string]string{
+					"storage": formatGiB(newSize),
+				},
+			},
+		},
+	}
+	if err := a.client.patchPersistentVolumeClaim(ctx, pvc.Metadata.Namespace, pvc.Metadata.Name, patch); err != nil {
+		return fmt.Errorf("failed to patch PVC: %s", err)
+	}
+
+	log.Info("grew PVC")
+	return nil
+}
+
+// isResizing checks whether the conditions of the given PVC show a resize in
+// progress.
+func isResizing(pvc persistentVolumeClaim) bool {
+	for _, cond := range pvc.Status.Conditions {
+		switch cond.Type {
+		case "Resizing", "FileSystemResizePending":
+			if cond.Status == "True" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Autoscaler) pvcLog(pvc persistentVolumeClaim) *logrus.Entry {
+	return a.log.WithFields(logrus.Fields{
+		"namespace": pvc.Metadata.Namespace,
+		"pvc":       pvc.Metadata.Name,
+	})
+}
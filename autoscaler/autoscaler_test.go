@@ -0,0 +1,265 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autoscaler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testDriverName = "dobs.csi.digitalocean.com"
+
+// fakeAPIServer serves the Kubernetes API requests of the autoscaler from
+// canned objects and records the patches it receives.
+type fakeAPIServer struct {
+	storageClasses []any
+	pvcs           []any
+	nodes          []string
+	// summaries maps node names to the PVC usage they report, keyed by
+	// namespace/name.
+	summaries map[string]map[string][2]int64
+
+	mu      sync.Mutex
+	patches map[string]map[string]any
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list := func(items []any) {
+		json.NewEncoder(w).Encode(map[string]any{"metadata": map[string]any{}, "items": items})
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/apis/storage.k8s.io/v1/storageclasses":
+		list(f.storageClasses)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/persistentvolumeclaims":
+		list(f.pvcs)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/nodes":
+		var items []any
+		for _, name := range f.nodes {
+			items = append(items, map[string]any{"metadata": map[string]any{"name": name}})
+		}
+		list(items)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/proxy/stats/summary"):
+		nodeName := strings.Split(r.URL.Path, "/")[4]
+		usage, ok := f.summaries[nodeName]
+		if !ok {
+			http.Error(w, "kubelet unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		var volumes []any
+		for key, u := range usage {
+			ns, name, _ := strings.Cut(key, "/")
+			volumes = append(volumes, map[string]any{
+				"name":          "data",
+				"capacityBytes": u[0],
+				"usedBytes":     u[1],
+				"pvcRef":        map[string]any{"namespace": ns, "name": name},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"pods": []any{map[string]any{"volume": volumes}}})
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/"):
+		if ct := r.Header.Get("Content-Type"); ct != "application/merge-patch+json" {
+			http.Error(w, "unexpected content type "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		var patch map[string]any
+		if err := json.Unmarshal(b, &patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.URL.Path, "/")
+		f.mu.Lock()
+		f.patches[parts[4]+"/"+parts[6]] = patch
+		f.mu.Unlock()
+		w.Write([]byte("{}"))
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func testStorageClass(name, provisioner string, allowExpansion bool, annotations map[string]string) map[string]any {
+	return map[string]any{
+		"metadata":             map[string]any{"name": name, "annotations": annotations},
+		"provisioner":          provisioner,
+		"allowVolumeExpansion": allowExpansion,
+	}
+}
+
+func testPVC(name, sc, requested, capacity string, annotations map[string]string) map[string]any {
+	return map[string]any{
+		"metadata": map[string]any{"name": name, "namespace": "default", "annotations": annotations},
+		"spec": map[string]any{
+			"storageClassName": sc,
+			"volumeMode":       "Filesystem",
+			"resources":        map[string]any{"requests": map[string]string{"storage": requested}},
+		},
+		"status": map[string]any{
+			"phase":    "Bound",
+			"capacity": map[string]string{"storage": capacity},
+		},
+	}
+}
+
+func TestAutoscalerSync(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	enabled := map[string]string{AnnotationEnabled: "true"}
+
+	api := &fakeAPIServer{
+		storageClasses: []any{
+			testStorageClass("do-autoscaled", testDriverName, true, map[string]string{
+				AnnotationEnabled:   "true",
+				AnnotationThreshold: "80%",
+				AnnotationStep:      "25%",
+				AnnotationCooldown:  "1h",
+			}),
+			testStorageClass("do-block-storage", testDriverName, true, nil),
+			testStorageClass("do-no-expansion", testDriverName, false, enabled),
+			testStorageClass("other", "other.csi.example.com", true, enabled),
+		},
+		pvcs: []any{
+			// grown by 25%
+			testPVC("full", "do-autoscaled", "100Gi", "100Gi", nil),
+			// below the threshold
+			testPVC("empty", "do-autoscaled", "100Gi", "100Gi", nil),
+			// resized within the cooldown
+			testPVC("cooling-down", "do-autoscaled", "100Gi", "100Gi", map[string]string{
+				AnnotationLastResizedAt: now.Add(-30 * time.Minute).Format(time.RFC3339),
+			}),
+			// resized before the cooldown, capped by its own maximum size
+			testPVC("capped", "do-autoscaled", "100Gi", "100Gi", map[string]string{
+				AnnotationLastResizedAt: now.Add(-2 * time.Hour).Format(time.RFC3339),
+				AnnotationMaxSize:       "110Gi",
+			}),
+			// at its maximum size
+			testPVC("at-max", "do-autoscaled", "100Gi", "100Gi", map[string]string{
+				AnnotationMaxSize: "100Gi",
+			}),
+			// being resized
+			testPVC("resizing", "do-autoscaled", "200Gi", "100Gi", nil),
+			// not opted in
+			testPVC("not-enabled", "do-block-storage", "100Gi", "100Gi", nil),
+			// opted in by the PVC itself
+			testPVC("pvc-enabled", "do-block-storage", "10Gi", "10Gi", enabled),
+			// opted out by the PVC itself
+			testPVC("pvc-disabled", "do-autoscaled", "100Gi", "100Gi", map[string]string{AnnotationEnabled: "false"}),
+			// storage class does not allow expansion
+			testPVC("no-expansion", "do-no-expansion", "100Gi", "100Gi", nil),
+			// storage class of another driver
+			testPVC("other", "other", "100Gi", "100Gi", nil),
+			// not mounted
+			testPVC("unmounted", "do-autoscaled", "100Gi", "100Gi", nil),
+		},
+		nodes: []string{"node-1", "node-2", "node-unreachable"},
+		summaries: map[string]map[string][2]int64{
+			"node-1": {
+				"default/full":         {100 * giB, 90 * giB},
+				"default/empty":        {100 * giB, 10 * giB},
+				"default/cooling-down": {100 * giB, 95 * giB},
+				"default/capped":       {100 * giB, 95 * giB},
+			},
+			"node-2": {
+				"default/at-max":       {100 * giB, 95 * giB},
+				"default/resizing":     {100 * giB, 95 * giB},
+				"default/not-enabled":  {100 * giB, 95 * giB},
+				"default/pvc-enabled":  {10 * giB, 9 * giB},
+				"default/pvc-disabled": {100 * giB, 95 * giB},
+				"default/no-expansion": {100 * giB, 95 * giB},
+				"default/other":        {100 * giB, 95 * giB},
+			},
+		},
+		patches: map[string]map[string]any{},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	a := New(logrus.New().WithField("test_enabled", true), NewKubeClient(srv.URL), Config{
+		DriverName: testDriverName,
+		Interval:   time.Minute,
+	})
+	a.now = func() time.Time { return now }
+
+	if err := a.Sync(context.Background()); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	got := map[string]string{}
+	for key, patch := range api.patches {
+		storage := patch["spec"].(map[string]any)["resources"].(map[string]any)["requests"].(map[string]any)["storage"]
+		resizedAt := patch["metadata"].(map[string]any)["annotations"].(map[string]any)[AnnotationLastResizedAt]
+		if resizedAt != now.Format(time.RFC3339) {
+			t.Errorf("got last resize %v for %s, want %s", resizedAt, key, now.Format(time.RFC3339))
+		}
+		got[key] = fmt.Sprint(storage)
+	}
+
+	want := map[string]string{
+		"default/full":        "125Gi",
+		"default/capped":      "110Gi",
+		"default/pvc-enabled": "12Gi",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		var keys []string
+		for key := range got {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		t.Errorf("got patches %v for %v, want %v", got, keys, want)
+	}
+}
+
+func TestAutoscalerSyncDryRun(t *testing.T) {
+	api := &fakeAPIServer{
+		storageClasses: []any{
+			testStorageClass("do-autoscaled", testDriverName, true, map[string]string{AnnotationEnabled: "true"}),
+		},
+		pvcs: []any{
+			testPVC("full", "do-autoscaled", "100Gi", "100Gi", nil),
+		},
+		nodes: []string{"node-1"},
+		summaries: map[string]map[string][2]int64{
+			"node-1": {"default/full": {100 * giB, 90 * giB}},
+		},
+		patches: map[string]map[string]any{},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	a := New(logrus.New().WithField("test_enabled", true), NewKubeClient(srv.URL), Config{
+		DriverName: testDriverName,
+		Interval:   time.Minute,
+		DryRun:     true,
+	})
+
+	if err := a.Sync(context.Background()); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(api.patches) != 0 {
+		t.Errorf("got patches %v in dry run, want none", api.patches)
+	}
+}
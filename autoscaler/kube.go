@@ -0,0 +1,257 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autoscaler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// listPageSize is the number of objects requested per page when listing.
+	listPageSize = 500
+
+	requestTimeout = 30 * time.Second
+)
+
+// KubeClient is a minimal client of the Kubernetes API, covering the few
+// requests the autoscaler makes.
+type KubeClient struct {
+	baseURL string
+	// tokenPath is the file the bearer token is read from on every request,
+	// as service account tokens are rotated. No token is sent if it is empty.
+	tokenPath string
+	http      *http.Client
+}
+
+// NewKubeClient returns a KubeClient talking to the API server at the given
+// URL without authentication, e.g., through `kubectl proxy`.
+func NewKubeClient(apiURL string) *KubeClient {
+	return &KubeClient{
+		baseURL: strings.TrimSuffix(apiURL, "/"),
+		http:    &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// NewInClusterKubeClient returns a KubeClient authenticating with the service
+// account of the pod it runs in.
+func NewInClusterKubeClient() (*KubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set when running in a cluster")
+	}
+
+	caCert, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("failed to parse cluster CA certificate")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	return &KubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenPath: serviceAccountDir + "/token",
+		http:      &http.Client{Transport: transport, Timeout: requestTimeout},
+	}, nil
+}
+
+// statusError is returned for responses with an unexpected status code.
+type statusError struct {
+	method, path string
+	code         int
+	body         string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s failed with status %d: %s", e.method, e.path, e.code, e.body)
+}
+
+func (c *KubeClient) do(ctx context.Context, method, path, contentType string, body []byte, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.tokenPath != "" {
+		token, err := os.ReadFile(c.tokenPath)
+		if err != nil {
+			return fmt.Errorf("failed to read service account token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{method: method, path: path, code: resp.StatusCode, body: strings.TrimSpace(string(b))}
+	}
+
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %s", method, path, err)
+	}
+	return nil
+}
+
+func (c *KubeClient) get(ctx context.Context, path string, v any) error {
+	return c.do(ctx, http.MethodGet, path, "", nil, v)
+}
+
+// mergePatch applies the given JSON merge patch to the object at the given
+// path.
+func (c *KubeClient) mergePatch(ctx context.Context, path string, patch any) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPatch, path, "application/merge-patch+json", body, nil)
+}
+
+// listAll lists all objects of the collection at the given path, paging
+// through the results.
+func listAll[T any](ctx context.Context, c *KubeClient, path string) ([]T, error) {
+	var items []T
+	cont := ""
+	for {
+		query := url.Values{"limit": {fmt.Sprint(listPageSize)}}
+		if cont != "" {
+			query.Set("continue", cont)
+		}
+
+		var list struct {
+			Metadata struct {
+				Continue string `json:"continue"`
+			} `json:"metadata"`
+			Items []T `json:"items"`
+		}
+		if err := c.get(ctx, path+"?"+query.Encode(), &list); err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+
+		if list.Metadata.Continue == "" {
+			return items, nil
+		}
+		cont = list.Metadata.Continue
+	}
+}
+
+type objectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type storageClass struct {
+	Metadata             objectMeta `json:"metadata"`
+	Provisioner          string     `json:"provisioner"`
+	AllowVolumeExpansion *bool      `json:"allowVolumeExpansion"`
+}
+
+type persistentVolumeClaim struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		StorageClassName *string `json:"storageClassName"`
+		VolumeMode       *string `json:"volumeMode"`
+		Resources        struct {
+			Requests map[string]string `json:"requests"`
+		} `json:"resources"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string            `json:"phase"`
+		Capacity   map[string]string `json:"capacity"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+type node struct {
+	Metadata objectMeta `json:"metadata"`
+}
+
+// statsSummary is the part of the kubelet's stats summary holding the usage
+// of pod volumes.
+type statsSummary struct {
+	Pods []struct {
+		Volumes []struct {
+			CapacityBytes *int64 `json:"capacityBytes"`
+			UsedBytes     *int64 `json:"usedBytes"`
+			PVCRef        *struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"pvcRef"`
+		} `json:"volume"`
+	} `json:"pods"`
+}
+
+func (c *KubeClient) listStorageClasses(ctx context.Context) ([]storageClass, error) {
+	return listAll[storageClass](ctx, c, "/apis/storage.k8s.io/v1/storageclasses")
+}
+
+func (c *KubeClient) listPersistentVolumeClaims(ctx context.Context) ([]persistentVolumeClaim, error) {
+	return listAll[persistentVolumeClaim](ctx, c, "/api/v1/persistentvolumeclaims")
+}
+
+func (c *KubeClient) listNodes(ctx context.Context) ([]node, error) {
+	return listAll[node](ctx, c, "/api/v1/nodes")
+}
+
+// nodeStatsSummary returns the stats summary of the kubelet on the given
+// node, proxied through the API server.
+func (c *KubeClient) nodeStatsSummary(ctx context.Context, nodeName string) (*statsSummary, error) {
+	var summary statsSummary
+	if err := c.get(ctx, "/api/v1/nodes/"+url.PathEscape(nodeName)+"/proxy/stats/summary", &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// patchPersistentVolumeClaim applies the given JSON merge patch to a PVC.
+func (c *KubeClient) patchPersistentVolumeClaim(ctx context.Context, namespace, name string, patch any) error {
+	return c.mergePatch(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/persistentvolumeclaims/"+url.PathEscape(name), patch)
+}
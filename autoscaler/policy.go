@@ -0,0 +1,161 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autoscaler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// annotationPrefix is the prefix of the StorageClass and PVC annotations
+	// configuring the autoscaler.
+	annotationPrefix = "autoscaler.dobs.csi.digitalocean.com/"
+
+	// AnnotationEnabled opts the PVCs of a StorageClass, or a single PVC,
+	// into autoscaling.
+	AnnotationEnabled = annotationPrefix + "enabled"
+
+	// AnnotationThreshold is the usage, in percent of the capacity, at which
+	// a PVC is grown.
+	AnnotationThreshold = annotationPrefix + "threshold"
+
+	// AnnotationStep is how much a PVC is grown by, either as a quantity
+	// (e.g., 10Gi) or in percent of its current size (e.g., 20%).
+	AnnotationStep = annotationPrefix + "step"
+
+	// AnnotationMaxSize is the size a PVC is never grown beyond.
+	AnnotationMaxSize = annotationPrefix + "max-size"
+
+	// AnnotationCooldown is the minimum duration between two resizes of a
+	// PVC.
+	AnnotationCooldown = annotationPrefix + "cooldown"
+
+	// AnnotationLastResizedAt records on a PVC when the autoscaler last grew
+	// it.
+	AnnotationLastResizedAt = annotationPrefix + "last-resized-at"
+
+	// maxVolumeSize is the maximum size of DigitalOcean volumes.
+	maxVolumeSize = 16 * tiB
+
+	defaultThreshold   = 80
+	defaultStepPercent = 20
+	defaultCooldown    = time.Hour
+)
+
+// policy describes how a PVC is autoscaled.
+type policy struct {
+	enabled bool
+	// threshold is in percent of the capacity.
+	threshold float64
+	// Exactly one of stepBytes and stepPercent is set.
+	stepBytes   int64
+	stepPercent float64
+	maxSize     int64
+	cooldown    time.Duration
+}
+
+// policyFor returns the autoscaling policy of a PVC from the annotations of
+// its StorageClass and of the PVC itself, where the latter take precedence.
+func policyFor(scAnnotations, pvcAnnotations map[string]string) (policy, error) {
+	annotations := map[string]string{}
+	for k, v := range scAnnotations {
+		annotations[k] = v
+	}
+	for k, v := range pvcAnnotations {
+		annotations[k] = v
+	}
+
+	p := policy{
+		threshold:   defaultThreshold,
+		stepPercent: defaultStepPercent,
+		maxSize:     maxVolumeSize,
+		cooldown:    defaultCooldown,
+	}
+
+	if val, ok := annotations[AnnotationEnabled]; ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return p, fmt.Errorf("annotation %q must be a boolean, got %q", AnnotationEnabled, val)
+		}
+		p.enabled = enabled
+	}
+
+	if val, ok := annotations[AnnotationThreshold]; ok {
+		threshold, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+		if err != nil || threshold <= 0 || threshold >= 100 {
+			return p, fmt.Errorf("annotation %q must be a percentage between 0 and 100 (exclusive), got %q", AnnotationThreshold, val)
+		}
+		p.threshold = threshold
+	}
+
+	if val, ok := annotations[AnnotationStep]; ok {
+		if percent, isPercent := strings.CutSuffix(val, "%"); isPercent {
+			stepPercent, err := strconv.ParseFloat(percent, 64)
+			if err != nil || stepPercent <= 0 {
+				return p, fmt.Errorf("annotation %q must be a positive percentage or quantity, got %q", AnnotationStep, val)
+			}
+			p.stepPercent = stepPercent
+		} else {
+			stepBytes, err := parseQuantity(val)
+			if err != nil || stepBytes <= 0 {
+				return p, fmt.Errorf("annotation %q must be a positive percentage or quantity, got %q", AnnotationStep, val)
+			}
+			p.stepBytes = stepBytes
+			p.stepPercent = 0
+		}
+	}
+
+	if val, ok := annotations[AnnotationMaxSize]; ok {
+		maxSize, err := parseQuantity(val)
+		if err != nil || maxSize <= 0 {
+			return p, fmt.Errorf("annotation %q must be a positive quantity, got %q", AnnotationMaxSize, val)
+		}
+		// DO volumes cannot be larger anyway
+		p.maxSize = min(maxSize, maxVolumeSize)
+	}
+
+	if val, ok := annotations[AnnotationCooldown]; ok {
+		cooldown, err := time.ParseDuration(val)
+		if err != nil || cooldown < 0 {
+			return p, fmt.Errorf("annotation %q must be a non-negative duration, got %q", AnnotationCooldown, val)
+		}
+		p.cooldown = cooldown
+	}
+
+	return p, nil
+}
+
+// nextSize returns the size a PVC of the given size is grown to, which is
+// capped at the maximum size. It returns the given size if the PVC cannot be
+// grown anymore.
+func (p policy) nextSize(size int64) int64 {
+	step := p.stepBytes
+	if p.stepPercent > 0 {
+		step = int64(float64(size) * p.stepPercent / 100)
+	}
+
+	next := roundUpGiB(size + max(step, 1))
+	// the cap is rounded down, as DO volumes are sized in whole GiB
+	maxSize := p.maxSize / giB * giB
+	if next > maxSize {
+		next = maxSize
+	}
+	return max(next, size)
+}
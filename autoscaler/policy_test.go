@@ -0,0 +1,177 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autoscaler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		quantity string
+		want     int64
+		wantErr  bool
+	}{
+		{quantity: "1073741824", want: 1 * giB},
+		{quantity: "10Gi", want: 10 * giB},
+		{quantity: "1.5Ti", want: 3 * tiB / 2},
+		{quantity: "500Mi", want: 500 * miB},
+		{quantity: "10G", want: 10_000_000_000},
+		{quantity: "1k", want: 1000},
+		{quantity: "", wantErr: true},
+		{quantity: "-1Gi", wantErr: true},
+		{quantity: "10GB", wantErr: true},
+		{quantity: "100Ei", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.quantity, func(t *testing.T) {
+			got, err := parseQuantity(test.quantity)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got %d bytes, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		sc      map[string]string
+		pvc     map[string]string
+		want    policy
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: policy{threshold: 80, stepPercent: 20, maxSize: maxVolumeSize, cooldown: time.Hour},
+		},
+		{
+			name: "enabled by storage class",
+			sc: map[string]string{
+				AnnotationEnabled:   "true",
+				AnnotationThreshold: "90%",
+				AnnotationStep:      "10Gi",
+				AnnotationMaxSize:   "1Ti",
+				AnnotationCooldown:  "30m",
+			},
+			want: policy{enabled: true, threshold: 90, stepBytes: 10 * giB, maxSize: 1 * tiB, cooldown: 30 * time.Minute},
+		},
+		{
+			name: "PVC overrides storage class",
+			sc: map[string]string{
+				AnnotationEnabled:   "true",
+				AnnotationThreshold: "90",
+			},
+			pvc: map[string]string{
+				AnnotationEnabled: "false",
+				AnnotationStep:    "50%",
+			},
+			want: policy{threshold: 90, stepPercent: 50, maxSize: maxVolumeSize, cooldown: time.Hour},
+		},
+		{
+			name: "maximum size is capped",
+			pvc:  map[string]string{AnnotationMaxSize: "20Ti"},
+			want: policy{threshold: 80, stepPercent: 20, maxSize: maxVolumeSize, cooldown: time.Hour},
+		},
+		{
+			name:    "invalid threshold",
+			pvc:     map[string]string{AnnotationThreshold: "100%"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid step",
+			pvc:     map[string]string{AnnotationStep: "-10%"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cooldown",
+			pvc:     map[string]string{AnnotationCooldown: "1 hour"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := policyFor(test.sc, test.pvc)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if !test.wantErr && got != test.want {
+				t.Errorf("got policy %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPolicyNextSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy policy
+		size   int64
+		want   int64
+	}{
+		{
+			name:   "percentage step is rounded up to whole GiB",
+			policy: policy{stepPercent: 20, maxSize: maxVolumeSize},
+			size:   10 * giB,
+			want:   12 * giB,
+		},
+		{
+			name:   "small percentage step grows by at least a GiB",
+			policy: policy{stepPercent: 1, maxSize: maxVolumeSize},
+			size:   10 * giB,
+			want:   11 * giB,
+		},
+		{
+			name:   "absolute step",
+			policy: policy{stepBytes: 50 * giB, maxSize: maxVolumeSize},
+			size:   100 * giB,
+			want:   150 * giB,
+		},
+		{
+			name:   "capped at maximum size",
+			policy: policy{stepPercent: 50, maxSize: 120 * giB},
+			size:   100 * giB,
+			want:   120 * giB,
+		},
+		{
+			name:   "capped at maximum volume size",
+			policy: policy{stepPercent: 50, maxSize: maxVolumeSize},
+			size:   15 * tiB,
+			want:   maxVolumeSize,
+		},
+		{
+			name:   "at maximum size",
+			policy: policy{stepPercent: 50, maxSize: 100 * giB},
+			size:   100 * giB,
+			want:   100 * giB,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.policy.nextSize(test.size); got != test.want {
+				t.Errorf("got size %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package autoscaler
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+const (
+	_   = iota
+	kiB = 1 << (10 * iota)
+	miB
+	giB
+	tiB
+)
+
+// quantitySuffixes maps the suffixes of Kubernetes quantities to their
+// multipliers.
+var quantitySuffixes = map[string]float64{
+	"":   1,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+	"Ei": 1 << 60,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"E":  1e18,
+}
+
+var quantityRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(Ki|Mi|Gi|Ti|Pi|Ei|k|M|G|T|P|E)?$`)
+
+// parseQuantity parses a Kubernetes storage quantity such as 10Gi into bytes,
+// rounding up fractional bytes.
+func parseQuantity(s string) (int64, error) {
+	m := quantityRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q: %s", s, err)
+	}
+
+	bytes := math.Ceil(value * quantitySuffixes[m[2]])
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("quantity %q is too large", s)
+	}
+	return int64(bytes), nil
+}
+
+// formatGiB formats the given number of bytes as a quantity in whole GiB,
+// rounding up.
+func formatGiB(bytes int64) string {
+	return fmt.Sprintf("%dGi", roundUpGiB(bytes)/giB)
+}
+
+// roundUpGiB rounds the given number of bytes up to whole GiB, the
+// granularity of DigitalOcean volume sizes.
+func roundUpGiB(bytes int64) int64 {
+	return (bytes + giB - 1) / giB * giB
+}
@@ -24,6 +24,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/digitalocean/csi-digitalocean/driver"
 )
@@ -40,7 +41,22 @@ func main() {
 		defaultVolumesPageSize = flag.Uint("default-volumes-page-size", 0, "The default page size used when paging through volumes results (default: do not specify and let the DO API choose)")
 		doAPIRateLimitQPS      = flag.Float64("do-api-rate-limit", 0, "Impose QPS rate limit on DigitalOcean API usage (default: do not rate limit)")
 		validateAttachment     = flag.Bool("validate-attachment", false, "Validate if the attachment has fully completed before formatting/mounting the device")
-		volumeLimit            = flag.Uint("volume-limit", 7, "Volumes per node limit to report; needs to match limit imposed by DO storage backend (honored by Node service only)")
+		verifyDeviceIdentity   = flag.Bool("verify-device-identity", true, "Verify the SCSI vendor, model, and serial of a device match the volume before formatting or mounting it (honored by Node service only)")
+		reconcileMounts        = flag.Bool("reconcile-mounts", false, "Clean up stale staging and publish mounts on startup (honored by Node service only)")
+		ephemeralVolumeToken   = flag.String("ephemeral-volume-token", "", "DigitalOcean access token scoped to block storage, used to create, attach, and delete ephemeral inline volumes (honored by Node service only)")
+		sweepEphemeralVolumes  = flag.Bool("sweep-ephemeral-volumes", false, "Periodically delete detached ephemeral inline volumes carrying the tag given by --do-tag, which must be set (honored by Controller service only)")
+		trimInterval           = flag.Duration("trim-interval", 0, "Interval to discard unused blocks of staged filesystems at (default: do not trim) (honored by Node service only)")
+		trimConcurrency        = flag.Uint("trim-concurrency", 1, "Number of volumes to trim at once (honored by Node service only)")
+		trimBandwidth          = flag.Uint("trim-bandwidth", 0, "Limit of discarded MiB per second across all volumes (default: do not limit) (honored by Node service only)")
+		freezeToken            = flag.String("freeze-token", "", "Shared secret authenticating the requests of the controller to freeze filesystems for snapshots on nodes (default: do not freeze filesystems)")
+		freezePort             = flag.Uint("freeze-port", 9899, "Port the node plugin serves freeze requests of the controller on, on the droplet's private IPv4 address")
+		freezeTimeout          = flag.Duration("freeze-timeout", 30*time.Second, "Time after which the node plugin thaws frozen filesystems at the latest (honored by Controller service only)")
+		volumeLimit            = flag.Uint("volume-limit", 7, "Volumes per node limit to report, reduced by the DO volumes attached outside of the driver; needs to match limit imposed by DO storage backend (honored by Node service only)")
+		listSnapshotsByTag     = flag.Bool("list-snapshots-by-tag", false, "Only list volume snapshots carrying the tag given by --do-tag (honored by Controller service only)")
+		preformatVolumes       = flag.Bool("preformat-volumes", false, "Let DigitalOcean format new volumes at creation time; can be overridden per StorageClass (honored by Controller service only)")
+		fsckPolicy             = flag.String("fsck-policy", "never", "Check filesystems before mounting them: never, check-only, or auto-repair; can be overridden per StorageClass (honored by Node service only)")
+		formatPolicy           = flag.String("format-policy", "if-unformatted", "When to format volumes: never, if-unformatted, or require-expected-fs; can be overridden per StorageClass (honored by Node service only)")
+		mounter                = flag.String("mounter", "exec", "How to mount and probe volumes: exec (mount, findmnt, and blkid) or native (system calls and procfs) (honored by Node service only)")
 		version                = flag.Bool("version", false, "Print the version and exit.")
 	)
 	flag.Parse()
@@ -65,7 +81,22 @@ func main() {
 		DefaultVolumesPageSize: *defaultVolumesPageSize,
 		DOAPIRateLimitQPS:      *doAPIRateLimitQPS,
 		ValidateAttachment:     *validateAttachment,
+		VerifyDeviceIdentity:   *verifyDeviceIdentity,
+		ReconcileMounts:        *reconcileMounts,
+		EphemeralVolumeToken:   *ephemeralVolumeToken,
+		SweepEphemeralVolumes:  *sweepEphemeralVolumes,
+		TrimInterval:           *trimInterval,
+		TrimConcurrency:        *trimConcurrency,
+		TrimBandwidth:          *trimBandwidth,
+		FreezeToken:            *freezeToken,
+		FreezePort:             *freezePort,
+		FreezeTimeout:          *freezeTimeout,
 		VolumeLimit:            *volumeLimit,
+		ListSnapshotsByTag:     *listSnapshotsByTag,
+		PreformatVolumes:       *preformatVolumes,
+		FsckPolicy:             *fsckPolicy,
+		FormatPolicy:           *formatPolicy,
+		Mounter:                *mounter,
 	})
 	if err != nil {
 		log.Fatalln(err)
@@ -0,0 +1,88 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/digitalocean/csi-digitalocean/autoscaler"
+	"github.com/digitalocean/csi-digitalocean/driver"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		driverName = flag.String("driver-name", driver.DefaultDriverName, "Provisioner of the storage classes whose PVCs are autoscaled.")
+		apiURL     = flag.String("kube-api-url", "", "URL of the Kubernetes API server to talk to without authentication, e.g., through kubectl proxy (default: use the in-cluster configuration)")
+		interval   = flag.Duration("interval", time.Minute, "How often to check the usage of PVCs.")
+		dryRun     = flag.Bool("dry-run", false, "Only log the PVCs that would be grown.")
+		logLevel   = flag.String("log-level", "info", "Log level: debug, info, warn, or error.")
+		version    = flag.Bool("version", false, "Print the version and exit.")
+	)
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s - %s (%s)\n", driver.GetVersion(), driver.GetCommit(), driver.GetTreeState())
+		os.Exit(0)
+	}
+
+	if *interval <= 0 {
+		log.Fatalln("interval must be positive")
+	}
+
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger := logrus.New()
+	logger.SetLevel(level)
+
+	var client *autoscaler.KubeClient
+	if *apiURL != "" {
+		client = autoscaler.NewKubeClient(*apiURL)
+	} else {
+		client, err = autoscaler.NewInClusterKubeClient()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	a := autoscaler.New(logger.WithField("version", driver.GetVersion()), client, autoscaler.Config{
+		DriverName: *driverName,
+		Interval:   *interval,
+		DryRun:     *dryRun,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	a.Run(ctx)
+}
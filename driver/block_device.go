@@ -0,0 +1,174 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// blockDeviceRescanInterval is how often the size of a rescanned block
+	// device is checked.
+	blockDeviceRescanInterval = 500 * time.Millisecond
+
+	// blockDeviceRescanTimeout bounds how long it may take for a rescanned
+	// block device to report its new size.
+	blockDeviceRescanTimeout = 30 * time.Second
+)
+
+// BlockDeviceResizer makes the kernel pick up the new size of resized block
+// devices.
+type BlockDeviceResizer interface {
+	// Resize rescans the block device at the given path, which may also be a
+	// file bind mounted from the device, until it reports at least the
+	// required size. It returns the size of the device in bytes.
+	Resize(ctx context.Context, devicePath string, requiredBytes int64) (int64, error)
+}
+
+// sysfsBlockDeviceResizer rescans SCSI block devices through sysfs.
+type sysfsBlockDeviceResizer struct {
+	log          *logrus.Entry
+	sysPath      string
+	stat         func(path string, stat *unix.Stat_t) error
+	pollInterval time.Duration
+	timeout      time.Duration
+}
+
+// newBlockDeviceResizer returns a new BlockDeviceResizer operating on the
+// host's sysfs.
+func newBlockDeviceResizer(log *logrus.Entry) BlockDeviceResizer {
+	return &sysfsBlockDeviceResizer{
+		log:          log.WithField("component", "block_device_resizer"),
+		sysPath:      "/sys",
+		stat:         unix.Stat,
+		pollInterval: blockDeviceRescanInterval,
+		timeout:      blockDeviceRescanTimeout,
+	}
+}
+
+func (r *sysfsBlockDeviceResizer) Resize(ctx context.Context, devicePath string, requiredBytes int64) (int64, error) {
+	devDir, err := blockDeviceSysfsDir(r.sysPath, r.stat, devicePath)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := readBlockDeviceSize(devDir)
+	if err != nil {
+		return 0, err
+	}
+
+	log := r.log.WithFields(logrus.Fields{
+		"device_path":    devicePath,
+		"sysfs_dir":      devDir,
+		"bytes_total":    size,
+		"bytes_required": requiredBytes,
+	})
+	if requiredBytes > 0 && size >= requiredBytes {
+		log.Info("block device already has the required size")
+		return size, nil
+	}
+
+	// writing to the rescan attribute makes the SCSI layer re-read the
+	// capacity of the device
+	log.Info("rescanning block device")
+	if err := os.WriteFile(filepath.Join(devDir, "device", "rescan"), []byte("1"), 0); err != nil {
+		return 0, fmt.Errorf("failed to rescan block device %s: %s", devicePath, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		size, err = readBlockDeviceSize(devDir)
+		if err != nil {
+			return 0, err
+		}
+		if size >= requiredBytes {
+			return size, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("block device %s reports %d bytes after rescanning, want at least %d bytes: %s", devicePath, size, requiredBytes, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// blockDeviceSysfsDir returns the sysfs directory of the block device at the
+// given path, which may also be a file bind mounted from the device.
+func blockDeviceSysfsDir(sysPath string, stat func(string, *unix.Stat_t) error, devicePath string) (string, error) {
+	var st unix.Stat_t
+	if err := stat(devicePath, &st); err != nil {
+		return "", fmt.Errorf("failed to stat %s: %s", devicePath, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", devicePath)
+	}
+
+	rdev := uint64(st.Rdev)
+	return filepath.Join(sysPath, "dev", "block", fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev))), nil
+}
+
+// readVolumeIOStats returns the I/O counters of the block device at the given
+// path.
+func readVolumeIOStats(sysPath string, stat func(string, *unix.Stat_t) error, devicePath string) (blockIOStats, error) {
+	devDir, err := blockDeviceSysfsDir(sysPath, stat, devicePath)
+	if err != nil {
+		return blockIOStats{}, err
+	}
+	return readBlockIOStats(filepath.Join(devDir, "stat"))
+}
+
+// withBlockIOStats adds the I/O counters of the block device at the given
+// path to stats. The counters are nice to have, so failing to read them must
+// not fail retrieving the capacity.
+func withBlockIOStats(log *logrus.Entry, sysPath string, stat func(string, *unix.Stat_t) error, devicePath string, stats volumeStatistics) volumeStatistics {
+	ioStats, err := readVolumeIOStats(sysPath, stat, devicePath)
+	if err != nil {
+		log.WithError(err).WithField("volume_path", devicePath).Warn("failed to read I/O counters of block volume")
+		return stats
+	}
+	stats.ioStats = &ioStats
+	return stats
+}
+
+// readBlockDeviceSize returns the size in bytes of the block device with the
+// given sysfs directory.
+func readBlockDeviceSize(devDir string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(devDir, "size"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read block device size: %s", err)
+	}
+
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed block device size in %s: %s", devDir, err)
+	}
+	return sectors * sectorSize, nil
+}
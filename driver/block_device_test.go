@@ -0,0 +1,147 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func TestBlockDeviceResizer(t *testing.T) {
+	const devicePath = "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod1"
+
+	tests := []struct {
+		name          string
+		sizeBefore    int64
+		sizeAfter     int64
+		requiredBytes int64
+		wantSize      int64
+		wantRescan    bool
+		wantErr       bool
+	}{
+		{
+			name:          "device already has the required size",
+			sizeBefore:    20 * giB,
+			requiredBytes: 20 * giB,
+			wantSize:      20 * giB,
+		},
+		{
+			name:          "device grows after rescan",
+			sizeBefore:    10 * giB,
+			sizeAfter:     20 * giB,
+			requiredBytes: 20 * giB,
+			wantSize:      20 * giB,
+			wantRescan:    true,
+		},
+		{
+			name:       "no required size",
+			sizeBefore: 10 * giB,
+			wantSize:   10 * giB,
+			wantRescan: true,
+		},
+		{
+			name:          "device does not grow",
+			sizeBefore:    10 * giB,
+			requiredBytes: 20 * giB,
+			wantRescan:    true,
+			wantErr:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysPath := t.TempDir()
+			devDir := filepath.Join(sysPath, "dev", "block", "8:16")
+			mustMkdirAll(t, filepath.Join(devDir, "device"))
+			writeSize := func(size int64) {
+				mustWriteFile(t, filepath.Join(devDir, "size"), strconv.FormatInt(size/sectorSize, 10)+"\n")
+			}
+			writeSize(test.sizeBefore)
+
+			r := &sysfsBlockDeviceResizer{
+				log:     logrus.New().WithField("test_enabled", true),
+				sysPath: sysPath,
+				stat: func(path string, st *unix.Stat_t) error {
+					if path != devicePath {
+						return unix.ENOENT
+					}
+					st.Mode = unix.S_IFBLK | 0660
+					st.Rdev = unix.Mkdev(8, 16)
+					return nil
+				},
+				pollInterval: time.Millisecond,
+				timeout:      100 * time.Millisecond,
+			}
+
+			if test.sizeAfter > 0 {
+				// the kernel updates the size shortly after the rescan
+				go func() {
+					rescanPath := filepath.Join(devDir, "device", "rescan")
+					for {
+						if _, err := os.Stat(rescanPath); err == nil {
+							writeSize(test.sizeAfter)
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				}()
+			}
+
+			size, err := r.Resize(context.Background(), devicePath, test.requiredBytes)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if size != test.wantSize {
+				t.Errorf("got size %d, want %d", size, test.wantSize)
+			}
+
+			_, err = os.Stat(filepath.Join(devDir, "device", "rescan"))
+			if rescanned := err == nil; rescanned != test.wantRescan {
+				t.Errorf("got rescanned %t, want %t", rescanned, test.wantRescan)
+			}
+		})
+	}
+}
+
+func TestBlockDeviceSysfsDir(t *testing.T) {
+	stat := func(mode uint32) func(string, *unix.Stat_t) error {
+		return func(path string, st *unix.Stat_t) error {
+			st.Mode = mode
+			st.Rdev = unix.Mkdev(259, 3)
+			return nil
+		}
+	}
+
+	got, err := blockDeviceSysfsDir("/sys", stat(unix.S_IFBLK|0660), "/dev/nvme0n1")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if want := "/sys/dev/block/259:3"; got != want {
+		t.Errorf("got sysfs dir %q, want %q", got, want)
+	}
+
+	if _, err := blockDeviceSysfsDir("/sys", stat(unix.S_IFREG|0644), "/tmp/file"); err == nil {
+		t.Error("got no error for a regular file")
+	}
+}
@@ -71,14 +71,23 @@ const (
 	// maxVolumesPerDropletErrorMessage is the error message returned by the DO API
 	// when the per-droplet volume limit would be exceeded.
 	maxVolumesPerDropletErrorMessage = "cannot attach more volumes to the Droplet"
+
+	// readOnlyAttachmentTagPrefix prefixes the tag that records that a volume
+	// was published read-only to a droplet. The volume and droplet ID follow
+	// the prefix, so that the tag is unique and can be deleted on detach.
+	readOnlyAttachmentTagPrefix = "csi-read-only:"
 )
 
 var (
-	// DO currently only support a single node to be attached to a single node
-	// in read/write mode. This corresponds to `accessModes.ReadWriteOnce` in a
-	// PVC resource on Kubernetes
-	supportedAccessMode = &csi.VolumeCapability_AccessMode{
-		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	// DO currently only supports attaching a volume to a single node. This
+	// corresponds to `accessModes.ReadWriteOnce` and `ReadWriteOncePod` in a
+	// PVC resource on Kubernetes. A volume may also be used read-only on the
+	// single node it is attached to.
+	supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
 	}
 )
 
@@ -99,7 +108,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 	size, err := d.extractStorage(req.CapacityRange)
 	if err != nil {
-		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+		return nil, status.Errorf(capacityRangeErrorCode(err), "invalid capacity range: %v", err)
 	}
 
 	if req.AccessibilityRequirements != nil {
@@ -115,9 +124,59 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
+	encrypted, err := boolParameter(req.Parameters, parameterEncrypted, false)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if encrypted && requestedFsType(req.VolumeCapabilities) == "" {
+		return nil, status.Error(codes.InvalidArgument, "encryption is only supported for volumes with mount access type")
+	}
+
+	if policy, ok := req.Parameters[parameterFsckPolicy]; ok {
+		if _, err := parseFsckPolicy(policy); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if policy, ok := req.Parameters[parameterFormatPolicy]; ok {
+		if _, err := parseFormatPolicy(policy); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	requireLabel, err := boolParameter(req.Parameters, parameterRequireVolumeLabel, false)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if fsType := requestedFsType(req.VolumeCapabilities); fsType != "" {
+		if _, err := mkfsArgs(fsType, req.Parameters); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if requireLabel && !supportsVolumeLabel(fsType) {
+			return nil, status.Errorf(codes.InvalidArgument, "volume labels are not supported for filesystem type %q", fsType)
+		}
+	}
+
+	preformatFsType, fsLabel, err := d.extractPreformat(req, encrypted)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Volumes are identified by the request name. Should the volume be named
+	// after a template, the request name is kept in an ID tag instead.
 	volumeName := req.Name
+	var idTag string
+	if _, ok := req.Parameters[parameterVolumeNameTemplate]; ok {
+		volumeName, err = volumeNameFromTemplate(req.Name, req.Parameters)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		idTag = volumeIDTag(req.Name)
+	}
 
 	log := d.log.WithFields(logrus.Fields{
+		"req_name":                req.Name,
 		"volume_name":             volumeName,
 		"storage_size_giga_bytes": size / giB,
 		"method":                  "create_volume",
@@ -126,30 +185,44 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	log.Info("create volume called")
 
 	// get volume first, if it's created do no thing
-	volumes, _, err := d.storage.ListVolumes(ctx, &godo.ListVolumeParams{
-		Region: d.region,
-		Name:   volumeName,
-	})
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
+	var vol *godo.Volume
+	if idTag != "" {
+		vol, err = d.getVolumeByIDTag(ctx, idTag)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		volumes, _, err := d.storage.ListVolumes(ctx, &godo.ListVolumeParams{
+			Region: d.region,
+			Name:   volumeName,
+		})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 
-	// volume already exist, do nothing
-	if len(volumes) != 0 {
 		if len(volumes) > 1 {
 			return nil, fmt.Errorf("fatal issue: duplicate volume %q exists", volumeName)
 		}
-		vol := volumes[0]
+		if len(volumes) == 1 {
+			vol = &volumes[0]
+		}
+	}
 
-		if vol.SizeGigaBytes*giB != size {
+	// volume already exist, do nothing
+	if vol != nil {
+		// volumes created from a snapshot may be larger than requested, so
+		// accept any existing volume that satisfies the capacity range.
+		volSize := vol.SizeGigaBytes * giB
+		if volSize < size || (req.CapacityRange.GetLimitBytes() > 0 && volSize > req.CapacityRange.GetLimitBytes()) {
 			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("invalid option requested size: %d", size))
 		}
 
-		log.Info("volume already created")
+		log.WithField("volume_id", vol.ID).Info("volume already created")
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
 				VolumeId:      vol.ID,
 				CapacityBytes: vol.SizeGigaBytes * giB,
+				VolumeContext: newVolumeContext(req.Parameters, vol.FilesystemType),
 			},
 		}, nil
 	}
@@ -164,6 +237,9 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if d.doTag != "" {
 		volumeReq.Tags = append(volumeReq.Tags, d.doTag)
 	}
+	if idTag != "" {
+		volumeReq.Tags = append(volumeReq.Tags, idTag)
+	}
 
 	contentSource := req.GetVolumeContentSource()
 	var snapshot *godo.Snapshot
@@ -189,6 +265,13 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		log.Info("using snapshot as volume source")
 
 		volumeReq.SnapshotID = snapshotID
+	} else if preformatFsType != "" {
+		// Volumes restored from a snapshot carry the filesystem of the
+		// snapshot already, so we only let DO format empty volumes.
+		log = log.WithField("preformat_fs_type", preformatFsType)
+		log.Info("letting DO format the volume")
+		volumeReq.FilesystemType = preformatFsType
+		volumeReq.FilesystemLabel = fsLabel
 	}
 
 	log.WithField("volume_req", volumeReq).Info("creating volume")
@@ -201,6 +284,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	sizeGigaBytes := vol.SizeGigaBytes
 	if vol.SizeGigaBytes < volumeReq.SizeGigaBytes {
 		log.Info("resizing volume because its requested size is larger than the size of the backing snapshot")
 		action, _, err := d.storageActions.Resize(ctx, vol.ID, int(volumeReq.SizeGigaBytes), volumeReq.Region)
@@ -219,12 +303,14 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			}
 		}
 		log.Info("resize completed")
+		sizeGigaBytes = volumeReq.SizeGigaBytes
 	}
 
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      vol.ID,
-			CapacityBytes: size,
+			CapacityBytes: sizeGigaBytes * giB,
+			VolumeContext: newVolumeContext(req.Parameters, volumeReq.FilesystemType),
 			AccessibleTopology: []*csi.Topology{
 				{
 					Segments: map[string]string{
@@ -252,6 +338,56 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	return resp, nil
 }
 
+// extractPreformat returns the filesystem type and label DO should format the
+// requested volume with. It returns an empty filesystem type if the volume
+// should be formatted by the node instead.
+func (d *Driver) extractPreformat(req *csi.CreateVolumeRequest, encrypted bool) (string, string, error) {
+	preformat, err := boolParameter(req.Parameters, parameterPreformat, d.preformatVolumes)
+	if err != nil {
+		return "", "", err
+	}
+
+	fsType := requestedFsType(req.VolumeCapabilities)
+	if !preformat || fsType == "" {
+		return "", "", nil
+	}
+
+	if encrypted {
+		// DO formats the raw device, leaving no room for the LUKS header.
+		d.log.WithField("volume_name", req.Name).Info("not letting DO format encrypted volume")
+		return "", "", nil
+	}
+
+	// parameter validity was checked by the caller
+	if requireLabel, _ := boolParameter(req.Parameters, parameterRequireVolumeLabel, false); requireLabel {
+		// The label is derived from the volume ID, which is not known yet.
+		d.log.WithField("volume_name", req.Name).Info("not letting DO format volume that requires a volume label")
+		return "", "", nil
+	}
+
+	if hasMkfsParameters(req.Parameters) {
+		// DO cannot apply custom mkfs options.
+		d.log.WithField("volume_name", req.Name).Info("not letting DO format volume with custom mkfs options")
+		return "", "", nil
+	}
+
+	maxLabelLen, ok := preformatFsTypes[fsType]
+	if !ok {
+		d.log.WithFields(logrus.Fields{
+			"volume_name": req.Name,
+			"fs_type":     fsType,
+		}).Warn("DO cannot format volumes with the requested filesystem type, leaving formatting to the node")
+		return "", "", nil
+	}
+
+	label := req.Parameters[parameterFsLabel]
+	if len(label) > maxLabelLen {
+		return "", "", fmt.Errorf("filesystem label %q exceeds the maximum length of %d characters for %s", label, maxLabelLen, fsType)
+	}
+
+	return fsType, label, nil
+}
+
 // DeleteVolume deletes the given volume. The function is idempotent.
 func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -300,18 +436,15 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume Node ID %q cannot be converted to integer: %s", req.NodeId, err)
 	}
 
-	if req.Readonly {
-		// TODO(arslan): we should return codes.InvalidArgument, but the CSI
-		// test fails, because according to the CSI Spec, this flag cannot be
-		// changed on the same volume. However we don't use this flag at all,
-		// as there are no `readonly` attachable volumes.
-		return nil, status.Error(codes.AlreadyExists, "read only Volumes are not supported")
+	if violations := validateCapabilities([]*csi.VolumeCapability{req.VolumeCapability}); len(violations) > 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume capability cannot be satisified: %s", strings.Join(violations, "; ")))
 	}
 
 	log := d.log.WithFields(logrus.Fields{
 		"volume_id":  req.VolumeId,
 		"node_id":    req.NodeId,
 		"droplet_id": dropletID,
+		"read_only":  req.Readonly,
 		"method":     "controller_publish_volume",
 	})
 	log.Info("controller publish volume called")
@@ -346,11 +479,16 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 	for _, id := range vol.DropletIDs {
 		attachedID = id
 		if id == dropletID {
+			// DO volumes are always attached read/write, the tag records
+			// how the volume was published
+			if readOnly := hasTag(vol.Tags, readOnlyAttachmentTag(vol.ID, dropletID)); readOnly != req.Readonly {
+				return nil, status.Errorf(codes.AlreadyExists,
+					"volume %q is already published to droplet %d with read-only %t",
+					req.VolumeId, dropletID, readOnly)
+			}
 			log.Info("volume is already attached")
 			return &csi.ControllerPublishVolumeResponse{
-				PublishContext: map[string]string{
-					d.publishInfoVolumeName: vol.Name,
-				},
+				PublishContext: d.publishContext(vol, req.Readonly),
 			}, nil
 		}
 	}
@@ -362,6 +500,11 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 			req.VolumeId, attachedID)
 	}
 
+	if err := d.setReadOnlyAttachment(ctx, vol, dropletID, req.Readonly); err != nil {
+		log.WithError(err).Error("error recording read-only attachment")
+		return nil, status.Errorf(codes.Internal, "failed to record read-only attachment: %s", err)
+	}
+
 	// attach the volume to the correct node
 	action, resp, err := d.storageActions.Attach(ctx, req.VolumeId, dropletID)
 	if err != nil {
@@ -373,9 +516,7 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 					"resp":  resp,
 				}).Warn("assuming volume is attached because of error response")
 				return &csi.ControllerPublishVolumeResponse{
-					PublishContext: map[string]string{
-						d.publishInfoVolumeName: vol.Name,
-					},
+					PublishContext: d.publishContext(vol, req.Readonly),
 				}, nil
 			}
 
@@ -406,12 +547,22 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 
 	log.Info("volume was attached")
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{
-			d.publishInfoVolumeName: vol.Name,
-		},
+		PublishContext: d.publishContext(vol, req.Readonly),
 	}, nil
 }
 
+// publishContext returns the publish context passed to the node for the given
+// volume.
+func (d *Driver) publishContext(vol *godo.Volume, readOnly bool) map[string]string {
+	publishContext := map[string]string{
+		d.publishInfoVolumeName: vol.Name,
+	}
+	if readOnly {
+		publishContext[d.publishInfoReadOnly] = "true"
+	}
+	return publishContext
+}
+
 // ControllerUnpublishVolume deattaches the given volume from the node
 func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -432,7 +583,7 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	log.Info("controller unpublish volume called")
 
 	// check if volume exist before trying to detach it
-	_, resp, err := d.storage.GetVolume(ctx, req.VolumeId)
+	vol, resp, err := d.storage.GetVolume(ctx, req.VolumeId)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusNotFound {
 			log.Info("assuming volume is detached because it does not exist")
@@ -441,6 +592,13 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		return nil, err
 	}
 
+	// the CO does not publish the volume to the droplet again before it was
+	// unpublished successfully, so the tag can be removed ahead of the detach
+	if err := d.setReadOnlyAttachment(ctx, vol, dropletID, false); err != nil {
+		log.WithError(err).Error("error removing read-only attachment tag")
+		return nil, status.Errorf(codes.Internal, "failed to remove read-only attachment tag: %s", err)
+	}
+
 	// check if droplet exists before trying to detach the volume from the droplet
 	_, resp, err = d.droplets.Get(ctx, dropletID)
 	if err != nil {
@@ -511,7 +669,7 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 	log := d.log.WithFields(logrus.Fields{
 		"volume_id":              req.VolumeId,
 		"volume_capabilities":    req.VolumeCapabilities,
-		"supported_capabilities": supportedAccessMode,
+		"supported_access_modes": supportedAccessModes,
 		"method":                 "validate_volume_capabilities",
 	})
 	log.Info("validate volume capabilities called")
@@ -525,14 +683,18 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		return nil, err
 	}
 
+	if violations := validateCapabilities(req.VolumeCapabilities); len(violations) > 0 {
+		resp := &csi.ValidateVolumeCapabilitiesResponse{
+			Message: fmt.Sprintf("volume capabilities cannot be satisified: %s", strings.Join(violations, "; ")),
+		}
+		log.WithField("message", resp.Message).Info("unsupported capabilities")
+		return resp, nil
+	}
+
 	// if it's not supported (i.e: wrong region), we shouldn't override it
 	resp := &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: []*csi.VolumeCapability{
-				{
-					AccessMode: supportedAccessMode,
-				},
-			},
+			VolumeCapabilities: req.VolumeCapabilities,
 		},
 	}
 
@@ -658,6 +820,7 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	} {
 		caps = append(caps, newCap(cap))
 	}
@@ -732,6 +895,18 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		opts.Page = page + 1
 	}
 
+	freeze, err := boolParameter(req.GetParameters(), parameterFreeze, false)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if freeze {
+		thaw, err := d.freezeVolume(ctx, log, req.GetSourceVolumeId())
+		if err != nil {
+			return nil, err
+		}
+		defer thaw()
+	}
+
 	snapReq := &godo.SnapshotCreateRequest{
 		VolumeID:    req.GetSourceVolumeId(),
 		Name:        req.GetName(),
@@ -822,7 +997,7 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 			if resp == nil || resp.StatusCode != http.StatusNotFound {
 				return nil, status.Errorf(codes.Internal, "failed to get snapshot by ID %s: %s", req.SnapshotId, err)
 			}
-		} else {
+		} else if !d.listSnapshotsByTag || d.doTag == "" || hasTag(snapshot.Tags, d.doTag) {
 			snap, err := toCSISnapshot(snapshot)
 			if err != nil {
 				return nil, status.Errorf(codes.Internal,
@@ -836,6 +1011,7 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 				},
 			}
 		}
+		filterSnapshotEntriesForVolumeID(listResp, req.SourceVolumeId)
 	} else {
 		var startingToken int32
 		if req.StartingToken != "" {
@@ -846,18 +1022,44 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 			startingToken = int32(parsedToken)
 		}
 
-		untypedSnapshots, nextToken, err := listResources(ctx, log, startingToken, req.MaxEntries, func(ctx context.Context, listOpts *godo.ListOptions) ([]interface{}, *godo.Response, error) {
-			snapshots, resp, err := d.snapshots.ListVolume(ctx, listOpts)
+		// Let the DO API filter by region, or by source volume if one was
+		// given, so that pagination is computed over the relevant snapshots
+		// only.
+		lister := func(ctx context.Context, listOpts *godo.ListOptions) ([]interface{}, *godo.Response, error) {
+			snapshots, resp, err := d.snapshots.ListVolumeSnapshotByRegion(ctx, d.region, listOpts)
 			if err != nil {
 				return nil, resp, err
 			}
-
-			untypedSnapshots := make([]interface{}, 0, len(snapshots))
-			for _, snap := range snapshots {
-				untypedSnapshots = append(untypedSnapshots, snap)
+			return toUntypedSnapshots(snapshots), resp, nil
+		}
+		if req.SourceVolumeId != "" {
+			lister = func(ctx context.Context, listOpts *godo.ListOptions) ([]interface{}, *godo.Response, error) {
+				snapshots, resp, err := d.storage.ListSnapshots(ctx, req.SourceVolumeId, listOpts)
+				if err != nil {
+					if resp != nil && resp.StatusCode == http.StatusNotFound {
+						// a volume that does not exist has no snapshots
+						return nil, &godo.Response{}, nil
+					}
+					return nil, resp, err
+				}
+				return toUntypedSnapshots(snapshots), resp, nil
 			}
-			return untypedSnapshots, resp, err
-		})
+		}
+
+		var (
+			untypedSnapshots []interface{}
+			nextToken        int32
+			err              error
+		)
+		if d.listSnapshotsByTag && d.doTag != "" {
+			// The DO API cannot filter snapshots by tag, so we need to do it
+			// ourselves before pagination is applied.
+			untypedSnapshots, nextToken, err = listFilteredResources(ctx, log, startingToken, req.MaxEntries, lister, func(untypedSnapshot interface{}) bool {
+				return hasTag(untypedSnapshot.(godo.Snapshot).Tags, d.doTag)
+			})
+		} else {
+			untypedSnapshots, nextToken, err = listResources(ctx, log, startingToken, req.MaxEntries, lister)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("ListSnapshots failed to list resources: %w", err)
 		}
@@ -887,8 +1089,6 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 		}
 	}
 
-	filterSnapshotEntriesForVolumeID(listResp, req.SourceVolumeId)
-
 	log.WithField("response", listResp).Info("snapshots listed")
 	return listResp, nil
 }
@@ -900,20 +1100,27 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	if len(volID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume volume ID missing in request")
 	}
-	volume, _, err := d.storage.GetVolume(ctx, volID)
+	volume, resp, err := d.storage.GetVolume(ctx, volID)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, status.Errorf(codes.NotFound, "ControllerExpandVolume volume %q does not exist", volID)
+		}
 		return nil, status.Errorf(codes.Internal, "ControllerExpandVolume could not retrieve existing volume: %v", err)
 	}
 
 	resizeBytes, err := d.extractStorage(req.GetCapacityRange())
 	if err != nil {
-		return nil, status.Errorf(codes.OutOfRange, "ControllerExpandVolume invalid capacity range: %v", err)
+		return nil, status.Errorf(capacityRangeErrorCode(err), "ControllerExpandVolume invalid capacity range: %v", err)
 	}
 	resizeGigaBytes := resizeBytes / giB
 
+	nodeExpansionRequired := isNodeExpansionRequired(volume, req.GetVolumeCapability())
+
 	log := d.log.WithFields(logrus.Fields{
-		"volume_id": req.VolumeId,
-		"method":    "controller_expand_volume",
+		"volume_id":               req.VolumeId,
+		"attached":                len(volume.DropletIDs) > 0,
+		"node_expansion_required": nodeExpansionRequired,
+		"method":                  "controller_expand_volume",
 	})
 
 	log.Info("controller expand volume called")
@@ -925,11 +1132,14 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 		}).Info("skipping volume resize because current volume size exceeds requested volume size")
 		// even if the volume is resized independently from the control panel, we still need to resize the node fs when resize is requested
 		// in this case, the claim capacity will be resized to the volume capacity, requested capcity will be ignored to make the PV and PVC capacities consistent
-		return &csi.ControllerExpandVolumeResponse{CapacityBytes: volume.SizeGigaBytes * giB, NodeExpansionRequired: true}, nil
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: volume.SizeGigaBytes * giB, NodeExpansionRequired: nodeExpansionRequired}, nil
 	}
 
-	action, _, err := d.storageActions.Resize(ctx, req.GetVolumeId(), int(resizeGigaBytes), d.region)
+	action, resp, err := d.storageActions.Resize(ctx, req.GetVolumeId(), int(resizeGigaBytes), d.region)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, status.Errorf(codes.NotFound, "ControllerExpandVolume volume %q does not exist", req.GetVolumeId())
+		}
 		return nil, status.Errorf(codes.Internal, "cannot resize volume %s: %s", req.GetVolumeId(), err.Error())
 	}
 
@@ -945,15 +1155,23 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 
 	log.Info("volume was resized")
 
-	nodeExpansionRequired := true
-	if req.GetVolumeCapability() != nil {
-		if _, ok := req.GetVolumeCapability().GetAccessType().(*csi.VolumeCapability_Block); ok {
-			log.Info("node expansion is not required for block volumes")
-			nodeExpansionRequired = false
-		}
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: resizeGigaBytes * giB, NodeExpansionRequired: nodeExpansionRequired}, nil
+}
+
+// isNodeExpansionRequired returns whether the filesystem or the block device
+// of the given volume needs to be grown by the node service once the volume
+// was resized.
+func isNodeExpansionRequired(vol *godo.Volume, volCap *csi.VolumeCapability) bool {
+	if _, ok := volCap.GetAccessType().(*csi.VolumeCapability_Block); ok {
+		// raw block volumes do not carry a filesystem, but the node service
+		// needs to make the kernel pick up the new size of attached devices
+		return len(vol.DropletIDs) > 0
 	}
 
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: resizeGigaBytes * giB, NodeExpansionRequired: nodeExpansionRequired}, nil
+	// DO only records filesystems it created itself, so any other volume may
+	// still carry a filesystem formatted by the node service. Detached
+	// volumes are grown by NodeExpandVolume once they are staged again.
+	return true
 }
 
 // ControllerGetVolume gets a specific volume.
@@ -969,10 +1187,30 @@ func (d *Driver) ControllerModifyVolume(_ context.Context, _ *csi.ControllerModi
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// invalidCapacityRangeError is returned by extractStorage if the capacity
+// range contradicts itself, as opposed to not being satisfiable by DO.
+type invalidCapacityRangeError struct {
+	error
+}
+
+// capacityRangeErrorCode returns the gRPC code to use for an error returned by
+// extractStorage.
+func capacityRangeErrorCode(err error) codes.Code {
+	var invalidErr invalidCapacityRangeError
+	if errors.As(err, &invalidErr) {
+		return codes.InvalidArgument
+	}
+	return codes.OutOfRange
+}
+
 // extractStorage extracts the storage size in bytes from the given capacity
-// range. If the capacity range is not satisfied it returns the default volume
-// size. If the capacity range is above supported sizes, it returns an
-// error. If the capacity range is below supported size, it returns the minimum supported size
+// range. Since DO volumes can only be provisioned in whole GiB, the returned
+// size is always a multiple of 1 GiB: the required bytes are rounded up while
+// the limit bytes are rounded down. If the capacity range is not satisfied it
+// returns the default volume size. If the capacity range is above supported
+// sizes, or if no whole-GiB size fits into it, it returns an error. If the
+// capacity range is below supported size, it returns the minimum supported
+// size.
 func (d *Driver) extractStorage(capRange *csi.CapacityRange) (int64, error) {
 	if capRange == nil {
 		return defaultVolumeSizeInBytes, nil
@@ -988,7 +1226,7 @@ func (d *Driver) extractStorage(capRange *csi.CapacityRange) (int64, error) {
 	}
 
 	if requiredSet && limitSet && limitBytes < requiredBytes {
-		return 0, fmt.Errorf("limit (%v) can not be less than required (%v) size", formatBytes(limitBytes), formatBytes(requiredBytes))
+		return 0, invalidCapacityRangeError{fmt.Errorf("limit (%v) can not be less than required (%v) size", formatBytes(limitBytes), formatBytes(requiredBytes))}
 	}
 
 	if requiredSet && !limitSet && requiredBytes < minimumVolumeSizeInBytes {
@@ -1011,19 +1249,27 @@ func (d *Driver) extractStorage(capRange *csi.CapacityRange) (int64, error) {
 		return 0, fmt.Errorf("limit (%v) can not exceed maximum supported volume size (%v)", formatBytes(limitBytes), formatBytes(maximumVolumeSizeInBytes))
 	}
 
-	if requiredSet && limitSet && requiredBytes == limitBytes {
-		return requiredBytes, nil
+	if !requiredSet {
+		// Pick the largest size within the limit.
+		return limitBytes / giB * giB, nil
 	}
 
-	if requiredSet {
-		return requiredBytes, nil
+	size := roundUpToGiB(requiredBytes)
+	if size < minimumVolumeSizeInBytes {
+		size = minimumVolumeSizeInBytes
 	}
 
-	if limitSet {
-		return limitBytes, nil
+	if limitSet && size > limitBytes {
+		return 0, fmt.Errorf("no whole-GiB size between required (%v) and limit (%v) size", formatBytes(requiredBytes), formatBytes(limitBytes))
 	}
 
-	return defaultVolumeSizeInBytes, nil
+	return size, nil
+}
+
+// roundUpToGiB rounds the given number of bytes up to the next multiple of
+// 1 GiB.
+func roundUpToGiB(bytes int64) int64 {
+	return (bytes + giB - 1) / giB * giB
 }
 
 func formatBytes(inputBytes int64) string {
@@ -1165,7 +1411,7 @@ func toCSISnapshot(snap *godo.Snapshot) (*csi.Snapshot, error) {
 func validateCapabilities(caps []*csi.VolumeCapability) []string {
 	violations := sets.NewString()
 	for _, cap := range caps {
-		if cap.GetAccessMode().GetMode() != supportedAccessMode.GetMode() {
+		if !supportedAccessModes[cap.GetAccessMode().GetMode()] {
 			violations.Insert(fmt.Sprintf("unsupported access mode %s", cap.GetAccessMode().GetMode().String()))
 		}
 
@@ -1182,10 +1428,14 @@ func validateCapabilities(caps []*csi.VolumeCapability) []string {
 }
 
 func (d *Driver) tagVolume(parentCtx context.Context, vol *godo.Volume) error {
-	for _, tag := range vol.Tags {
-		if tag == d.doTag {
-			return nil
-		}
+	return d.tagVolumeWith(parentCtx, vol, d.doTag)
+}
+
+// tagVolumeWith tags the volume with the given tag, creating the tag if it
+// does not exist yet.
+func (d *Driver) tagVolumeWith(parentCtx context.Context, vol *godo.Volume, tag string) error {
+	if hasTag(vol.Tags, tag) {
+		return nil
 	}
 
 	tagReq := &godo.TagResourcesRequest{
@@ -1199,7 +1449,7 @@ func (d *Driver) tagVolume(parentCtx context.Context, vol *godo.Volume) error {
 
 	ctx, cancel := context.WithTimeout(parentCtx, doAPITimeout)
 	defer cancel()
-	resp, err := d.tags.TagResources(ctx, d.doTag, tagReq)
+	resp, err := d.tags.TagResources(ctx, tag, tagReq)
 	if resp == nil || resp.StatusCode != http.StatusNotFound {
 		// either success or irrecoverable failure
 		return err
@@ -1211,7 +1461,7 @@ func (d *Driver) tagVolume(parentCtx context.Context, vol *godo.Volume) error {
 	ctx, cancel = context.WithTimeout(parentCtx, doAPITimeout)
 	defer cancel()
 	_, _, err = d.tags.Create(ctx, &godo.TagCreateRequest{
-		Name: d.doTag,
+		Name: tag,
 	})
 	if err != nil {
 		return err
@@ -1219,10 +1469,39 @@ func (d *Driver) tagVolume(parentCtx context.Context, vol *godo.Volume) error {
 
 	ctx, cancel = context.WithTimeout(parentCtx, doAPITimeout)
 	defer cancel()
-	_, err = d.tags.TagResources(ctx, d.doTag, tagReq)
+	_, err = d.tags.TagResources(ctx, tag, tagReq)
 	return err
 }
 
+// setReadOnlyAttachment records whether the volume is published read-only to
+// the given droplet. The tag is deleted rather than removed from the volume
+// when the volume is not published read-only, so that no tags are left
+// behind in the account.
+func (d *Driver) setReadOnlyAttachment(ctx context.Context, vol *godo.Volume, dropletID int, readOnly bool) error {
+	tag := readOnlyAttachmentTag(vol.ID, dropletID)
+	if readOnly {
+		return d.tagVolumeWith(ctx, vol, tag)
+	}
+
+	if !hasTag(vol.Tags, tag) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, doAPITimeout)
+	defer cancel()
+	resp, err := d.tags.Delete(ctx, tag)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
+// readOnlyAttachmentTag returns the tag that records that the given volume is
+// published read-only to the given droplet.
+func readOnlyAttachmentTag(volumeID string, dropletID int) string {
+	return readOnlyAttachmentTagPrefix + volumeID + ":" + strconv.Itoa(dropletID)
+}
+
 func filterSnapshotEntriesForVolumeID(listResp *csi.ListSnapshotsResponse, sourceVolumeID string) {
 	if sourceVolumeID == "" {
 		return
@@ -1236,3 +1515,21 @@ func filterSnapshotEntriesForVolumeID(listResp *csi.ListSnapshotsResponse, sourc
 	}
 	listResp.Entries = filteredEntries
 }
+
+func toUntypedSnapshots(snapshots []godo.Snapshot) []interface{} {
+	untypedSnapshots := make([]interface{}, 0, len(snapshots))
+	for _, snap := range snapshots {
+		untypedSnapshots = append(untypedSnapshots, snap)
+	}
+	return untypedSnapshots
+}
+
+// hasTag returns true if tags contains the given tag.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
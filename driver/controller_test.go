@@ -131,10 +131,13 @@ func TestTagger(t *testing.T) {
 }
 
 type fakeTagsDriver struct {
+	// volumes is used to look up tagged volumes in Get.
+	volumes           map[string]*godo.Volume
 	createFunc        func(ctx context.Context, req *godo.TagCreateRequest) (*godo.Tag, *godo.Response, error)
 	tagResourcesFunc  func(context.Context, string, *godo.TagResourcesRequest) (*godo.Response, error)
 	exists            bool
 	resources         []godo.Resource
+	deleted           []string
 	createCount       int
 	tagResourcesCount int
 }
@@ -143,8 +146,30 @@ func (*fakeTagsDriver) List(context.Context, *godo.ListOptions) ([]godo.Tag, *go
 	panic("not implemented")
 }
 
-func (*fakeTagsDriver) Get(context.Context, string) (*godo.Tag, *godo.Response, error) {
-	panic("not implemented")
+func (f *fakeTagsDriver) Get(ctx context.Context, name string) (*godo.Tag, *godo.Response, error) {
+	tag := &godo.Tag{
+		Name: name,
+		Resources: &godo.TaggedResources{
+			Volumes: &godo.TaggedVolumesResources{},
+		},
+	}
+	for _, vol := range f.volumes {
+		if hasTag(vol.Tags, name) {
+			tag.Resources.Count++
+			tag.Resources.Volumes.Count++
+			tag.Resources.Volumes.LastTaggedURI = "https://api.digitalocean.com/v2/volumes/" + vol.ID
+		}
+	}
+
+	if tag.Resources.Count == 0 {
+		resp := godoResponse()
+		resp.Response = &http.Response{
+			StatusCode: http.StatusNotFound,
+		}
+		return nil, resp, errors.New("tag not found")
+	}
+
+	return tag, godoResponse(), nil
 }
 
 func (f *fakeTagsDriver) Create(ctx context.Context, req *godo.TagCreateRequest) (*godo.Tag, *godo.Response, error) {
@@ -158,8 +183,18 @@ func (f *fakeTagsDriver) Create(ctx context.Context, req *godo.TagCreateRequest)
 	}, godoResponse(), nil
 }
 
-func (*fakeTagsDriver) Delete(context.Context, string) (*godo.Response, error) {
-	panic("not implemented")
+func (f *fakeTagsDriver) Delete(ctx context.Context, name string) (*godo.Response, error) {
+	f.deleted = append(f.deleted, name)
+	for _, vol := range f.volumes {
+		var tags []string
+		for _, t := range vol.Tags {
+			if t != name {
+				tags = append(tags, t)
+			}
+		}
+		vol.Tags = tags
+	}
+	return godoResponse(), nil
 }
 
 func (f *fakeTagsDriver) TagResources(ctx context.Context, tag string, req *godo.TagResourcesRequest) (*godo.Response, error) {
@@ -174,6 +209,11 @@ func (f *fakeTagsDriver) TagResources(ctx context.Context, tag string, req *godo
 		}, errors.New("An error occured")
 	}
 	f.resources = append(f.resources, req.Resources...)
+	for _, res := range req.Resources {
+		if vol, ok := f.volumes[res.ID]; ok && !hasTag(vol.Tags, tag) {
+			vol.Tags = append(vol.Tags, tag)
+		}
+	}
 	return godoResponse(), nil
 }
 
@@ -185,6 +225,7 @@ func TestControllerExpandVolume(t *testing.T) {
 	defaultVolume := &godo.Volume{
 		ID:            "volume-id",
 		SizeGigaBytes: (defaultVolumeSizeInBytes / giB),
+		DropletIDs:    []int{1},
 	}
 	tcs := []struct {
 		name   string
@@ -209,6 +250,7 @@ func TestControllerExpandVolume(t *testing.T) {
 			volume: &godo.Volume{
 				ID:            "volume-id",
 				SizeGigaBytes: 1,
+				DropletIDs:    []int{1},
 			},
 			req: &csi.ControllerExpandVolumeRequest{
 				VolumeId: "volume-id",
@@ -228,7 +270,129 @@ func TestControllerExpandVolume(t *testing.T) {
 				},
 			},
 			resp: nil,
-			err:  status.Error(codes.Internal, "ControllerExpandVolume could not retrieve existing volume: volume not found"),
+			err:  status.Error(codes.NotFound, "ControllerExpandVolume volume \"non-existent-id\" does not exist"),
+		},
+		{
+			name: "sub-GiB request is rounded up to whole GiB",
+			volume: &godo.Volume{
+				ID:            "volume-id",
+				SizeGigaBytes: 16,
+				DropletIDs:    []int{1},
+			},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "volume-id",
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 20*giB + 512*miB,
+				},
+			},
+			resp: &csi.ControllerExpandVolumeResponse{CapacityBytes: 21 * giB, NodeExpansionRequired: true},
+			err:  nil,
+		},
+		{
+			name: "no whole-GiB size fits into capacity range",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "volume-id",
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 20*giB + 256*miB,
+					LimitBytes:    20*giB + 768*miB,
+				},
+			},
+			resp: nil,
+			err:  status.Error(codes.OutOfRange, "ControllerExpandVolume invalid capacity range: no whole-GiB size between required (20.2Gi) and limit (20.8Gi) size"),
+		},
+		{
+			name: "limit less than required",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "volume-id",
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 20 * giB,
+					LimitBytes:    19 * giB,
+				},
+			},
+			resp: nil,
+			err:  status.Error(codes.InvalidArgument, "ControllerExpandVolume invalid capacity range: limit (19Gi) can not be less than required (20Gi) size"),
+		},
+		{
+			name: "detached volume with filesystem recorded by DO",
+			volume: &godo.Volume{
+				ID:             "volume-id",
+				SizeGigaBytes:  16,
+				FilesystemType: "ext4",
+			},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "volume-id",
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 20 * giB,
+				},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			resp: &csi.ControllerExpandVolumeResponse{CapacityBytes: 20 * giB, NodeExpansionRequired: true},
+			err:  nil,
+		},
+		{
+			name: "detached volume formatted by the node",
+			volume: &godo.Volume{
+				ID:            "volume-id",
+				SizeGigaBytes: 16,
+			},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "volume-id",
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 20 * giB,
+				},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			resp: &csi.ControllerExpandVolumeResponse{CapacityBytes: 20 * giB, NodeExpansionRequired: true},
+			err:  nil,
+		},
+		{
+			name: "attached block volume",
+			volume: &godo.Volume{
+				ID:            "volume-id",
+				SizeGigaBytes: 16,
+				DropletIDs:    []int{1},
+			},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "volume-id",
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 20 * giB,
+				},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{
+						Block: &csi.VolumeCapability_BlockVolume{},
+					},
+				},
+			},
+			resp: &csi.ControllerExpandVolumeResponse{CapacityBytes: 20 * giB, NodeExpansionRequired: true},
+			err:  nil,
+		},
+		{
+			name: "detached block volume",
+			volume: &godo.Volume{
+				ID:            "volume-id",
+				SizeGigaBytes: 16,
+			},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId: "volume-id",
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 20 * giB,
+				},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{
+						Block: &csi.VolumeCapability_BlockVolume{},
+					},
+				},
+			},
+			resp: &csi.ControllerExpandVolumeResponse{CapacityBytes: 20 * giB, NodeExpansionRequired: false},
+			err:  nil,
 		},
 		{
 			name: "new volume size is less than old volume size",
@@ -284,6 +448,212 @@ func TestControllerExpandVolume(t *testing.T) {
 	}
 }
 
+func TestExtractStorage(t *testing.T) {
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		wantSize int64
+		wantCode codes.Code
+	}{
+		{
+			name:     "no capacity range",
+			wantSize: defaultVolumeSizeInBytes,
+		},
+		{
+			name:     "empty capacity range",
+			capRange: &csi.CapacityRange{},
+			wantSize: defaultVolumeSizeInBytes,
+		},
+		{
+			name:     "required whole GiB",
+			capRange: &csi.CapacityRange{RequiredBytes: 5 * giB},
+			wantSize: 5 * giB,
+		},
+		{
+			name:     "required sub-GiB rounded up",
+			capRange: &csi.CapacityRange{RequiredBytes: 1*giB + 512*miB},
+			wantSize: 2 * giB,
+		},
+		{
+			name:     "required one byte above whole GiB rounded up",
+			capRange: &csi.CapacityRange{RequiredBytes: 5*giB + 1},
+			wantSize: 6 * giB,
+		},
+		{
+			name:     "required below minimum",
+			capRange: &csi.CapacityRange{RequiredBytes: 100 * miB},
+			wantSize: minimumVolumeSizeInBytes,
+		},
+		{
+			name:     "required below minimum with limit above minimum",
+			capRange: &csi.CapacityRange{RequiredBytes: 100 * miB, LimitBytes: 3 * giB},
+			wantSize: minimumVolumeSizeInBytes,
+		},
+		{
+			name:     "required rounded up within limit",
+			capRange: &csi.CapacityRange{RequiredBytes: 1*giB + 512*miB, LimitBytes: 2 * giB},
+			wantSize: 2 * giB,
+		},
+		{
+			name:     "required equals limit",
+			capRange: &csi.CapacityRange{RequiredBytes: 7 * giB, LimitBytes: 7 * giB},
+			wantSize: 7 * giB,
+		},
+		{
+			name:     "required rounded up beyond limit",
+			capRange: &csi.CapacityRange{RequiredBytes: 1*giB + 256*miB, LimitBytes: 1*giB + 768*miB},
+			wantCode: codes.OutOfRange,
+		},
+		{
+			name:     "required equals non-whole-GiB limit",
+			capRange: &csi.CapacityRange{RequiredBytes: 1*giB + 512*miB, LimitBytes: 1*giB + 512*miB},
+			wantCode: codes.OutOfRange,
+		},
+		{
+			name:     "required rounded up to maximum",
+			capRange: &csi.CapacityRange{RequiredBytes: maximumVolumeSizeInBytes - 1},
+			wantSize: maximumVolumeSizeInBytes,
+		},
+		{
+			name:     "required above maximum",
+			capRange: &csi.CapacityRange{RequiredBytes: maximumVolumeSizeInBytes + 1},
+			wantCode: codes.OutOfRange,
+		},
+		{
+			name:     "limit only rounded down",
+			capRange: &csi.CapacityRange{LimitBytes: 3*giB + 512*miB},
+			wantSize: 3 * giB,
+		},
+		{
+			name:     "limit below minimum",
+			capRange: &csi.CapacityRange{LimitBytes: 512 * miB},
+			wantCode: codes.OutOfRange,
+		},
+		{
+			name:     "limit only above maximum",
+			capRange: &csi.CapacityRange{LimitBytes: maximumVolumeSizeInBytes + giB},
+			wantCode: codes.OutOfRange,
+		},
+		{
+			name:     "limit less than required",
+			capRange: &csi.CapacityRange{RequiredBytes: 3 * giB, LimitBytes: 2 * giB},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &Driver{
+				log: logrus.New().WithField("test_enabed", true),
+			}
+
+			size, err := d.extractStorage(test.capRange)
+			if test.wantCode != codes.OK {
+				if err == nil {
+					t.Fatalf("got size %d, want error with code %s", size, test.wantCode)
+				}
+				if code := capacityRangeErrorCode(err); code != test.wantCode {
+					t.Errorf("got code %s, want %s", code, test.wantCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+			if size != test.wantSize {
+				t.Errorf("got size %s, want %s", formatBytes(size), formatBytes(test.wantSize))
+			}
+		})
+	}
+}
+
+func TestCreateVolumeCapacity(t *testing.T) {
+	tests := []struct {
+		name              string
+		capRange          *csi.CapacityRange
+		existingSizeGiB   int64
+		wantCapacityBytes int64
+		wantCode          codes.Code
+	}{
+		{
+			name:              "sub-GiB request",
+			capRange:          &csi.CapacityRange{RequiredBytes: 1*giB + 512*miB},
+			wantCapacityBytes: 2 * giB,
+		},
+		{
+			name:              "existing volume within range",
+			capRange:          &csi.CapacityRange{RequiredBytes: 1*giB + 512*miB},
+			existingSizeGiB:   2,
+			wantCapacityBytes: 2 * giB,
+		},
+		{
+			name:            "existing volume exceeding limit",
+			capRange:        &csi.CapacityRange{RequiredBytes: 1 * giB, LimitBytes: 2 * giB},
+			existingSizeGiB: 3,
+			wantCode:        codes.AlreadyExists,
+		},
+		{
+			name:     "no whole-GiB size fits",
+			capRange: &csi.CapacityRange{RequiredBytes: 1*giB + 256*miB, LimitBytes: 1*giB + 768*miB},
+			wantCode: codes.OutOfRange,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volumes := map[string]*godo.Volume{}
+			if test.existingSizeGiB > 0 {
+				volumes["existing"] = &godo.Volume{
+					ID:            "existing",
+					Name:          "name",
+					SizeGigaBytes: test.existingSizeGiB,
+				}
+			}
+			d := &Driver{
+				region: "nyc3",
+				storage: &fakeStorageDriver{
+					volumes: volumes,
+				},
+				log: logrus.New().WithField("test_enabled", true),
+			}
+
+			resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:          "name",
+				CapacityRange: test.capRange,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+			})
+			if test.wantCode != codes.OK {
+				if status.Code(err) != test.wantCode {
+					t.Fatalf("got error %v, want code %s", err, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if resp.Volume.CapacityBytes != test.wantCapacityBytes {
+				t.Errorf("got capacity %d, want %d", resp.Volume.CapacityBytes, test.wantCapacityBytes)
+			}
+			for _, vol := range volumes {
+				if vol.SizeGigaBytes*giB != resp.Volume.CapacityBytes {
+					t.Errorf("reported capacity %d does not match provisioned size %d GiB", resp.Volume.CapacityBytes, vol.SizeGigaBytes)
+				}
+			}
+		})
+	}
+}
+
 func TestCreateVolume(t *testing.T) {
 	snapshotId := "snapshotId"
 
@@ -532,7 +902,8 @@ func TestWaitAction(t *testing.T) {
 				log: logrus.New().WithField("test_enabed", true),
 			}
 
-			ctx, _ := context.WithTimeout(context.Background(), test.timeout)
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
 			err := d.waitAction(
 				ctx,
 				logrus.New().WithField("test_enabed", true),
@@ -689,3 +1060,525 @@ func TestListSnapshot(t *testing.T) {
 		})
 	}
 }
+
+func TestListSnapshotFilters(t *testing.T) {
+	const (
+		region = "nyc3"
+		doTag  = "k8s:cluster-id"
+	)
+
+	// Snapshots 001-020 belong to volume-a in our region, every other one
+	// carrying our tag. Snapshots 021-030 belong to volume-b in our region
+	// and are not tagged. Snapshots 031-040 live in a different region.
+	newSnapshots := func() map[string]*godo.Snapshot {
+		snapshots := map[string]*godo.Snapshot{}
+		for i := 1; i <= 40; i++ {
+			id := fmt.Sprintf("%03d", i)
+			snap := createGodoSnapshot(id, "snapshot-"+id, "volume-a")
+			snap.Regions = []string{region}
+			switch {
+			case i <= 20:
+				if i%2 == 0 {
+					snap.Tags = []string{doTag}
+				}
+			case i <= 30:
+				snap.ResourceID = "volume-b"
+			default:
+				snap.ResourceID = "volume-c"
+				snap.Regions = []string{"ams3"}
+			}
+			snapshots[id] = snap
+		}
+		return snapshots
+	}
+
+	tests := []struct {
+		name               string
+		listSnapshotsByTag bool
+		sourceVolumeID     string
+		maxEntries         int32
+		startingToken      string
+		wantIDs            []string
+		wantNextToken      string
+	}{
+		{
+			name:          "region",
+			maxEntries:    25,
+			startingToken: "10",
+			wantIDs:       idRange(10, 30),
+		},
+		{
+			name:           "source volume with max entries",
+			sourceVolumeID: "volume-b",
+			maxEntries:     4,
+			wantIDs:        idRange(21, 24),
+			wantNextToken:  "5",
+		},
+		{
+			name:           "source volume with starting token",
+			sourceVolumeID: "volume-b",
+			maxEntries:     4,
+			startingToken:  "9",
+			wantIDs:        idRange(29, 30),
+		},
+		{
+			name:           "source volume does not exist",
+			sourceVolumeID: "volume-z",
+			wantIDs:        nil,
+		},
+		{
+			name:               "tag with max entries",
+			listSnapshotsByTag: true,
+			maxEntries:         3,
+			wantIDs:            []string{"002", "004", "006"},
+			wantNextToken:      "4",
+		},
+		{
+			name:               "tag with starting token",
+			listSnapshotsByTag: true,
+			maxEntries:         3,
+			startingToken:      "4",
+			wantIDs:            []string{"008", "010", "012"},
+			wantNextToken:      "7",
+		},
+		{
+			name:               "tag with last page",
+			listSnapshotsByTag: true,
+			maxEntries:         3,
+			startingToken:      "9",
+			wantIDs:            []string{"018", "020"},
+		},
+		{
+			name:               "tag and source volume",
+			listSnapshotsByTag: true,
+			sourceVolumeID:     "volume-b",
+			wantIDs:            nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshots := newSnapshots()
+			d := Driver{
+				region:             region,
+				doTag:              doTag,
+				listSnapshotsByTag: test.listSnapshotsByTag,
+				storage: &fakeStorageDriver{
+					volumes: map[string]*godo.Volume{
+						"volume-a": {ID: "volume-a"},
+						"volume-b": {ID: "volume-b"},
+					},
+					snapshots: snapshots,
+				},
+				snapshots: &fakeSnapshotsDriver{
+					snapshots: snapshots,
+				},
+				log: logrus.New().WithField("test_enabed", true),
+			}
+
+			resp, err := d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{
+				SourceVolumeId: test.sourceVolumeID,
+				MaxEntries:     test.maxEntries,
+				StartingToken:  test.startingToken,
+			})
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			var gotIDs []string
+			for _, entry := range resp.Entries {
+				gotIDs = append(gotIDs, entry.Snapshot.GetSnapshotId())
+			}
+			if diff := cmp.Diff(test.wantIDs, gotIDs); diff != "" {
+				t.Errorf("snapshot IDs mismatch (-want +got):\n%s", diff)
+			}
+
+			if resp.NextToken != test.wantNextToken {
+				t.Errorf("got next token %q, want %q", resp.NextToken, test.wantNextToken)
+			}
+		})
+	}
+}
+
+func idRange(from, to int) []string {
+	var ids []string
+	for i := from; i <= to; i++ {
+		ids = append(ids, fmt.Sprintf("%03d", i))
+	}
+	return ids
+}
+
+func TestCreateVolumePreformat(t *testing.T) {
+	mountCap := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType: fsType,
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}
+	}
+
+	tests := []struct {
+		name             string
+		preformatVolumes bool
+		params           map[string]string
+		volCap           *csi.VolumeCapability
+		snapshotID       string
+		wantFsType       string
+		wantFsLabel      string
+		wantCode         codes.Code
+	}{
+		{
+			name:   "disabled by default",
+			volCap: mountCap(""),
+		},
+		{
+			name:             "enabled globally",
+			preformatVolumes: true,
+			volCap:           mountCap(""),
+			wantFsType:       "ext4",
+		},
+		{
+			name:             "disabled by parameter",
+			preformatVolumes: true,
+			params:           map[string]string{parameterPreformat: "false"},
+			volCap:           mountCap(""),
+		},
+		{
+			name:        "enabled by parameter with label",
+			params:      map[string]string{parameterPreformat: "true", parameterFsLabel: "data"},
+			volCap:      mountCap("xfs"),
+			wantFsType:  "xfs",
+			wantFsLabel: "data",
+		},
+		{
+			name:             "unsupported filesystem type",
+			preformatVolumes: true,
+			volCap:           mountCap("btrfs"),
+		},
+		{
+			name: "block volume",
+			params: map[string]string{
+				parameterPreformat: "true",
+			},
+			volCap: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{
+					Block: &csi.VolumeCapability_BlockVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		{
+			name:             "volume restored from snapshot",
+			preformatVolumes: true,
+			volCap:           mountCap(""),
+			snapshotID:       "snapshot-id",
+		},
+		{
+			name:             "encrypted volume",
+			preformatVolumes: true,
+			params:           map[string]string{parameterEncrypted: "true"},
+			volCap:           mountCap(""),
+		},
+		{
+			name:   "encrypted block volume",
+			params: map[string]string{parameterEncrypted: "true"},
+			volCap: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{
+					Block: &csi.VolumeCapability_BlockVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "label too long",
+			params:   map[string]string{parameterPreformat: "true", parameterFsLabel: "label-longer-than-12"},
+			volCap:   mountCap("xfs"),
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid parameter",
+			params:   map[string]string{parameterPreformat: "yes please"},
+			volCap:   mountCap(""),
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volumes := map[string]*godo.Volume{}
+			d := &Driver{
+				region:           "nyc3",
+				preformatVolumes: test.preformatVolumes,
+				storage: &fakeStorageDriver{
+					volumes: volumes,
+				},
+				snapshots: &fakeSnapshotsDriver{
+					snapshots: map[string]*godo.Snapshot{
+						"snapshot-id": {ID: "snapshot-id", SizeGigaBytes: 16},
+					},
+				},
+				log: logrus.New().WithField("test_enabled", true),
+			}
+
+			req := &csi.CreateVolumeRequest{
+				Name:               "name",
+				Parameters:         test.params,
+				VolumeCapabilities: []*csi.VolumeCapability{test.volCap},
+			}
+			if test.snapshotID != "" {
+				req.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{
+							SnapshotId: test.snapshotID,
+						},
+					},
+				}
+			}
+
+			resp, err := d.CreateVolume(context.Background(), req)
+			if test.wantCode != codes.OK {
+				if status.Code(err) != test.wantCode {
+					t.Fatalf("got error %v, want code %s", err, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			vol := volumes[resp.Volume.VolumeId]
+			if vol.FilesystemType != test.wantFsType {
+				t.Errorf("got filesystem type %q, want %q", vol.FilesystemType, test.wantFsType)
+			}
+			if vol.FilesystemLabel != test.wantFsLabel {
+				t.Errorf("got filesystem label %q, want %q", vol.FilesystemLabel, test.wantFsLabel)
+			}
+			if got := resp.Volume.VolumeContext[volumeContextPreformattedFsType]; got != test.wantFsType {
+				t.Errorf("got preformatted filesystem type %q in volume context, want %q", got, test.wantFsType)
+			}
+			if got, want := resp.Volume.VolumeContext[parameterEncrypted], test.params[parameterEncrypted]; got != want {
+				t.Errorf("got encrypted %q in volume context, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	volCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: mode,
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		caps          []*csi.VolumeCapability
+		wantConfirmed bool
+	}{
+		{
+			name:          "single node writer",
+			caps:          []*csi.VolumeCapability{volCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			wantConfirmed: true,
+		},
+		{
+			name:          "single node single writer",
+			caps:          []*csi.VolumeCapability{volCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)},
+			wantConfirmed: true,
+		},
+		{
+			name:          "single node multi writer",
+			caps:          []*csi.VolumeCapability{volCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)},
+			wantConfirmed: true,
+		},
+		{
+			name:          "single node reader only",
+			caps:          []*csi.VolumeCapability{volCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)},
+			wantConfirmed: true,
+		},
+		{
+			name: "multi node reader only",
+			caps: []*csi.VolumeCapability{volCap(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)},
+		},
+		{
+			name: "supported and unsupported modes",
+			caps: []*csi.VolumeCapability{
+				volCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				volCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &Driver{
+				storage: &fakeStorageDriver{
+					volumes: map[string]*godo.Volume{
+						"volume-id": {ID: "volume-id"},
+					},
+				},
+				log: logrus.New().WithField("test_enabled", true),
+			}
+
+			resp, err := d.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "volume-id",
+				VolumeCapabilities: test.caps,
+			})
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if confirmed := resp.Confirmed != nil; confirmed != test.wantConfirmed {
+				t.Fatalf("got confirmed %t (message %q), want %t", confirmed, resp.Message, test.wantConfirmed)
+			}
+			if test.wantConfirmed && len(resp.Confirmed.VolumeCapabilities) != len(test.caps) {
+				t.Errorf("got %d confirmed capabilities, want %d", len(resp.Confirmed.VolumeCapabilities), len(test.caps))
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolumeReadOnly(t *testing.T) {
+	const dropletID = 1
+	roTag := readOnlyAttachmentTag("volume-id", dropletID)
+
+	tests := []struct {
+		name         string
+		attached     bool
+		tags         []string
+		readOnly     bool
+		wantCode     codes.Code
+		wantReadOnly bool
+	}{
+		{
+			name:         "attach read-only",
+			readOnly:     true,
+			wantReadOnly: true,
+		},
+		{
+			name: "attach read/write with stale tag",
+			tags: []string{roTag},
+		},
+		{
+			name:         "already attached read-only",
+			attached:     true,
+			tags:         []string{roTag},
+			readOnly:     true,
+			wantReadOnly: true,
+		},
+		{
+			name:     "already attached read/write",
+			attached: true,
+		},
+		{
+			name:     "already attached read/write, publishing read-only",
+			attached: true,
+			readOnly: true,
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name:     "already attached read-only, publishing read/write",
+			attached: true,
+			tags:     []string{roTag},
+			wantCode: codes.AlreadyExists,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vol := &godo.Volume{ID: "volume-id", Name: "volume-name", Tags: test.tags}
+			if test.attached {
+				vol.DropletIDs = []int{dropletID}
+			}
+			volumes := map[string]*godo.Volume{vol.ID: vol}
+			droplets := map[int]*godo.Droplet{dropletID: {ID: dropletID}}
+
+			d := &Driver{
+				publishInfoVolumeName: DefaultDriverName + "/volume-name",
+				publishInfoReadOnly:   DefaultDriverName + "/read-only",
+				storage:               &fakeStorageDriver{volumes: volumes},
+				storageActions:        &fakeStorageActionsDriver{volumes: volumes, droplets: droplets},
+				droplets:              &fakeDropletsDriver{droplets: droplets},
+				tags:                  &fakeTagsDriver{volumes: volumes, exists: true},
+				log:                   logrus.New().WithField("test_enabled", true),
+			}
+
+			resp, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId: vol.ID,
+				NodeId:   strconv.Itoa(dropletID),
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+				Readonly: test.readOnly,
+			})
+			if test.wantCode != codes.OK {
+				if status.Code(err) != test.wantCode {
+					t.Fatalf("got error %v, want code %s", err, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if got := d.isPublishedReadOnly(resp.PublishContext); got != test.wantReadOnly {
+				t.Errorf("got read-only %t in publish context, want %t", got, test.wantReadOnly)
+			}
+			if got := hasTag(vol.Tags, roTag); got != test.wantReadOnly {
+				t.Errorf("got read-only tag %t, want %t", got, test.wantReadOnly)
+			}
+		})
+	}
+}
+
+func TestControllerUnpublishVolumeReadOnly(t *testing.T) {
+	const dropletID = 1
+	roTag := readOnlyAttachmentTag("volume-id", dropletID)
+
+	vol := &godo.Volume{ID: "volume-id", Name: "volume-name", DropletIDs: []int{dropletID}, Tags: []string{roTag}}
+	volumes := map[string]*godo.Volume{vol.ID: vol}
+	droplets := map[int]*godo.Droplet{dropletID: {ID: dropletID, VolumeIDs: []string{vol.ID}}}
+	tags := &fakeTagsDriver{volumes: volumes, exists: true}
+
+	d := &Driver{
+		storage:        &fakeStorageDriver{volumes: volumes},
+		storageActions: &fakeStorageActionsDriver{volumes: volumes, droplets: droplets},
+		droplets:       &fakeDropletsDriver{droplets: droplets},
+		tags:           tags,
+		log:            logrus.New().WithField("test_enabled", true),
+	}
+
+	_, err := d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: vol.ID,
+		NodeId:   strconv.Itoa(dropletID),
+	})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	if want := []string{roTag}; !cmp.Equal(tags.deleted, want) {
+		t.Errorf("got deleted tags %v, want %v", tags.deleted, want)
+	}
+	if len(vol.Tags) != 0 {
+		t.Errorf("got tags %v after detaching, want none", vol.Tags)
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// doSCSIVendor and doSCSIModel identify DO volumes among SCSI devices.
+	doSCSIVendor = "DO"
+	doSCSIModel  = "Volume"
+
+	// vpdPageUnitSerialNumber is the code of the SCSI VPD page holding the
+	// unit serial number, which is the volume name for DO volumes.
+	vpdPageUnitSerialNumber = 0x80
+
+	defaultDeviceWaitTimeout    = 30 * time.Second
+	defaultDeviceInitialBackoff = 100 * time.Millisecond
+	defaultDeviceMaxBackoff     = 2 * time.Second
+)
+
+// DeviceResolver finds the block devices of attached volumes.
+type DeviceResolver interface {
+	// Resolve returns the path of the block device of the volume with the
+	// given name. It waits for the device to show up until the context is
+	// done or a timeout expires.
+	Resolve(ctx context.Context, volumeName string) (string, error)
+
+	// Verify checks that the block device at the given path, following
+	// symlinks, is the DO volume with the given ID and name.
+	Verify(devicePath, volumeID, volumeName string) error
+}
+
+// sysfsDeviceResolver resolves devices through the udev by-id symlinks and
+// falls back to scanning sysfs for devices udev has not processed (yet).
+type sysfsDeviceResolver struct {
+	log *logrus.Entry
+
+	diskIDPath string
+	sysPath    string
+	devPath    string
+
+	timeout        time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// newDeviceResolver returns a new DeviceResolver operating on the host's
+// /dev and /sys.
+func newDeviceResolver(log *logrus.Entry) *sysfsDeviceResolver {
+	return &sysfsDeviceResolver{
+		log:            log,
+		diskIDPath:     diskIDPath,
+		sysPath:        "/sys",
+		devPath:        "/dev",
+		timeout:        defaultDeviceWaitTimeout,
+		initialBackoff: defaultDeviceInitialBackoff,
+		maxBackoff:     defaultDeviceMaxBackoff,
+	}
+}
+
+func (r *sysfsDeviceResolver) Resolve(ctx context.Context, volumeName string) (string, error) {
+	log := r.log.WithField("volume_name", volumeName)
+	byIDPath := filepath.Join(r.diskIDPath, diskDOPrefix+volumeName)
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+	backoff := r.initialBackoff
+	rescanned := false
+	for attempt := 1; ; attempt++ {
+		if _, err := os.Stat(byIDPath); err == nil {
+			if attempt > 1 {
+				log.WithFields(logrus.Fields{
+					"device_path": byIDPath,
+					"attempts":    attempt,
+					"elapsed":     time.Since(start),
+				}).Info("found device through by-id symlink")
+			}
+			return byIDPath, nil
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to check by-id symlink %q: %v", byIDPath, err)
+		}
+
+		devicePath, err := r.findBySerial(volumeName)
+		if err != nil {
+			log.WithError(err).Warn("failed to scan sysfs for the device")
+		}
+		if devicePath != "" {
+			log.WithFields(logrus.Fields{
+				"device_path": devicePath,
+				"attempts":    attempt,
+				"elapsed":     time.Since(start),
+			}).Warn("by-id symlink is missing, found device by its serial in sysfs")
+			return devicePath, nil
+		}
+
+		if !rescanned {
+			// the device may not have been noticed by the kernel at all,
+			// e.g., if the hot-plug event got lost
+			log.Info("device not found, rescanning SCSI hosts")
+			if err := r.rescanSCSIHosts(); err != nil {
+				log.WithError(err).Warn("failed to rescan SCSI hosts")
+			}
+			rescanned = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("device of volume %q not found after %d attempts in %s: neither %q exists nor does any SCSI device carry the volume name as its serial", volumeName, attempt, time.Since(start).Round(time.Millisecond), byIDPath)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+func (r *sysfsDeviceResolver) Verify(devicePath, volumeID, volumeName string) error {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return fmt.Errorf("could not resolve device path %q: %v", devicePath, err)
+	}
+
+	name := filepath.Base(resolved)
+	deviceDir := filepath.Join(r.sysPath, "block", name, "device")
+
+	vendor, err := readSysfsString(filepath.Join(deviceDir, "vendor"))
+	if err != nil {
+		return fmt.Errorf("could not read SCSI vendor of device %q: %v", resolved, err)
+	}
+	model, err := readSysfsString(filepath.Join(deviceDir, "model"))
+	if err != nil {
+		return fmt.Errorf("could not read SCSI model of device %q: %v", resolved, err)
+	}
+	if vendor != doSCSIVendor || model != doSCSIModel {
+		return fmt.Errorf("device %q is a %q %q SCSI device, not a DO volume", resolved, vendor, model)
+	}
+
+	log := r.log.WithFields(logrus.Fields{
+		"device_path": devicePath,
+		"device":      resolved,
+		"volume_id":   volumeID,
+		"volume_name": volumeName,
+	})
+
+	// DO volumes identify themselves by their name, the ID is accepted as
+	// well
+	isVolume := func(id string) bool {
+		return id == volumeName || id == volumeID
+	}
+
+	// a stale by-id symlink of another volume may point at the device, e.g.,
+	// after the volume was detached and another one attached in its place
+	links, err := r.linkedVolumes(resolved)
+	if err != nil {
+		return fmt.Errorf("could not read by-id symlinks of device %q: %v", resolved, err)
+	}
+	for _, link := range links {
+		if !isVolume(link) {
+			return fmt.Errorf("device %q is linked as volume %q, expected volume %q (%s)", resolved, link, volumeName, volumeID)
+		}
+	}
+
+	serial, err := readVPDSerial(filepath.Join(deviceDir, "vpd_pg80"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// some kernels do not expose the VPD pages of all devices
+			log.Warn("device does not expose its SCSI serial, verified its vendor, model, and by-id symlinks only")
+			return nil
+		}
+		return fmt.Errorf("could not read SCSI serial of device %q: %v", resolved, err)
+	}
+	if !isVolume(serial) {
+		return fmt.Errorf("device %q carries serial %q, expected volume %q (%s)", resolved, serial, volumeName, volumeID)
+	}
+
+	log.Info("verified device identity")
+	return nil
+}
+
+// linkedVolumes returns the volumes whose by-id symlinks point at the given
+// device.
+func (r *sysfsDeviceResolver) linkedVolumes(device string) ([]string, error) {
+	links, err := filepath.Glob(filepath.Join(r.diskIDPath, diskDOPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []string
+	for _, link := range links {
+		name := strings.TrimPrefix(filepath.Base(link), diskDOPrefix)
+		if partitionSuffix.MatchString(name) {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			// the link may be removed concurrently
+			continue
+		}
+		if target == device {
+			volumes = append(volumes, name)
+		}
+	}
+	return volumes, nil
+}
+
+// rescanSCSIHosts makes the kernel scan all SCSI hosts for new devices.
+func (r *sysfsDeviceResolver) rescanSCSIHosts() error {
+	scanFiles, err := filepath.Glob(filepath.Join(r.sysPath, "class", "scsi_host", "*", "scan"))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, scanFile := range scanFiles {
+		// scan all channels, targets, and LUNs
+		if err := os.WriteFile(scanFile, []byte("- - -"), 0200); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		r.log.WithField("scan_file", scanFile).Debug("rescanned SCSI host")
+	}
+	return errors.Join(errs...)
+}
+
+// findBySerial returns the path of the block device that is a DO volume with
+// the given name as its serial, or an empty string if there is none.
+func (r *sysfsDeviceResolver) findBySerial(volumeName string) (string, error) {
+	deviceDirs, err := filepath.Glob(filepath.Join(r.sysPath, "block", "*", "device"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, deviceDir := range deviceDirs {
+		vendor, err := readSysfsString(filepath.Join(deviceDir, "vendor"))
+		if err != nil || vendor != doSCSIVendor {
+			continue
+		}
+		model, err := readSysfsString(filepath.Join(deviceDir, "model"))
+		if err != nil || model != doSCSIModel {
+			continue
+		}
+
+		serial, err := readVPDSerial(filepath.Join(deviceDir, "vpd_pg80"))
+		if err != nil {
+			r.log.WithError(err).WithField("device_dir", deviceDir).Debug("failed to read unit serial number")
+			continue
+		}
+		if serial == volumeName {
+			name := filepath.Base(filepath.Dir(deviceDir))
+			return filepath.Join(r.devPath, name), nil
+		}
+	}
+
+	return "", nil
+}
+
+// readSysfsString reads a sysfs attribute, stripping the padding SCSI
+// identification strings come with.
+func readSysfsString(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readVPDSerial reads the unit serial number from the raw contents of SCSI
+// VPD page 0x80.
+func readVPDSerial(path string) (string, error) {
+	page, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if len(page) < 4 || page[1] != vpdPageUnitSerialNumber {
+		return "", fmt.Errorf("malformed unit serial number VPD page %q", path)
+	}
+
+	length := int(page[2])<<8 | int(page[3])
+	if len(page) < 4+length {
+		return "", fmt.Errorf("truncated unit serial number VPD page %q", path)
+	}
+
+	return strings.TrimSpace(string(page[4 : 4+length])), nil
+}
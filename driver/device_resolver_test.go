@@ -0,0 +1,252 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDeviceResolver(t *testing.T) {
+	const volumeName = "pvc-123"
+
+	newResolver := func(t *testing.T) *sysfsDeviceResolver {
+		root := t.TempDir()
+		r := newDeviceResolver(logrus.New().WithField("test_enabled", true))
+		r.diskIDPath = filepath.Join(root, "dev", "disk", "by-id")
+		r.sysPath = filepath.Join(root, "sys")
+		r.devPath = filepath.Join(root, "dev")
+		r.timeout = 200 * time.Millisecond
+		r.initialBackoff = 10 * time.Millisecond
+		r.maxBackoff = 20 * time.Millisecond
+
+		mustMkdirAll(t, r.diskIDPath)
+		mustMkdirAll(t, filepath.Join(r.sysPath, "class", "scsi_host", "host0"))
+		mustWriteFile(t, filepath.Join(r.sysPath, "class", "scsi_host", "host0", "scan"), "")
+		return r
+	}
+
+	addSCSIDevice := func(t *testing.T, r *sysfsDeviceResolver, name, vendor, model, serial string) {
+		deviceDir := filepath.Join(r.sysPath, "block", name, "device")
+		mustMkdirAll(t, deviceDir)
+		mustWriteFile(t, filepath.Join(deviceDir, "vendor"), vendor+"      \n")
+		mustWriteFile(t, filepath.Join(deviceDir, "model"), model+"          \n")
+		page := append([]byte{0, vpdPageUnitSerialNumber, 0, byte(len(serial))}, serial...)
+		mustWriteFile(t, filepath.Join(deviceDir, "vpd_pg80"), string(page))
+	}
+
+	t.Run("by-id symlink", func(t *testing.T) {
+		r := newResolver(t)
+		byIDPath := filepath.Join(r.diskIDPath, diskDOPrefix+volumeName)
+		mustWriteFile(t, byIDPath, "")
+
+		path, err := r.Resolve(context.Background(), volumeName)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if path != byIDPath {
+			t.Errorf("got path %q, want %q", path, byIDPath)
+		}
+	})
+
+	t.Run("late by-id symlink", func(t *testing.T) {
+		r := newResolver(t)
+		byIDPath := filepath.Join(r.diskIDPath, diskDOPrefix+volumeName)
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			_ = os.WriteFile(byIDPath, nil, 0644)
+		}()
+
+		path, err := r.Resolve(context.Background(), volumeName)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if path != byIDPath {
+			t.Errorf("got path %q, want %q", path, byIDPath)
+		}
+	})
+
+	t.Run("serial in sysfs", func(t *testing.T) {
+		r := newResolver(t)
+		addSCSIDevice(t, r, "sda", "DO", "Volume", "pvc-other")
+		addSCSIDevice(t, r, "sdb", "QEMU", "QEMU HARDDISK", volumeName)
+		addSCSIDevice(t, r, "sdc", "DO", "Volume", volumeName)
+
+		path, err := r.Resolve(context.Background(), volumeName)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if want := filepath.Join(r.devPath, "sdc"); path != want {
+			t.Errorf("got path %q, want %q", path, want)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		r := newResolver(t)
+		addSCSIDevice(t, r, "sda", "DO", "Volume", "pvc-other")
+
+		if path, err := r.Resolve(context.Background(), volumeName); err == nil {
+			t.Fatalf("got path %q, want error", path)
+		}
+
+		scan, err := os.ReadFile(filepath.Join(r.sysPath, "class", "scsi_host", "host0", "scan"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(scan) != "- - -" {
+			t.Errorf("got SCSI host scan %q, want %q", scan, "- - -")
+		}
+	})
+}
+
+func TestDeviceResolverVerify(t *testing.T) {
+	const (
+		volumeID   = "3be4aa5b-5fd4-11ea-8bab-0a58ac14c7b2"
+		volumeName = "pvc-123"
+	)
+
+	tests := []struct {
+		name   string
+		vendor string
+		model  string
+		serial string
+		// page is the raw VPD page, if it is not built from the serial.
+		page string
+		// links are the volumes with further by-id symlinks to the device.
+		links   []string
+		wantErr bool
+	}{
+		{
+			name:   "matching device",
+			vendor: "DO",
+			model:  "Volume",
+			serial: volumeName,
+		},
+		{
+			name:    "other volume",
+			vendor:  "DO",
+			model:   "Volume",
+			serial:  "pvc-other",
+			wantErr: true,
+		},
+		{
+			name:   "serial is the volume ID",
+			vendor: "DO",
+			model:  "Volume",
+			serial: volumeID,
+		},
+		{
+			name:    "device of another volume",
+			vendor:  "DO",
+			model:   "Volume",
+			serial:  "pvc-other",
+			links:   []string{"pvc-other"},
+			wantErr: true,
+		},
+		{
+			name:    "device linked as another volume without serial",
+			vendor:  "DO",
+			model:   "Volume",
+			links:   []string{"pvc-other"},
+			wantErr: true,
+		},
+		{
+			name:   "partition links",
+			vendor: "DO",
+			model:  "Volume",
+			serial: volumeName,
+			links:  []string{"pvc-other-part1"},
+		},
+		{
+			name:    "other vendor",
+			vendor:  "QEMU",
+			model:   "QEMU HARDDISK",
+			serial:  volumeName,
+			wantErr: true,
+		},
+		{
+			name:   "missing serial",
+			vendor: "DO",
+			model:  "Volume",
+		},
+		{
+			name:    "malformed serial",
+			vendor:  "DO",
+			model:   "Volume",
+			page:    "\x00\x83\x00\x07pvc-123",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			r := newDeviceResolver(logrus.New().WithField("test_enabled", true))
+			r.sysPath = filepath.Join(root, "sys")
+			r.diskIDPath = filepath.Join(root, "dev")
+
+			devicePath := filepath.Join(root, "dev", "sdb")
+			mustMkdirAll(t, filepath.Dir(devicePath))
+			mustWriteFile(t, devicePath, "")
+			byIDPath := filepath.Join(root, "dev", diskDOPrefix+volumeName)
+			if err := os.Symlink(devicePath, byIDPath); err != nil {
+				t.Fatal(err)
+			}
+			for _, link := range test.links {
+				if err := os.Symlink(devicePath, filepath.Join(root, "dev", diskDOPrefix+link)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deviceDir := filepath.Join(r.sysPath, "block", "sdb", "device")
+			mustMkdirAll(t, deviceDir)
+			mustWriteFile(t, filepath.Join(deviceDir, "vendor"), test.vendor+"      \n")
+			mustWriteFile(t, filepath.Join(deviceDir, "model"), test.model+"          \n")
+			if test.serial != "" {
+				page := append([]byte{0, vpdPageUnitSerialNumber, 0, byte(len(test.serial))}, test.serial...)
+				mustWriteFile(t, filepath.Join(deviceDir, "vpd_pg80"), string(page))
+			}
+			if test.page != "" {
+				mustWriteFile(t, filepath.Join(deviceDir, "vpd_pg80"), test.page)
+			}
+
+			err := r.Verify(byIDPath, volumeID, volumeName)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func mustMkdirAll(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -66,6 +66,9 @@ type Driver struct {
 	// publishInfoVolumeName is used to pass the volume name from
 	// `ControllerPublishVolume` to `NodeStageVolume or `NodePublishVolume`
 	publishInfoVolumeName string
+	// publishInfoReadOnly is used to tell `NodeStageVolume` and
+	// `NodePublishVolume` that the volume was published read-only
+	publishInfoReadOnly string
 
 	endpoint               string
 	debugAddr              string
@@ -75,11 +78,41 @@ type Driver struct {
 	isController           bool
 	defaultVolumesPageSize uint
 	validateAttachment     bool
-
-	srv     *grpc.Server
-	httpSrv *http.Server
-	log     *logrus.Entry
-	mounter Mounter
+	verifyDeviceIdentity   bool
+	reconcileMounts        bool
+	ephemeralVolumes       bool
+	ephemeralVolumeSweep   bool
+	listSnapshotsByTag     bool
+	preformatVolumes       bool
+	defaultFsckPolicy      fsckPolicy
+	defaultFormatPolicy    formatPolicy
+
+	srv       *grpc.Server
+	httpSrv   *http.Server
+	log       *logrus.Entry
+	mounter   Mounter
+	encryptor Encryptor
+
+	deviceResolver     DeviceResolver
+	volumeHealth       VolumeHealthChecker
+	blockDeviceResizer BlockDeviceResizer
+	fsResizer          FilesystemResizer
+	foreignVolumes     ForeignVolumeLister
+	mountReconciler    *mountReconciler
+	ioStats            *ioStatsCollector
+	// trimScheduler is nil if periodic trimming is disabled
+	trimScheduler *trimScheduler
+	// freezeServer is nil unless the node plugin freezes filesystems for
+	// snapshots
+	freezeServer *freezeServer
+	freezeSrv    *http.Server
+	// freezeAddr is the address on the droplet's private network the
+	// freeze server listens on
+	freezeAddr string
+	// freezeClient is nil unless the controller freezes filesystems for
+	// snapshots
+	freezeClient  FreezeClient
+	freezeTimeout time.Duration
 
 	storage        godo.StorageService
 	storageActions godo.StorageActionsService
@@ -109,7 +142,22 @@ type NewDriverParams struct {
 	DefaultVolumesPageSize uint
 	DOAPIRateLimitQPS      float64
 	ValidateAttachment     bool
+	VerifyDeviceIdentity   bool
+	ReconcileMounts        bool
+	EphemeralVolumeToken   string
+	SweepEphemeralVolumes  bool
+	TrimInterval           time.Duration
+	TrimConcurrency        uint
+	TrimBandwidth          uint
+	FreezeToken            string
+	FreezePort             uint
+	FreezeTimeout          time.Duration
 	VolumeLimit            uint
+	ListSnapshotsByTag     bool
+	PreformatVolumes       bool
+	FsckPolicy             string
+	FormatPolicy           string
+	Mounter                string
 }
 
 // NewDriver returns a CSI plugin that contains the necessary gRPC
@@ -121,8 +169,45 @@ func NewDriver(p NewDriverParams) (*Driver, error) {
 		driverName = DefaultDriverName
 	}
 
+	// the sweeper would otherwise delete the inline volumes of every cluster
+	// in the region
+	if p.SweepEphemeralVolumes && p.DOTag == "" {
+		return nil, fmt.Errorf("sweeping ephemeral volumes requires the do-tag flag to be set")
+	}
+
+	if p.TrimInterval > 0 && p.TrimConcurrency == 0 {
+		return nil, fmt.Errorf("trim concurrency must be at least 1")
+	}
+
+	if p.FreezeToken != "" && (p.FreezeTimeout <= 0 || p.FreezeTimeout > maxFreezeTimeout) {
+		return nil, fmt.Errorf("freeze timeout must be between 1s and %s", maxFreezeTimeout)
+	}
+
+	fsckPolicy := fsckPolicyNever
+	if p.FsckPolicy != "" {
+		var err error
+		fsckPolicy, err = parseFsckPolicy(p.FsckPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	formatPolicy := formatPolicyIfUnformatted
+	if p.FormatPolicy != "" {
+		var err error
+		formatPolicy, err = parseFormatPolicy(p.FormatPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the node plugin only talks to the DO API for ephemeral inline volumes
+	token := p.Token
+	if token == "" {
+		token = p.EphemeralVolumeToken
+	}
 	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{
-		AccessToken: p.Token,
+		AccessToken: token,
 	})
 	oauthClient := oauth2.NewClient(context.Background(), tokenSource)
 
@@ -155,6 +240,13 @@ func NewDriver(p NewDriverParams) (*Driver, error) {
 		"version": version,
 	})
 
+	mounter, err := newMounterByName(p.Mounter, log)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptor := newLuksEncryptor(log)
+
 	if p.DOAPIRateLimitQPS > 0 {
 		log.WithField("do_api_rate_limit", p.DOAPIRateLimitQPS).Info("setting DO API rate limit")
 		opts = append(opts, godo.SetStaticRateLimit(p.DOAPIRateLimitQPS))
@@ -167,20 +259,68 @@ func NewDriver(p NewDriverParams) (*Driver, error) {
 
 	healthChecker := NewHealthChecker(&doHealthChecker{account: doClient.Account})
 
+	var trimScheduler *trimScheduler
+	if p.Token == "" && p.TrimInterval > 0 {
+		trimScheduler = newTrimScheduler(log, driverName, p.TrimInterval, p.TrimConcurrency, uint64(p.TrimBandwidth)*miB)
+	}
+
+	var freezeServer *freezeServer
+	var freezeClient FreezeClient
+	var freezeAddr string
+	if p.FreezeToken != "" {
+		if p.Token == "" {
+			md, err := mdClient.Metadata()
+			if err != nil {
+				return nil, fmt.Errorf("couldn't get metadata to determine the private IP address to serve freeze requests on: %s", err)
+			}
+			privateIP := privateIPv4(md)
+			if privateIP == "" {
+				return nil, fmt.Errorf("freezing filesystems requires the droplet to have a private IPv4 address")
+			}
+			freezeAddr = net.JoinHostPort(privateIP, strconv.Itoa(int(p.FreezePort)))
+			freezeServer = newFreezeServer(log, driverName, p.FreezeToken)
+		} else {
+			freezeClient = newFreezeClient(p.FreezeToken, p.FreezePort)
+		}
+	}
+
 	return &Driver{
 		name:                  driverName,
 		publishInfoVolumeName: driverName + "/volume-name",
+		publishInfoReadOnly:   driverName + "/read-only",
 
 		doTag:                  p.DOTag,
 		endpoint:               p.Endpoint,
 		debugAddr:              p.DebugAddr,
 		defaultVolumesPageSize: p.DefaultVolumesPageSize,
 		volumeLimit:            p.VolumeLimit,
-
-		hostID:  func() string { return hostID },
-		region:  region,
-		mounter: newMounter(log),
-		log:     log,
+		listSnapshotsByTag:     p.ListSnapshotsByTag,
+		preformatVolumes:       p.PreformatVolumes,
+		defaultFsckPolicy:      fsckPolicy,
+		defaultFormatPolicy:    formatPolicy,
+		verifyDeviceIdentity:   p.VerifyDeviceIdentity,
+		reconcileMounts:        p.ReconcileMounts,
+		ephemeralVolumes:       p.Token == "" && p.EphemeralVolumeToken != "",
+		ephemeralVolumeSweep:   p.Token != "" && p.SweepEphemeralVolumes,
+
+		hostID:    func() string { return hostID },
+		region:    region,
+		mounter:   mounter,
+		encryptor: encryptor,
+
+		deviceResolver:     newDeviceResolver(log),
+		volumeHealth:       newVolumeHealthChecker(log),
+		blockDeviceResizer: newBlockDeviceResizer(log),
+		fsResizer:          newFilesystemResizer(),
+		foreignVolumes:     newForeignVolumeLister(log, driverName),
+		mountReconciler:    newMountReconciler(log, driverName, mounter, encryptor),
+		ioStats:            newIOStatsCollector(log, driverName),
+		trimScheduler:      trimScheduler,
+		freezeServer:       freezeServer,
+		freezeClient:       freezeClient,
+		freezeTimeout:      p.FreezeTimeout,
+		freezeAddr:         freezeAddr,
+		log:                log,
 		// we're assuming only the controller has a non-empty token.
 		isController: p.Token != "",
 
@@ -247,9 +387,17 @@ func (d *Driver) Run(ctx context.Context) error {
 				"num_volumes": details.numVolumes,
 			}).Warn("CSI plugin may not function correctly, please resolve volume limit")
 		}
+	} else if d.reconcileMounts {
+		// clean up after a previous instance of the node plugin before
+		// serving any requests
+		reconcileCtx, cancel := context.WithTimeout(ctx, reconcileTimeout)
+		d.mountReconciler.Reconcile(reconcileCtx)
+		cancel()
+	}
 
-		if d.debugAddr != "" {
-			mux := http.NewServeMux()
+	if d.debugAddr != "" {
+		mux := http.NewServeMux()
+		if d.isController {
 			mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 				err := d.healthChecker.Check(r.Context())
 				if err != nil {
@@ -259,11 +407,31 @@ func (d *Driver) Run(ctx context.Context) error {
 				}
 				w.WriteHeader(http.StatusOK)
 			})
-			d.httpSrv = &http.Server{
-				Addr:    d.debugAddr,
-				Handler: mux,
+		} else {
+			mux.Handle("/reconcile", d.mountReconciler)
+			mux.Handle("/metrics", d.ioStats)
+			if d.trimScheduler != nil {
+				mux.Handle("/trim", d.trimScheduler)
 			}
 		}
+		d.httpSrv = &http.Server{
+			Addr:    d.debugAddr,
+			Handler: mux,
+		}
+	}
+
+	if d.freezeServer != nil {
+		// a previous instance may have died with filesystems frozen
+		if err := d.freezeServer.ThawStale(); err != nil {
+			d.log.WithError(err).Error("failed to thaw filesystems left frozen by a previous instance")
+		}
+
+		// the node plugin runs in the host network, so only listen on the
+		// private network the controller reaches node plugins through
+		d.freezeSrv = &http.Server{
+			Addr:    d.freezeAddr,
+			Handler: d.freezeServer,
+		}
 	}
 
 	d.srv = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
@@ -293,6 +461,37 @@ func (d *Driver) Run(ctx context.Context) error {
 			return err
 		})
 	}
+	if d.freezeSrv != nil {
+		eg.Go(func() error {
+			<-ctx.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := d.freezeSrv.Shutdown(ctx)
+			// never leave filesystems frozen behind
+			d.freezeServer.ThawAll()
+			return err
+		})
+		eg.Go(func() error {
+			d.log.WithField("freeze_addr", d.freezeSrv.Addr).Info("starting freeze server")
+			err := d.freezeSrv.ListenAndServe()
+			if err == http.ErrServerClosed {
+				return nil
+			}
+			return err
+		})
+	}
+	if d.trimScheduler != nil {
+		eg.Go(func() error {
+			d.trimScheduler.Run(ctx)
+			return nil
+		})
+	}
+	if d.ephemeralVolumeSweep {
+		eg.Go(func() error {
+			d.runEphemeralVolumeSweeper(ctx)
+			return nil
+		})
+	}
 	eg.Go(func() error {
 		go func() {
 			<-ctx.Done()
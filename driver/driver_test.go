@@ -23,11 +23,13 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/digitalocean/godo"
 	"github.com/google/uuid"
 	"github.com/kubernetes-csi/csi-test/v4/pkg/sanity"
@@ -37,8 +39,7 @@ import (
 )
 
 const (
-	maxAPIPageSize = 200
-	numDroplets    = 100
+	numDroplets = 100
 )
 
 func init() {
@@ -85,8 +86,10 @@ func TestDriverSuite(t *testing.T) {
 		mounted: map[string]string{},
 	}
 	driver := &Driver{
-		name:     DefaultDriverName,
-		endpoint: endpoint,
+		name:                  DefaultDriverName,
+		publishInfoVolumeName: DefaultDriverName + "/volume-name",
+		publishInfoReadOnly:   DefaultDriverName + "/read-only",
+		endpoint:              endpoint,
 		hostID: func() string {
 			// Distribute requests across multiple nodes so that we do not run
 			// into the max-volumes-per-node limit.
@@ -94,10 +97,18 @@ func TestDriverSuite(t *testing.T) {
 			dropletIdx++
 			return strconv.Itoa(droplets[i+1].ID)
 		},
-		doTag:   doTag,
-		region:  "nyc3",
-		mounter: fm,
-		log:     logrus.New().WithField("test_enabed", true),
+		doTag:     doTag,
+		region:    "nyc3",
+		mounter:   fm,
+		encryptor: newFakeEncryptor(),
+
+		deviceResolver:       &fakeDeviceResolver{},
+		volumeHealth:         &fakeVolumeHealthChecker{},
+		blockDeviceResizer:   &fakeBlockDeviceResizer{},
+		fsResizer:            &fakeFilesystemResizer{},
+		foreignVolumes:       &fakeForeignVolumeLister{},
+		verifyDeviceIdentity: true,
+		log:                  logrus.New().WithField("test_enabed", true),
 
 		storage: &fakeStorageDriver{
 			volumes:   volumes,
@@ -114,7 +125,7 @@ func TestDriverSuite(t *testing.T) {
 			snapshots: snapshots,
 		},
 		account: &fakeAccountDriver{},
-		tags:    &fakeTagsDriver{},
+		tags:    &fakeTagsDriver{volumes: volumes},
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -226,6 +237,10 @@ func (f *fakeStorageDriver) CreateVolume(ctx context.Context, req *godo.VolumeCr
 		Name:          req.Name,
 		Description:   req.Description,
 		SizeGigaBytes: req.SizeGigaBytes,
+
+		FilesystemType:  req.FilesystemType,
+		FilesystemLabel: req.FilesystemLabel,
+		Tags:            req.Tags,
 	}
 
 	f.volumes[id] = vol
@@ -239,15 +254,17 @@ func (f *fakeStorageDriver) DeleteVolume(ctx context.Context, id string) (*godo.
 }
 
 func (f *fakeStorageDriver) ListSnapshots(ctx context.Context, volumeID string, opts *godo.ListOptions) ([]godo.Snapshot, *godo.Response, error) {
-	var snapshots []godo.Snapshot
-
-	for _, snap := range f.snapshots {
-		if snap.ResourceID == volumeID {
-			snapshots = append(snapshots, *snap)
+	if _, ok := f.volumes[volumeID]; !ok {
+		resp := godoResponse()
+		resp.Response = &http.Response{
+			StatusCode: http.StatusNotFound,
 		}
+		return nil, resp, errors.New("volume not found")
 	}
 
-	return snapshots, godoResponseWithMeta(len(snapshots)), nil
+	return pageSnapshots(f.snapshots, opts, func(snap *godo.Snapshot) bool {
+		return snap.ResourceID == volumeID
+	})
 }
 
 func (f *fakeStorageDriver) GetSnapshot(ctx context.Context, id string) (*godo.Snapshot, *godo.Response, error) {
@@ -277,6 +294,10 @@ func (f *fakeStorageDriver) CreateSnapshot(crx context.Context, req *godo.Snapsh
 
 	id := randString(10)
 	snap := createGodoSnapshot(id, req.Name, req.VolumeID)
+	snap.Tags = req.Tags
+	if vol, ok := f.volumes[req.VolumeID]; ok && vol.Region != nil {
+		snap.Regions = []string{vol.Region.Slug}
+	}
 
 	f.snapshots[id] = snap
 
@@ -405,52 +426,22 @@ func (f *fakeSnapshotsDriver) List(context.Context, *godo.ListOptions) ([]godo.S
 	panic("not implemented")
 }
 
-func (f *fakeSnapshotsDriver) ListVolumeSnapshotByRegion(context.Context, string, *godo.ListOptions) ([]godo.Snapshot, *godo.Response, error) {
-	panic("not implemented")
+func (f *fakeSnapshotsDriver) ListVolumeSnapshotByRegion(ctx context.Context, region string, opts *godo.ListOptions) ([]godo.Snapshot, *godo.Response, error) {
+	return pageSnapshots(f.snapshots, opts, func(snap *godo.Snapshot) bool {
+		if region == "" {
+			return true
+		}
+		for _, r := range snap.Regions {
+			if r == region {
+				return true
+			}
+		}
+		return false
+	})
 }
 
 func (f *fakeSnapshotsDriver) ListVolume(ctx context.Context, opts *godo.ListOptions) ([]godo.Snapshot, *godo.Response, error) {
-	if opts == nil {
-		opts = &godo.ListOptions{}
-	}
-	if opts.Page == 0 {
-		opts.Page = 1
-	}
-
-	// Convert snapshot map into ordered slice for deterministic
-	// output.
-	var names []string
-	for name := range f.snapshots {
-		names = append(names, name)
-	}
-	sort.Strings(names)
-
-	var snapshots []godo.Snapshot
-	for _, name := range names {
-		snapshots = append(snapshots, *f.snapshots[name])
-	}
-
-	// Mimic the maximum page size of the API.
-	if opts.PerPage == 0 || opts.PerPage > maxAPIPageSize {
-		opts.PerPage = maxAPIPageSize
-	}
-
-	start := (opts.Page - 1) * opts.PerPage
-	if start >= len(snapshots) {
-		// Requested page is larger than the snapshots we have, so return empty
-		// result.
-		return []godo.Snapshot{}, godoResponseWithLinks(opts.Page, false), nil
-	}
-
-	snapshots = snapshots[start:]
-
-	hasNextPage := false
-	if len(snapshots) > opts.PerPage {
-		snapshots = snapshots[:opts.PerPage]
-		hasNextPage = true
-	}
-
-	return snapshots, godoResponseWithLinks(opts.Page, hasNextPage), nil
+	panic("not implemented")
 }
 
 func (f *fakeSnapshotsDriver) ListDroplet(context.Context, *godo.ListOptions) ([]godo.Snapshot, *godo.Response, error) {
@@ -482,7 +473,7 @@ type fakeMounter struct {
 	mounted map[string]string
 }
 
-func (f *fakeMounter) Format(source string, fsType string) error {
+func (f *fakeMounter) Format(source string, fsType string, opts ...string) error {
 	return nil
 }
 
@@ -508,14 +499,134 @@ func (f *fakeMounter) IsAttached(source string) error {
 	return nil
 }
 
-func (f *fakeMounter) IsFormatted(source string) (bool, error) {
-	return true, nil
+func (f *fakeMounter) ProbeDevice(source string) (*deviceSignature, error) {
+	return &deviceSignature{Type: defaultFsType, Usage: blkidUsageFilesystem}, nil
+}
+
+func (f *fakeMounter) MountContext(target string) (string, error) {
+	return "", nil
+}
+
+func (f *fakeMounter) ApplyMountGroup(root string, gid int) (bool, error) {
+	return false, nil
 }
+
+func (f *fakeMounter) Fsck(source, fsType string, repair bool) (*fsckResult, error) {
+	return &fsckResult{}, nil
+}
+
+func (f *fakeMounter) ReplayJournal(source string) error {
+	return nil
+}
+
 func (f *fakeMounter) IsMounted(target string) (bool, error) {
 	_, ok := f.mounted[target]
 	return ok, nil
 }
 
+type fakeDeviceResolver struct{}
+
+func (f *fakeDeviceResolver) Resolve(ctx context.Context, volumeName string) (string, error) {
+	return filepath.Join(diskIDPath, diskDOPrefix+volumeName), nil
+}
+
+func (f *fakeDeviceResolver) Verify(devicePath, volumeID, volumeName string) error {
+	return nil
+}
+
+type fakeVolumeHealthChecker struct{}
+
+func (f *fakeVolumeHealthChecker) Condition(volumePath string, isBlock bool) (*csi.VolumeCondition, error) {
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}, nil
+}
+
+type fakeBlockDeviceResizer struct{}
+
+func (f *fakeBlockDeviceResizer) Resize(ctx context.Context, devicePath string, requiredBytes int64) (int64, error) {
+	return requiredBytes, nil
+}
+
+type fakeForeignVolumeLister struct{}
+
+func (f *fakeForeignVolumeLister) List() ([]string, error) {
+	return nil, nil
+}
+
+// fakeEncryptor keeps track of the LUKS formatted devices and opened device
+// mappers, and records the calls changing them.
+type fakeEncryptor struct {
+	// luks holds the LUKS formatted source devices.
+	luks map[string]bool
+	// opened maps the opened device mappers to their source devices.
+	opened map[string]string
+	calls  []string
+}
+
+func newFakeEncryptor() *fakeEncryptor {
+	return &fakeEncryptor{
+		luks:   map[string]bool{},
+		opened: map[string]string{},
+	}
+}
+
+func (f *fakeEncryptor) IsLuks(source string) (bool, error) {
+	return f.luks[source], nil
+}
+
+func (f *fakeEncryptor) LuksFormat(source, key string) error {
+	f.luks[source] = true
+	f.calls = append(f.calls, "format "+source)
+	return nil
+}
+
+func (f *fakeEncryptor) LuksOpen(source, mapperName, key string, readOnly bool) error {
+	if !f.luks[source] {
+		return fmt.Errorf("%s is not a LUKS device", source)
+	}
+	if _, ok := f.opened[mapperName]; ok {
+		return nil
+	}
+	f.opened[mapperName] = source
+	if readOnly {
+		f.calls = append(f.calls, "open --readonly "+mapperName)
+		return nil
+	}
+	f.calls = append(f.calls, "open "+mapperName)
+	return nil
+}
+
+func (f *fakeEncryptor) LuksClose(mapperName string) error {
+	if _, ok := f.opened[mapperName]; !ok {
+		return nil
+	}
+	delete(f.opened, mapperName)
+	f.calls = append(f.calls, "close "+mapperName)
+	return nil
+}
+
+func (f *fakeEncryptor) LuksResize(mapperName, key string) error {
+	if _, ok := f.opened[mapperName]; !ok {
+		return fmt.Errorf("device mapper %s does not exist", mapperName)
+	}
+	f.calls = append(f.calls, "resize "+mapperName)
+	return nil
+}
+
+func (f *fakeEncryptor) IsLuksOpen(mapperName string) (bool, error) {
+	_, ok := f.opened[mapperName]
+	return ok, nil
+}
+
+type fakeFilesystemResizer struct{}
+
+func (f *fakeFilesystemResizer) NeedResize(devicePath, deviceMountPath string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeFilesystemResizer) Resize(devicePath, deviceMountPath string) (bool, error) {
+	return true, nil
+}
+
 func (f *fakeMounter) checkMountPath(path string) (sanity.PathKind, error) {
 	isMounted, err := f.IsMounted(path)
 	if err != nil {
@@ -543,6 +654,54 @@ func (f *fakeMounter) IsBlockDevice(volumePath string) (bool, error) {
 	return false, nil
 }
 
+// pageSnapshots returns the requested page of those snapshots that keep
+// returns true for, mimicking the paging behavior of the DO API.
+func pageSnapshots(snapshotsByID map[string]*godo.Snapshot, opts *godo.ListOptions, keep func(*godo.Snapshot) bool) ([]godo.Snapshot, *godo.Response, error) {
+	if opts == nil {
+		opts = &godo.ListOptions{}
+	}
+	if opts.Page == 0 {
+		opts.Page = 1
+	}
+
+	// Convert snapshot map into ordered slice for deterministic
+	// output.
+	var ids []string
+	for id, snap := range snapshotsByID {
+		if keep(snap) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var snapshots []godo.Snapshot
+	for _, id := range ids {
+		snapshots = append(snapshots, *snapshotsByID[id])
+	}
+
+	// Mimic the maximum page size of the API.
+	if opts.PerPage == 0 || opts.PerPage > maxAPIPageSize {
+		opts.PerPage = maxAPIPageSize
+	}
+
+	start := (opts.Page - 1) * opts.PerPage
+	if start >= len(snapshots) {
+		// Requested page is larger than the snapshots we have, so return empty
+		// result.
+		return []godo.Snapshot{}, godoResponseWithLinks(opts.Page, false), nil
+	}
+
+	snapshots = snapshots[start:]
+
+	hasNextPage := false
+	if len(snapshots) > opts.PerPage {
+		snapshots = snapshots[:opts.PerPage]
+		hasNextPage = true
+	}
+
+	return snapshots, godoResponseWithLinks(opts.Page, hasNextPage), nil
+}
+
 func createGodoSnapshot(id, name, volumeID string) *godo.Snapshot {
 	return &godo.Snapshot{
 		ID:         id,
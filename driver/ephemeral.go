@@ -0,0 +1,441 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/digitalocean/godo"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// volumeContextEphemeral is set to "true" by kubelet in the volume
+	// context of CSI ephemeral inline volumes.
+	volumeContextEphemeral = "csi.storage.k8s.io/ephemeral"
+
+	// parameterEphemeralSize is the volume attribute of an inline volume
+	// that sets the size of its scratch volume (e.g., 100Gi).
+	parameterEphemeralSize = DefaultDriverName + "/size"
+
+	// ephemeralVolumeIDPrefix prefixes the volume IDs kubelet generates for
+	// inline volumes. DO volume IDs are UUIDs and never carry it.
+	ephemeralVolumeIDPrefix = "csi-"
+
+	// ephemeralVolumeNamePrefix prefixes the names of the DO volumes backing
+	// inline volumes.
+	ephemeralVolumeNamePrefix = "csi-ephemeral-"
+
+	// ephemeralVolumeTag marks the DO volumes backing inline volumes, e.g.,
+	// to find leftovers of deleted nodes.
+	ephemeralVolumeTag = "csi-ephemeral"
+
+	createdForEphemeral = "Created by DigitalOcean CSI driver for an ephemeral inline volume"
+
+	// ephemeralVolumeSweepInterval is how often the controller looks for
+	// volumes of inline volumes left behind.
+	ephemeralVolumeSweepInterval = 10 * time.Minute
+
+	// ephemeralVolumeGracePeriod is how long a volume of an inline volume
+	// may exist without being attached before it is considered left behind.
+	// It covers the time between creating and attaching the volume, and
+	// retries of kubelet in between.
+	ephemeralVolumeGracePeriod = time.Hour
+)
+
+// isEphemeralVolume checks whether the volume context belongs to a CSI
+// ephemeral inline volume.
+func isEphemeralVolume(volumeContext map[string]string) bool {
+	return volumeContext[volumeContextEphemeral] == "true"
+}
+
+// ephemeralVolumeName returns the name of the DO volume backing the inline
+// volume with the given ID. Kubelet derives the ID from the pod UID and the
+// volume name, and it is too long for a DO volume name.
+func ephemeralVolumeName(volumeID string) string {
+	sum := sha256.Sum256([]byte(volumeID))
+	return ephemeralVolumeNamePrefix + hex.EncodeToString(sum[:])[:32]
+}
+
+// parseEphemeralSize parses the size of an inline volume, given in whole Gi
+// or Ti, and returns it in bytes.
+func parseEphemeralSize(size string) (int64, error) {
+	if size == "" {
+		return defaultVolumeSizeInBytes, nil
+	}
+
+	unit := int64(giB)
+	num, ok := strings.CutSuffix(size, "Gi")
+	if !ok {
+		num, ok = strings.CutSuffix(size, "Ti")
+		unit = tiB
+	}
+	if !ok {
+		return 0, fmt.Errorf("parameter %q must be given in Gi or Ti (e.g., 100Gi), got %q", parameterEphemeralSize, size)
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("parameter %q must be a positive whole number of Gi or Ti, got %q", parameterEphemeralSize, size)
+	}
+
+	bytes := n * unit
+	if bytes < minimumVolumeSizeInBytes || bytes > maximumVolumeSizeInBytes {
+		return 0, fmt.Errorf("parameter %q must be between %s and %s, got %q", parameterEphemeralSize, formatBytes(minimumVolumeSizeInBytes), formatBytes(maximumVolumeSizeInBytes), size)
+	}
+	return bytes, nil
+}
+
+// nodePublishEphemeralVolume creates a DO volume for the inline volume of the
+// request, attaches it to this node, and mounts it to the target path. Inline
+// volumes skip ControllerPublishVolume and NodeStageVolume, so the node
+// plugin does their part.
+func (d *Driver) nodePublishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest, log *logrus.Entry) error {
+	if !d.ephemeralVolumes {
+		return status.Error(codes.FailedPrecondition, "ephemeral inline volumes are not enabled, the node plugin needs a DigitalOcean access token (--ephemeral-volume-token)")
+	}
+
+	mnt := req.VolumeCapability.GetMount()
+	if mnt == nil {
+		return status.Error(codes.InvalidArgument, "ephemeral inline volumes only support the mount access type")
+	}
+
+	size, err := parseEphemeralSize(req.VolumeContext[parameterEphemeralSize])
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	fsType := defaultFsType
+	if mnt.FsType != "" {
+		fsType = mnt.FsType
+	}
+
+	mountGroup, err := parseMountGroup(mnt.VolumeMountGroup)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	dropletID, err := strconv.Atoi(d.hostID())
+	if err != nil {
+		return status.Errorf(codes.Internal, "host ID %q cannot be converted to integer: %s", d.hostID(), err)
+	}
+
+	target := req.TargetPath
+	volumeName := ephemeralVolumeName(req.VolumeId)
+	log = log.WithFields(logrus.Fields{
+		"volume_name": volumeName,
+		"size":        formatBytes(size),
+		"fs_type":     fsType,
+		"droplet_id":  dropletID,
+		"ephemeral":   true,
+	})
+
+	mounted, err := d.mounter.IsMounted(target)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		log.Info("ephemeral volume is already mounted")
+		return nil
+	}
+
+	vol, err := d.ensureEphemeralVolume(ctx, volumeName, size, log)
+	if err != nil {
+		return err
+	}
+	log = log.WithField("do_volume_id", vol.ID)
+
+	if err := d.attachEphemeralVolume(ctx, vol, dropletID, log); err != nil {
+		return err
+	}
+
+	source, err := d.deviceResolver.Resolve(ctx, volumeName)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to find device path for volume %s: %v", volumeName, err)
+	}
+	if d.verifyDeviceIdentity {
+		if err := d.deviceResolver.Verify(source, vol.ID, volumeName); err != nil {
+			return status.Errorf(codes.FailedPrecondition, "device %q of volume %q failed identity verification: %v", source, volumeName, err)
+		}
+	}
+	log = log.WithField("source", source)
+
+	sig, err := d.mounter.ProbeDevice(source)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	format, err := needsFormat(req.VolumeId, sig, fsType, formatPolicyIfUnformatted, "")
+	if err != nil {
+		return err
+	}
+	if format {
+		log.Info("formatting the ephemeral volume")
+		if err := d.mounter.Format(source, fsType); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	options := append([]string{}, mnt.MountFlags...)
+	if req.Readonly {
+		options = append(options, "ro")
+	}
+	if mountGroup >= 0 {
+		options = append(options, mountGroupMountOptions(fsType, mountGroup)...)
+	}
+
+	log.WithField("mount_options", options).Info("mounting the ephemeral volume")
+	if err := d.mounter.Mount(source, target, fsType, options...); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if mountGroup >= 0 && !req.Readonly {
+		if err := d.applyVolumeMountGroup(target, fsType, mountGroup, log); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureEphemeralVolume returns the DO volume with the given name, creating
+// it if it does not exist yet.
+func (d *Driver) ensureEphemeralVolume(ctx context.Context, volumeName string, size int64, log *logrus.Entry) (*godo.Volume, error) {
+	volumes, _, err := d.storage.ListVolumes(ctx, &godo.ListVolumeParams{
+		Region: d.region,
+		Name:   volumeName,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(volumes) > 1 {
+		return nil, status.Errorf(codes.Internal, "fatal issue: duplicate volume %q exists", volumeName)
+	}
+	if len(volumes) == 1 {
+		log.Info("ephemeral volume already created")
+		return &volumes[0], nil
+	}
+
+	volumeReq := &godo.VolumeCreateRequest{
+		Region:        d.region,
+		Name:          volumeName,
+		Description:   createdForEphemeral,
+		SizeGigaBytes: size / giB,
+		Tags:          []string{ephemeralVolumeTag},
+	}
+	if d.doTag != "" {
+		volumeReq.Tags = append(volumeReq.Tags, d.doTag)
+	}
+
+	log.Info("creating ephemeral volume")
+	vol, resp, err := d.storage.CreateVolume(ctx, volumeReq)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusForbidden && strings.Contains(err.Error(), "capacity limit exceeded") {
+			return nil, status.Errorf(codes.ResourceExhausted, "volume limit has been reached. Please contact support")
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return vol, nil
+}
+
+// attachEphemeralVolume attaches the DO volume to the given droplet unless it
+// is attached already.
+func (d *Driver) attachEphemeralVolume(ctx context.Context, vol *godo.Volume, dropletID int, log *logrus.Entry) error {
+	for _, id := range vol.DropletIDs {
+		if id == dropletID {
+			log.Info("ephemeral volume is already attached")
+			return nil
+		}
+		return status.Errorf(codes.FailedPrecondition, "ephemeral volume %q is attached to another droplet (%d)", vol.Name, id)
+	}
+
+	log.Info("attaching ephemeral volume")
+	action, resp, err := d.storageActions.Attach(ctx, vol.ID, dropletID)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnprocessableEntity {
+			if strings.Contains(err.Error(), "This volume is already attached") {
+				return nil
+			}
+			if strings.Contains(err.Error(), "Droplet already has a pending event") {
+				return status.Errorf(codes.Aborted, "cannot attach because droplet %d has pending action for volume %q", dropletID, vol.ID)
+			}
+			if strings.Contains(err.Error(), maxVolumesPerDropletErrorMessage) ||
+				strings.Contains(err.Error(), maxVolumesPerDropletErrorLegacyMessage) {
+				return status.Error(codes.ResourceExhausted, err.Error())
+			}
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if action != nil {
+		log = logWithAction(log, action)
+		log.Info("waiting until ephemeral volume is attached")
+		if err := d.waitAction(ctx, log, vol.ID, action.ID); err != nil {
+			return status.Errorf(codes.Internal, "failed waiting on action ID %d for volume ID %s to get attached: %s", action.ID, vol.ID, err)
+		}
+	}
+	return nil
+}
+
+// nodeUnpublishEphemeralVolume detaches and deletes the DO volume backing the
+// inline volume with the given ID, once it is unmounted.
+func (d *Driver) nodeUnpublishEphemeralVolume(ctx context.Context, volumeID string, log *logrus.Entry) error {
+	volumeName := ephemeralVolumeName(volumeID)
+	log = log.WithFields(logrus.Fields{
+		"volume_name": volumeName,
+		"ephemeral":   true,
+	})
+
+	volumes, _, err := d.storage.ListVolumes(ctx, &godo.ListVolumeParams{
+		Region: d.region,
+		Name:   volumeName,
+	})
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if len(volumes) == 0 {
+		log.Info("ephemeral volume is already deleted")
+		return nil
+	}
+	vol := volumes[0]
+	log = log.WithField("do_volume_id", vol.ID)
+
+	for _, dropletID := range vol.DropletIDs {
+		log.WithField("droplet_id", dropletID).Info("detaching ephemeral volume")
+		action, resp, err := d.storageActions.DetachByDropletID(ctx, vol.ID, dropletID)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusUnprocessableEntity && strings.Contains(err.Error(), "Droplet already has a pending event") {
+				return status.Errorf(codes.Aborted, "cannot detach because droplet %d has pending action for volume %q", dropletID, vol.ID)
+			}
+			if resp == nil || resp.StatusCode != http.StatusNotFound {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		if action != nil {
+			log = logWithAction(log, action)
+			log.Info("waiting until ephemeral volume is detached")
+			if err := d.waitAction(ctx, log, vol.ID, action.ID); err != nil {
+				return status.Errorf(codes.Internal, "failed waiting on action ID %d for volume ID %s to get detached: %s", action.ID, vol.ID, err)
+			}
+		}
+	}
+
+	log.Info("deleting ephemeral volume")
+	resp, err := d.storage.DeleteVolume(ctx, vol.ID)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// runEphemeralVolumeSweeper deletes the volumes of inline volumes left behind
+// every ephemeralVolumeSweepInterval until the context is done.
+func (d *Driver) runEphemeralVolumeSweeper(ctx context.Context) {
+	log := d.log.WithField("component", "ephemeral_volume_sweeper")
+	log.WithFields(logrus.Fields{
+		"interval":     ephemeralVolumeSweepInterval,
+		"grace_period": ephemeralVolumeGracePeriod,
+	}).Info("starting ephemeral volume sweeper")
+
+	ticker := time.NewTicker(ephemeralVolumeSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("ephemeral volume sweeper stopped")
+			return
+		case <-ticker.C:
+			if _, err := d.sweepEphemeralVolumes(ctx, time.Now(), log); err != nil {
+				log.WithError(err).Error("failed to sweep ephemeral volumes")
+			}
+		}
+	}
+}
+
+// sweepEphemeralVolumes deletes the volumes of inline volumes that are not
+// attached to any droplet and were created more than the grace period before
+// now. Inline volumes live as long as their pod on a single node, so such
+// volumes are left behind, e.g., by nodes deleted before kubelet could clean
+// up. Only volumes carrying the tag given by --do-tag are considered, so that
+// the inline volumes of other clusters are left alone. It returns the IDs of
+// the deleted volumes.
+func (d *Driver) sweepEphemeralVolumes(ctx context.Context, now time.Time, log *logrus.Entry) ([]string, error) {
+	if d.doTag == "" {
+		return nil, errors.New("refusing to sweep ephemeral volumes without a tag scoping them to the cluster")
+	}
+
+	params := &godo.ListVolumeParams{
+		Region:      d.region,
+		ListOptions: &godo.ListOptions{Page: 1, PerPage: maxAPIPageSize},
+	}
+
+	var stale []godo.Volume
+	for {
+		volumes, resp, err := d.storage.ListVolumes(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list volumes: %s", err)
+		}
+
+		for _, vol := range volumes {
+			if !hasTag(vol.Tags, ephemeralVolumeTag) || !hasTag(vol.Tags, d.doTag) || !strings.HasPrefix(vol.Name, ephemeralVolumeNamePrefix) {
+				continue
+			}
+			if len(vol.DropletIDs) > 0 || now.Sub(vol.CreatedAt) < ephemeralVolumeGracePeriod {
+				continue
+			}
+			stale = append(stale, vol)
+		}
+
+		if resp == nil || resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to page volumes: %s", err)
+		}
+		params.ListOptions.Page = page + 1
+	}
+
+	var deleted []string
+	for _, vol := range stale {
+		log := log.WithFields(logrus.Fields{
+			"volume_id":   vol.ID,
+			"volume_name": vol.Name,
+			"created_at":  vol.CreatedAt,
+		})
+		// volumes attached meanwhile cannot be deleted
+		resp, err := d.storage.DeleteVolume(ctx, vol.ID)
+		if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+			log.WithError(err).Warn("failed to delete ephemeral volume left behind")
+			continue
+		}
+		log.Info("deleted ephemeral volume left behind")
+		deleted = append(deleted, vol.ID)
+	}
+	return deleted, nil
+}
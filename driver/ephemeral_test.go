@@ -0,0 +1,295 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/digitalocean/godo"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseEphemeralSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{size: "", want: defaultVolumeSizeInBytes},
+		{size: "100Gi", want: 100 * giB},
+		{size: "2Ti", want: 2 * tiB},
+		{size: "0Gi", wantErr: true},
+		{size: "100G", wantErr: true},
+		{size: "1.5Ti", wantErr: true},
+		{size: "100Ti", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.size, func(t *testing.T) {
+			got, err := parseEphemeralSize(test.size)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got size %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEphemeralVolumeName(t *testing.T) {
+	volumeID := "csi-" + strings.Repeat("0123456789abcdef", 4)
+	name := ephemeralVolumeName(volumeID)
+	if len(name) > maxVolumeNameLength {
+		t.Errorf("got name %q longer than %d characters", name, maxVolumeNameLength)
+	}
+	if !strings.HasPrefix(name, ephemeralVolumeNamePrefix) {
+		t.Errorf("got name %q without prefix %q", name, ephemeralVolumeNamePrefix)
+	}
+	if other := ephemeralVolumeName(volumeID + "0"); other == name {
+		t.Errorf("got the same name %q for different volume IDs", name)
+	}
+}
+
+func TestNodePublishEphemeralVolume(t *testing.T) {
+	const (
+		dropletID  = 1
+		volumeID   = "csi-0123456789abcdef"
+		targetPath = "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/scratch/mount"
+	)
+
+	newDriver := func(ephemeralVolumes bool) (*Driver, map[string]*godo.Volume, map[int]*godo.Droplet, *fakeMounter) {
+		volumes := map[string]*godo.Volume{}
+		droplets := map[int]*godo.Droplet{dropletID: {ID: dropletID}}
+		m := &fakeMounter{mounted: map[string]string{}}
+		return &Driver{
+			hostID:           func() string { return strconv.Itoa(dropletID) },
+			region:           "nyc3",
+			doTag:            "k8s:cluster",
+			ephemeralVolumes: ephemeralVolumes,
+			mounter:          m,
+			deviceResolver:   &fakeDeviceResolver{},
+			storage:          &fakeStorageDriver{volumes: volumes},
+			storageActions:   &fakeStorageActionsDriver{volumes: volumes, droplets: droplets},
+			log:              logrus.New().WithField("test_enabled", true),
+		}, volumes, droplets, m
+	}
+
+	publishReq := &csi.NodePublishVolumeRequest{
+		VolumeId:   volumeID,
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+		VolumeContext: map[string]string{
+			volumeContextEphemeral: "true",
+			parameterEphemeralSize: "100Gi",
+		},
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		d, _, _, _ := newDriver(false)
+		_, err := d.NodePublishVolume(context.Background(), publishReq)
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("got error %v, want code %s", err, codes.FailedPrecondition)
+		}
+	})
+
+	t.Run("lifecycle", func(t *testing.T) {
+		d, volumes, droplets, m := newDriver(true)
+
+		for i := 0; i < 2; i++ {
+			if _, err := d.NodePublishVolume(context.Background(), publishReq); err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+		}
+
+		if len(volumes) != 1 {
+			t.Fatalf("got %d volumes, want 1", len(volumes))
+		}
+		var vol *godo.Volume
+		for _, v := range volumes {
+			vol = v
+		}
+		if vol.Name != ephemeralVolumeName(volumeID) {
+			t.Errorf("got volume name %q, want %q", vol.Name, ephemeralVolumeName(volumeID))
+		}
+		if vol.SizeGigaBytes != 100 {
+			t.Errorf("got volume size %d GiB, want 100 GiB", vol.SizeGigaBytes)
+		}
+		if !hasTag(vol.Tags, ephemeralVolumeTag) || !hasTag(vol.Tags, d.doTag) {
+			t.Errorf("got volume tags %v, want %q and %q", vol.Tags, ephemeralVolumeTag, d.doTag)
+		}
+		if got := droplets[dropletID].VolumeIDs; len(got) != 1 || got[0] != vol.ID {
+			t.Errorf("got attached volumes %v, want %v", got, []string{vol.ID})
+		}
+		if _, ok := m.mounted[targetPath]; !ok {
+			t.Errorf("got target path %q unmounted", targetPath)
+		}
+
+		// the fake storage actions do not record attachments on volumes
+		vol.DropletIDs = []int{dropletID}
+
+		_, err := d.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+		})
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+
+		if len(volumes) != 0 {
+			t.Errorf("got %d volumes after unpublishing, want none", len(volumes))
+		}
+		if got := droplets[dropletID].VolumeIDs; len(got) != 0 {
+			t.Errorf("got attached volumes %v after unpublishing, want none", got)
+		}
+		if _, ok := m.mounted[targetPath]; ok {
+			t.Errorf("got target path %q mounted after unpublishing", targetPath)
+		}
+	})
+
+	t.Run("block access type", func(t *testing.T) {
+		d, _, _, _ := newDriver(true)
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{
+					Block: &csi.VolumeCapability_BlockVolume{},
+				},
+			},
+			VolumeContext: map[string]string{volumeContextEphemeral: "true"},
+		}
+		_, err := d.NodePublishVolume(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("got error %v, want code %s", err, codes.InvalidArgument)
+		}
+	})
+}
+
+// unpagedStorageDriver is a fakeStorageDriver that lists all volumes at once
+// without consuming them.
+type unpagedStorageDriver struct {
+	*fakeStorageDriver
+}
+
+func (f *unpagedStorageDriver) ListVolumes(ctx context.Context, param *godo.ListVolumeParams) ([]godo.Volume, *godo.Response, error) {
+	var volumes []godo.Volume
+	for _, vol := range f.volumes {
+		volumes = append(volumes, *vol)
+	}
+	return volumes, godoResponse(), nil
+}
+
+func TestSweepEphemeralVolumes(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * ephemeralVolumeGracePeriod)
+
+	volumes := map[string]*godo.Volume{
+		"left-behind": {
+			ID:        "left-behind",
+			Name:      ephemeralVolumeNamePrefix + "1",
+			Tags:      []string{ephemeralVolumeTag, "k8s:cluster"},
+			CreatedAt: old,
+		},
+		"attached": {
+			ID:         "attached",
+			Name:       ephemeralVolumeNamePrefix + "2",
+			Tags:       []string{ephemeralVolumeTag, "k8s:cluster"},
+			DropletIDs: []int{1},
+			CreatedAt:  old,
+		},
+		"being-attached": {
+			ID:        "being-attached",
+			Name:      ephemeralVolumeNamePrefix + "3",
+			Tags:      []string{ephemeralVolumeTag, "k8s:cluster"},
+			CreatedAt: now.Add(-time.Minute),
+		},
+		"other-cluster": {
+			ID:        "other-cluster",
+			Name:      ephemeralVolumeNamePrefix + "4",
+			Tags:      []string{ephemeralVolumeTag, "k8s:other"},
+			CreatedAt: old,
+		},
+		"persistent": {
+			ID:        "persistent",
+			Name:      "pvc-123",
+			Tags:      []string{"k8s:cluster"},
+			CreatedAt: old,
+		},
+	}
+
+	d := &Driver{
+		region:  "nyc3",
+		doTag:   "k8s:cluster",
+		storage: &unpagedStorageDriver{&fakeStorageDriver{volumes: volumes}},
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	deleted, err := d.sweepEphemeralVolumes(context.Background(), now, d.log)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if want := []string{"left-behind"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted volumes %v, want %v", deleted, want)
+	}
+	for _, id := range []string{"attached", "being-attached", "other-cluster", "persistent"} {
+		if _, ok := volumes[id]; !ok {
+			t.Errorf("got volume %q deleted, want it kept", id)
+		}
+	}
+}
+
+func TestSweepEphemeralVolumesWithoutTag(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	volumes := map[string]*godo.Volume{
+		"other-cluster": {
+			ID:        "other-cluster",
+			Name:      ephemeralVolumeNamePrefix + "1",
+			Tags:      []string{ephemeralVolumeTag},
+			CreatedAt: now.Add(-2 * ephemeralVolumeGracePeriod),
+		},
+	}
+
+	d := &Driver{
+		region:  "nyc3",
+		storage: &unpagedStorageDriver{&fakeStorageDriver{volumes: volumes}},
+		log:     logrus.New().WithField("test_enabled", true),
+	}
+
+	if _, err := d.sweepEphemeralVolumes(context.Background(), now, d.log); err == nil {
+		t.Error("got no error sweeping without a tag")
+	}
+	if _, ok := volumes["other-cluster"]; !ok {
+		t.Error("got volume deleted, want it kept")
+	}
+}
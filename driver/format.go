@@ -0,0 +1,197 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// parameterFormatPolicy is the StorageClass parameter that defines the
+	// format policy of a volume. It overrides the driver-wide default.
+	parameterFormatPolicy = DefaultDriverName + "/format-policy"
+
+	// parameterRequireVolumeLabel is the StorageClass parameter that defines
+	// whether the filesystem of a volume must carry a label derived from the
+	// volume ID.
+	parameterRequireVolumeLabel = DefaultDriverName + "/require-volume-label"
+
+	// volumeLabelLength is the length of labels derived from volume IDs. It
+	// matches the maximum label length of xfs.
+	volumeLabelLength = 12
+
+	// blkidUsageFilesystem is the USAGE reported by blkid for filesystems.
+	blkidUsageFilesystem = "filesystem"
+)
+
+// formatPolicy defines when the node service may format a volume.
+type formatPolicy string
+
+const (
+	// formatPolicyNever never formats volumes and refuses to stage volumes
+	// without a filesystem.
+	formatPolicyNever formatPolicy = "never"
+
+	// formatPolicyIfUnformatted formats volumes that carry no signature at
+	// all and mounts existing filesystems as they are.
+	formatPolicyIfUnformatted formatPolicy = "if-unformatted"
+
+	// formatPolicyRequireExpectedFs formats volumes that carry no signature
+	// at all and refuses to mount filesystems of a type other than the
+	// requested one.
+	formatPolicyRequireExpectedFs formatPolicy = "require-expected-fs"
+)
+
+// foreignSignatures lists the signatures of block device users other than
+// filesystems that must never be formatted over, mapped to a description.
+var foreignSignatures = map[string]string{
+	"LVM2_member":       "LVM physical volume",
+	"crypto_LUKS":       "LUKS",
+	"linux_raid_member": "md RAID member",
+	"swap":              "swap",
+}
+
+// deviceSignature describes the signatures found on a block device.
+type deviceSignature struct {
+	// Type is the type of the filesystem or other superblock found on the
+	// device, if any.
+	Type string
+	// Usage is the usage blkid reports for the type (e.g., filesystem,
+	// raid, crypto, or other).
+	Usage string
+	// Label is the filesystem label, if any.
+	Label string
+	// PartitionTable is the type of the partition table found on the
+	// device, if any.
+	PartitionTable string
+}
+
+// isEmpty checks whether no signature was found at all.
+func (s *deviceSignature) isEmpty() bool {
+	return s.Type == "" && s.PartitionTable == ""
+}
+
+// String describes the signature for log and error messages.
+func (s *deviceSignature) String() string {
+	switch {
+	case s.PartitionTable != "":
+		return s.PartitionTable + " partition table"
+	case s.Type != "":
+		return s.Type
+	}
+	return "none"
+}
+
+// parseDeviceSignature parses the output of `blkid -p -o export`.
+func parseDeviceSignature(out string) *deviceSignature {
+	sig := &deviceSignature{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "TYPE":
+			sig.Type = val
+		case "USAGE":
+			sig.Usage = val
+		case "LABEL":
+			sig.Label = val
+		case "PTTYPE":
+			sig.PartitionTable = val
+		}
+	}
+	return sig
+}
+
+// parseFormatPolicy parses the given format policy.
+func parseFormatPolicy(policy string) (formatPolicy, error) {
+	switch p := formatPolicy(policy); p {
+	case formatPolicyNever, formatPolicyIfUnformatted, formatPolicyRequireExpectedFs:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid format policy %q, must be one of %q, %q, or %q", policy, formatPolicyNever, formatPolicyIfUnformatted, formatPolicyRequireExpectedFs)
+}
+
+// volumeFormatPolicy returns the format policy for the volume with the given
+// volume context.
+func (d *Driver) volumeFormatPolicy(volCtx map[string]string) (formatPolicy, error) {
+	policy, ok := volCtx[parameterFormatPolicy]
+	if !ok {
+		return d.defaultFormatPolicy, nil
+	}
+	return parseFormatPolicy(policy)
+}
+
+// volumeLabel returns the filesystem label derived from the given volume ID.
+func volumeLabel(volumeID string) string {
+	label := strings.ReplaceAll(volumeID, "-", "")
+	if len(label) > volumeLabelLength {
+		label = label[:volumeLabelLength]
+	}
+	return label
+}
+
+// supportsVolumeLabel checks whether the node service can label filesystems
+// of the given type.
+func supportsVolumeLabel(fsType string) bool {
+	switch fsType {
+	case "ext2", "ext3", "ext4", "xfs":
+		return true
+	}
+	return false
+}
+
+// needsFormat decides whether a device with the given signature must be
+// formatted with the given filesystem type. It returns a gRPC error if the
+// device must neither be formatted nor mounted. If label is not empty, an
+// existing filesystem must carry it.
+func needsFormat(volumeID string, sig *deviceSignature, fsType string, policy formatPolicy, label string) (bool, error) {
+	if sig.PartitionTable != "" {
+		return false, status.Errorf(codes.FailedPrecondition, "volume %q carries a %s partition table, refusing to format or mount it", volumeID, sig.PartitionTable)
+	}
+
+	if sig.isEmpty() {
+		if policy == formatPolicyNever {
+			return false, status.Errorf(codes.FailedPrecondition, "volume %q is not formatted and the format policy is %q", volumeID, policy)
+		}
+		return true, nil
+	}
+
+	if desc, ok := foreignSignatures[sig.Type]; ok {
+		return false, status.Errorf(codes.FailedPrecondition, "volume %q carries a %s signature, refusing to format or mount it", volumeID, desc)
+	}
+	if sig.Usage != "" && sig.Usage != blkidUsageFilesystem {
+		return false, status.Errorf(codes.FailedPrecondition, "volume %q carries a %s signature of type %q, refusing to format or mount it", volumeID, sig.Usage, sig.Type)
+	}
+
+	if policy == formatPolicyRequireExpectedFs && sig.Type != fsType {
+		return false, status.Errorf(codes.FailedPrecondition, "volume %q carries a %s filesystem but %s is expected", volumeID, sig.Type, fsType)
+	}
+
+	if label != "" && sig.Label != label {
+		return false, status.Errorf(codes.FailedPrecondition, "volume %q carries filesystem label %q but %q is expected", volumeID, sig.Label, label)
+	}
+
+	return false, nil
+}
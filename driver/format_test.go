@@ -0,0 +1,191 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseDeviceSignature(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		wantSig *deviceSignature
+	}{
+		{
+			name:    "empty",
+			wantSig: &deviceSignature{},
+		},
+		{
+			name: "filesystem",
+			out: `DEVNAME=/dev/sda
+UUID=3e6be9de-8139-11d1-9106-a43f08d823a6
+VERSION=1.0
+LABEL=data
+TYPE=ext4
+USAGE=filesystem
+`,
+			wantSig: &deviceSignature{Type: "ext4", Usage: "filesystem", Label: "data"},
+		},
+		{
+			name: "partition table",
+			out: `DEVNAME=/dev/sda
+PTUUID=c5b1e3c0-2e5b-4e4e-8f5d-7b1c9d6d8a3f
+PTTYPE=gpt
+`,
+			wantSig: &deviceSignature{PartitionTable: "gpt"},
+		},
+		{
+			name: "LVM physical volume",
+			out: `DEVNAME=/dev/sda
+UUID=Wf3m2Z-9hQ2-Uc0d-Kc3S-7yQb-gV1T-9fHk3a
+VERSION=LVM2 001
+TYPE=LVM2_member
+USAGE=raid
+`,
+			wantSig: &deviceSignature{Type: "LVM2_member", Usage: "raid"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if sig := parseDeviceSignature(test.out); !reflect.DeepEqual(sig, test.wantSig) {
+				t.Errorf("got signature %+v, want %+v", sig, test.wantSig)
+			}
+		})
+	}
+}
+
+func TestNeedsFormat(t *testing.T) {
+	const volumeID = "3e6be9de-8139-11d1-9106-a43f08d823a6"
+
+	tests := []struct {
+		name       string
+		sig        *deviceSignature
+		fsType     string
+		policy     formatPolicy
+		label      string
+		wantFormat bool
+		wantCode   codes.Code
+	}{
+		{
+			name:       "pristine device",
+			sig:        &deviceSignature{},
+			fsType:     "ext4",
+			policy:     formatPolicyIfUnformatted,
+			wantFormat: true,
+		},
+		{
+			name:     "pristine device with format policy never",
+			sig:      &deviceSignature{},
+			fsType:   "ext4",
+			policy:   formatPolicyNever,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:   "formatted device",
+			sig:    &deviceSignature{Type: "ext4", Usage: "filesystem"},
+			fsType: "ext4",
+			policy: formatPolicyNever,
+		},
+		{
+			name:   "other filesystem",
+			sig:    &deviceSignature{Type: "xfs", Usage: "filesystem"},
+			fsType: "ext4",
+			policy: formatPolicyIfUnformatted,
+		},
+		{
+			name:     "other filesystem with expected filesystem required",
+			sig:      &deviceSignature{Type: "xfs", Usage: "filesystem"},
+			fsType:   "ext4",
+			policy:   formatPolicyRequireExpectedFs,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "partition table",
+			sig:      &deviceSignature{PartitionTable: "gpt"},
+			fsType:   "ext4",
+			policy:   formatPolicyIfUnformatted,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "LVM physical volume",
+			sig:      &deviceSignature{Type: "LVM2_member", Usage: "raid"},
+			fsType:   "ext4",
+			policy:   formatPolicyIfUnformatted,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "LUKS",
+			sig:      &deviceSignature{Type: "crypto_LUKS", Usage: "crypto"},
+			fsType:   "ext4",
+			policy:   formatPolicyIfUnformatted,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "md RAID member",
+			sig:      &deviceSignature{Type: "linux_raid_member", Usage: "raid"},
+			fsType:   "ext4",
+			policy:   formatPolicyIfUnformatted,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "unknown non-filesystem signature",
+			sig:      &deviceSignature{Type: "zfs_member", Usage: "other"},
+			fsType:   "ext4",
+			policy:   formatPolicyIfUnformatted,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:   "matching label",
+			sig:    &deviceSignature{Type: "ext4", Usage: "filesystem", Label: volumeLabel(volumeID)},
+			fsType: "ext4",
+			policy: formatPolicyIfUnformatted,
+			label:  volumeLabel(volumeID),
+		},
+		{
+			name:     "mismatching label",
+			sig:      &deviceSignature{Type: "ext4", Usage: "filesystem", Label: "data"},
+			fsType:   "ext4",
+			policy:   formatPolicyIfUnformatted,
+			label:    volumeLabel(volumeID),
+			wantCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format, err := needsFormat(volumeID, test.sig, test.fsType, test.policy, test.label)
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("got code %s, want %s (error: %v)", code, test.wantCode, err)
+			}
+			if format != test.wantFormat {
+				t.Errorf("got format %t, want %t", format, test.wantFormat)
+			}
+		})
+	}
+}
+
+func TestVolumeLabel(t *testing.T) {
+	if got, want := volumeLabel("3e6be9de-8139-11d1-9106-a43f08d823a6"), "3e6be9de8139"; got != want {
+		t.Errorf("got label %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,579 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-metadata"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// parameterFreeze is the VolumeSnapshotClass parameter that defines
+	// whether the filesystem of a volume is frozen while it is snapshotted.
+	parameterFreeze = DefaultDriverName + "/freeze"
+
+	// maxFreezeTimeout bounds how long a filesystem may stay frozen before
+	// the node plugin thaws it on its own.
+	maxFreezeTimeout = 2 * time.Minute
+
+	// freezeRequestTimeout bounds the requests of the controller to the node
+	// plugin.
+	freezeRequestTimeout = 10 * time.Second
+
+	// fifreezeIoctl is FIFREEZE, i.e., _IOWR('X', 119, int).
+	fifreezeIoctl = 0xc0045877
+	// fithawIoctl is FITHAW, i.e., _IOWR('X', 120, int).
+	fithawIoctl = 0xc0045878
+)
+
+// freezeRequest is the body of the freeze and thaw requests of the controller
+// to the node plugin.
+type freezeRequest struct {
+	VolumeName string `json:"volume_name"`
+	// TimeoutSeconds is how long the filesystem stays frozen at most. It is
+	// ignored by thaw requests.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// freezeResponse is the body of the responses of the node plugin to freeze and
+// thaw requests.
+type freezeResponse struct {
+	// Path is the staging path of the volume, if it is staged as a
+	// filesystem.
+	Path string `json:"path,omitempty"`
+	// Frozen is set if a freeze request froze the filesystem.
+	Frozen bool `json:"frozen"`
+	// Thawed is set if a thaw request thawed the filesystem, i.e., if it was
+	// not thawed after the timeout already.
+	Thawed bool `json:"thawed"`
+}
+
+// frozenFilesystem is a filesystem frozen by the freeze server.
+type frozenFilesystem struct {
+	path     string
+	frozenAt time.Time
+	timer    *time.Timer
+}
+
+// freezeServer freezes and thaws the staged filesystems of volumes on request
+// of the controller, so that snapshots of them are consistent. Filesystems
+// are thawed after a timeout at the latest, even if the controller never asks
+// for it.
+type freezeServer struct {
+	log        *logrus.Entry
+	driverName string
+	token      string
+
+	diskIDPath    string
+	mountInfoPath string
+	kubeletDir    string
+	sysPath       string
+	freeze        func(path string) error
+	thaw          func(path string) error
+
+	mu sync.Mutex // protects frozen and freezing
+	// frozen maps volume names to their frozen filesystems.
+	frozen map[string]*frozenFilesystem
+	// freezing holds the names of the volumes whose filesystems are being
+	// frozen.
+	freezing map[string]bool
+}
+
+// newFreezeServer returns a new freezeServer operating on the host's kubelet
+// directory that authenticates requests with the given token.
+func newFreezeServer(log *logrus.Entry, driverName, token string) *freezeServer {
+	return &freezeServer{
+		log:           log.WithField("component", "freeze_server"),
+		driverName:    driverName,
+		token:         token,
+		diskIDPath:    diskIDPath,
+		mountInfoPath: procMountInfoPath,
+		kubeletDir:    defaultKubeletDir,
+		sysPath:       "/sys",
+		freeze:        freezeFilesystem,
+		thaw:          thawFilesystem,
+		frozen:        map[string]*frozenFilesystem{},
+		freezing:      map[string]bool{},
+	}
+}
+
+func (s *freezeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		s.log.WithField("remote_addr", r.RemoteAddr).Warn("rejecting unauthenticated freeze request")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req freezeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.VolumeName == "" {
+		http.Error(w, "request must be a JSON object carrying the volume name", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		resp freezeResponse
+		err  error
+	)
+	switch r.URL.Path {
+	case "/freeze":
+		timeout := time.Duration(req.TimeoutSeconds) * time.Second
+		if timeout <= 0 || timeout > maxFreezeTimeout {
+			http.Error(w, fmt.Sprintf("timeout must be between 1s and %s", maxFreezeTimeout), http.StatusBadRequest)
+			return
+		}
+		resp, err = s.Freeze(req.VolumeName, timeout)
+	case "/thaw":
+		resp, err = s.Thaw(req.VolumeName)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errAlreadyFrozen) || errors.Is(err, errFreezeInProgress) {
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.log.WithError(err).Error("failed to encode freeze response")
+	}
+}
+
+var (
+	errAlreadyFrozen    = errors.New("filesystem is frozen already")
+	errFreezeInProgress = errors.New("filesystem is being frozen")
+)
+
+// Freeze freezes the staged filesystem of the volume with the given name and
+// thaws it after the given timeout unless Thaw is called before. Volumes that
+// are not staged as a filesystem on the node are not frozen.
+func (s *freezeServer) Freeze(volumeName string, timeout time.Duration) (freezeResponse, error) {
+	log := s.log.WithFields(logrus.Fields{
+		"volume_name": volumeName,
+		"timeout":     timeout,
+	})
+
+	s.mu.Lock()
+	if _, ok := s.frozen[volumeName]; ok {
+		s.mu.Unlock()
+		return freezeResponse{}, errAlreadyFrozen
+	}
+	if s.freezing[volumeName] {
+		s.mu.Unlock()
+		return freezeResponse{}, errFreezeInProgress
+	}
+	s.freezing[volumeName] = true
+	s.mu.Unlock()
+
+	// FIFREEZE syncs the filesystem and may take a while, so the lock is not
+	// held across it to not hold up thaws of other volumes
+	path, err := s.stagingPath(volumeName)
+	if err == nil && path != "" {
+		if ferr := s.freeze(path); ferr != nil {
+			err = fmt.Errorf("failed to freeze filesystem at %q: %s", path, ferr)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.freezing, volumeName)
+
+	if err != nil {
+		return freezeResponse{}, err
+	}
+	if path == "" {
+		log.Info("volume is not staged as a filesystem on this node, not freezing it")
+		return freezeResponse{}, nil
+	}
+
+	log = log.WithField("path", path)
+	fs := &frozenFilesystem{path: path, frozenAt: time.Now()}
+	fs.timer = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// the filesystem may have been thawed and frozen again meanwhile
+		if s.frozen[volumeName] != fs {
+			return
+		}
+		delete(s.frozen, volumeName)
+		if err := s.thaw(path); err != nil {
+			log.WithError(err).Error("failed to thaw filesystem after timeout")
+			return
+		}
+		log.Warn("thawed filesystem after timeout")
+	})
+	s.frozen[volumeName] = fs
+
+	log.Info("froze filesystem")
+	return freezeResponse{Path: path, Frozen: true}, nil
+}
+
+// Thaw thaws the filesystem of the volume with the given name. Filesystems
+// that the server does not know to be frozen are thawed as well, as they may
+// have been frozen by a previous instance of the node plugin.
+func (s *freezeServer) Thaw(volumeName string) (freezeResponse, error) {
+	log := s.log.WithField("volume_name", volumeName)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.freezing[volumeName] {
+		return freezeResponse{}, errFreezeInProgress
+	}
+
+	fs, ok := s.frozen[volumeName]
+	if !ok {
+		path, err := s.stagingPath(volumeName)
+		if err != nil {
+			return freezeResponse{}, err
+		}
+		if path == "" {
+			log.Info("volume is not staged as a filesystem on this node, not thawing it")
+			return freezeResponse{}, nil
+		}
+		thawed, err := s.thawUnknown(path)
+		if err != nil {
+			return freezeResponse{}, fmt.Errorf("failed to thaw filesystem at %q: %s", path, err)
+		}
+		if !thawed {
+			log.WithField("path", path).Info("filesystem of volume is not frozen")
+			return freezeResponse{Path: path}, nil
+		}
+		log.WithField("path", path).Warn("thawed filesystem that was not frozen by this instance")
+		return freezeResponse{Path: path, Thawed: true}, nil
+	}
+
+	if err := s.thaw(fs.path); err != nil {
+		// keep the timer to retry on timeout
+		return freezeResponse{}, fmt.Errorf("failed to thaw filesystem at %q: %s", fs.path, err)
+	}
+	fs.timer.Stop()
+	delete(s.frozen, volumeName)
+
+	log.WithFields(logrus.Fields{
+		"path":       fs.path,
+		"frozen_for": time.Since(fs.frozenAt),
+	}).Info("thawed filesystem")
+	return freezeResponse{Path: fs.path, Thawed: true}, nil
+}
+
+// ThawAll thaws all frozen filesystems, e.g., when the node plugin shuts down.
+func (s *freezeServer) ThawAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for volumeName, fs := range s.frozen {
+		fs.timer.Stop()
+		delete(s.frozen, volumeName)
+
+		log := s.log.WithFields(logrus.Fields{
+			"volume_name": volumeName,
+			"path":        fs.path,
+		})
+		if err := s.thaw(fs.path); err != nil {
+			log.WithError(err).Error("failed to thaw filesystem")
+			continue
+		}
+		log.Info("thawed filesystem")
+	}
+}
+
+// ThawStale thaws the staged filesystems of all volumes of the driver on the
+// node. It is called when the node plugin starts, as a previous instance may
+// have died while filesystems were frozen, which would leave them frozen
+// forever.
+func (s *freezeServer) ThawStale() error {
+	infos, err := readMountInfo(s.mountInfoPath)
+	if err != nil {
+		return fmt.Errorf("failed to read mounts: %s", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range ownedMounts(s.kubeletDir, s.driverName, infos) {
+		if m.kind != mountKindStaging {
+			continue
+		}
+		log := s.log.WithField("path", m.info.MountPoint)
+		thawed, err := s.thawUnknown(m.info.MountPoint)
+		if err != nil {
+			log.WithError(err).Error("failed to thaw filesystem")
+			continue
+		}
+		if thawed {
+			log.Warn("thawed filesystem left frozen by a previous instance")
+		}
+	}
+	return nil
+}
+
+// thawUnknown thaws the filesystem mounted at the given path, which may or may
+// not be frozen. It returns whether the filesystem was frozen.
+func (s *freezeServer) thawUnknown(path string) (bool, error) {
+	err := s.thaw(path)
+	if errors.Is(err, unix.EINVAL) {
+		// the filesystem is not frozen
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// stagingPath returns the staging path of the volume with the given name. It
+// returns an empty path if the volume is not attached to the node or not
+// staged as a filesystem.
+func (s *freezeServer) stagingPath(volumeName string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(s.diskIDPath, diskDOPrefix+volumeName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to resolve device of volume: %s", err)
+	}
+	disk := filepath.Base(resolved)
+
+	infos, err := readMountInfo(s.mountInfoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read mounts: %s", err)
+	}
+	for _, m := range ownedMounts(s.kubeletDir, s.driverName, infos) {
+		if m.kind != mountKindStaging {
+			continue
+		}
+		for _, d := range mountDisks(s.sysPath, m.info) {
+			if d == disk {
+				return m.info.MountPoint, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// privateIPv4 returns the IPv4 address of the droplet's private interface, or
+// an empty string if it has none.
+func privateIPv4(md *metadata.Metadata) string {
+	for _, iface := range md.Interfaces["private"] {
+		if iface.IPv4 != nil && iface.IPv4.IPAddress != "" {
+			return iface.IPv4.IPAddress
+		}
+	}
+	return ""
+}
+
+// freezeFilesystem freezes the filesystem mounted at the given path, blocking
+// all writes until it is thawed.
+func freezeFilesystem(path string) error {
+	return filesystemIoctl(path, fifreezeIoctl)
+}
+
+// thawFilesystem thaws the filesystem mounted at the given path.
+func thawFilesystem(path string) error {
+	return filesystemIoctl(path, fithawIoctl)
+}
+
+func filesystemIoctl(path string, req uint) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	return unix.IoctlSetInt(fd, req, 0)
+}
+
+// FreezeClient asks node plugins to freeze and thaw the filesystems of
+// volumes.
+type FreezeClient interface {
+	// Freeze freezes the filesystem of the volume with the given name on
+	// the node with the given address for the given timeout at most. It
+	// returns whether the filesystem was frozen, which it is not if the
+	// volume is not staged as a filesystem.
+	Freeze(ctx context.Context, nodeAddr, volumeName string, timeout time.Duration) (bool, error)
+
+	// Thaw thaws the filesystem of the volume with the given name on the
+	// node with the given address. It returns whether the filesystem was
+	// still frozen, i.e., whether it was not thawed after the timeout
+	// already.
+	Thaw(ctx context.Context, nodeAddr, volumeName string) (bool, error)
+}
+
+// httpFreezeClient talks to the freeze servers of node plugins over HTTP.
+type httpFreezeClient struct {
+	token string
+	port  uint
+	http  *http.Client
+}
+
+// newFreezeClient returns a new FreezeClient talking to node plugins on the
+// given port with the given token.
+func newFreezeClient(token string, port uint) FreezeClient {
+	return &httpFreezeClient{
+		token: token,
+		port:  port,
+		http:  &http.Client{Timeout: freezeRequestTimeout},
+	}
+}
+
+func (c *httpFreezeClient) Freeze(ctx context.Context, nodeAddr, volumeName string, timeout time.Duration) (bool, error) {
+	resp, err := c.do(ctx, nodeAddr, "/freeze", freezeRequest{
+		VolumeName:     volumeName,
+		TimeoutSeconds: int(timeout.Round(time.Second) / time.Second),
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.Frozen, nil
+}
+
+func (c *httpFreezeClient) Thaw(ctx context.Context, nodeAddr, volumeName string) (bool, error) {
+	resp, err := c.do(ctx, nodeAddr, "/thaw", freezeRequest{VolumeName: volumeName})
+	if err != nil {
+		return false, err
+	}
+	return resp.Thawed, nil
+}
+
+func (c *httpFreezeClient) do(ctx context.Context, nodeAddr, path string, body freezeRequest) (freezeResponse, error) {
+	var resp freezeResponse
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return resp, err
+	}
+	u := "http://" + net.JoinHostPort(nodeAddr, strconv.Itoa(int(c.port))) + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return resp, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return resp, fmt.Errorf("%s failed with status %d: %s", u, httpResp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("failed to decode response of %s: %s", u, err)
+	}
+	return resp, nil
+}
+
+// freezeVolume freezes the filesystem of the volume with the given ID on the
+// node it is attached to, if any. It returns a function that thaws the
+// filesystem again.
+func (d *Driver) freezeVolume(ctx context.Context, log *logrus.Entry, volumeID string) (func(), error) {
+	noop := func() {}
+	if d.freezeClient == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "parameter %q requires the controller to run with --freeze-token", parameterFreeze)
+	}
+
+	vol, resp, err := d.storage.GetVolume(ctx, volumeID)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, status.Errorf(codes.NotFound, "volume %q not found", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get volume %q: %s", volumeID, err)
+	}
+	if len(vol.DropletIDs) == 0 {
+		log.Info("volume is not attached, no filesystem to freeze")
+		return noop, nil
+	}
+
+	dropletID := vol.DropletIDs[0]
+	droplet, _, err := d.droplets.Get(ctx, dropletID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get droplet %d the volume is attached to: %s", dropletID, err)
+	}
+	nodeAddr, err := droplet.PrivateIPv4()
+	if err != nil || nodeAddr == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to determine private IP address of droplet %d to freeze the filesystem on: %v", dropletID, err)
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"volume_name": vol.Name,
+		"droplet_id":  dropletID,
+		"node_addr":   nodeAddr,
+	})
+
+	freezeCtx, cancel := context.WithTimeout(ctx, freezeRequestTimeout)
+	defer cancel()
+	frozen, err := d.freezeClient.Freeze(freezeCtx, nodeAddr, vol.Name, d.freezeTimeout)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to freeze filesystem of volume %q on droplet %d: %s", volumeID, dropletID, err)
+	}
+	if !frozen {
+		log.Info("volume is not staged as a filesystem, not freezing it")
+		return noop, nil
+	}
+	log.Info("froze filesystem of volume")
+
+	frozenAt := time.Now()
+	return func() {
+		// thaw even if the request was canceled meanwhile
+		thawCtx, cancel := context.WithTimeout(context.Background(), freezeRequestTimeout)
+		defer cancel()
+
+		log := log.WithField("frozen_for", time.Since(frozenAt))
+		thawed, err := d.freezeClient.Thaw(thawCtx, nodeAddr, vol.Name)
+		switch {
+		case err != nil:
+			log.WithError(err).Error("failed to thaw filesystem of volume, the node plugin thaws it after the timeout")
+		case !thawed:
+			log.WithField("freeze_timeout", d.freezeTimeout).Warn("filesystem of volume was thawed after the timeout before the snapshot was taken, the snapshot may only be crash-consistent")
+		default:
+			log.Info("thawed filesystem of volume")
+		}
+	}, nil
+}
@@ -0,0 +1,491 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/digitalocean/go-metadata"
+	"github.com/digitalocean/godo"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingFreezer records the successful freeze and thaw calls of a
+// freezeServer and fails the calls the kernel fails, i.e., freezing a frozen
+// filesystem and thawing a filesystem that is not frozen.
+type recordingFreezer struct {
+	mu     sync.Mutex
+	frozen map[string]bool
+	calls  []string
+}
+
+func (r *recordingFreezer) record(op string) func(string) error {
+	return func(path string) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.frozen == nil {
+			r.frozen = map[string]bool{}
+		}
+		if freeze := op == "freeze"; r.frozen[path] == freeze {
+			if freeze {
+				return unix.EBUSY
+			}
+			return unix.EINVAL
+		}
+		r.frozen[path] = op == "freeze"
+		r.calls = append(r.calls, op+" "+path)
+		return nil
+	}
+}
+
+func (r *recordingFreezer) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+func newTestFreezeServer(t *testing.T) (*freezeServer, *recordingFreezer, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	kubeletDir := filepath.Join(root, "kubelet")
+	sysPath := filepath.Join(root, "sys")
+	devPath := filepath.Join(root, "dev")
+	idPath := filepath.Join(devPath, "disk", "by-id")
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+
+	symlink := func(target, link string) {
+		mustMkdirAll(t, filepath.Dir(link))
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	device := func(volumeName, name, majorMinor string) {
+		devDir := filepath.Join(sysPath, "devices", "virtual", "block", name)
+		mustMkdirAll(t, devDir)
+		symlink(devDir, filepath.Join(sysPath, "class", "block", name))
+		symlink(devDir, filepath.Join(sysPath, "dev", "block", majorMinor))
+		mustMkdirAll(t, devPath)
+		mustWriteFile(t, filepath.Join(devPath, name), "")
+		symlink(filepath.Join(devPath, name), filepath.Join(idPath, diskDOPrefix+volumeName))
+	}
+
+	// staged filesystem volume
+	device("pvc-fs", "sda", "8:0")
+	staging := filepath.Join(csiDir, DefaultDriverName, "aaa", "globalmount")
+	mustMkdirAll(t, filepath.Dir(staging))
+	mustWriteFile(t, filepath.Join(filepath.Dir(staging), volDataFileName), fmt.Sprintf(`{"driverName":%q}`, DefaultDriverName))
+
+	// attached volume awaiting staging
+	device("pvc-unstaged", "sdb", "8:16")
+
+	mountInfoPath := filepath.Join(root, "mountinfo")
+	mustWriteFile(t, mountInfoPath, strings.Join([]string{
+		"22 1 252:1 / / rw shared:1 - ext4 /dev/vda1 rw",
+		"30 22 8:0 / " + staging + " rw shared:2 - ext4 /dev/sda rw",
+	}, "\n"))
+
+	freezer := &recordingFreezer{}
+	s := newFreezeServer(logrus.New().WithField("test_enabled", true), DefaultDriverName, "secret")
+	s.diskIDPath = idPath
+	s.mountInfoPath = mountInfoPath
+	s.kubeletDir = kubeletDir
+	s.sysPath = sysPath
+	s.freeze = freezer.record("freeze")
+	s.thaw = freezer.record("thaw")
+	return s, freezer, staging
+}
+
+func TestFreezeServer(t *testing.T) {
+	s, freezer, staging := newTestFreezeServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newFreezeClient("secret", uint(port))
+	ctx := context.Background()
+
+	if _, err := newFreezeClient("wrong", uint(port)).Freeze(ctx, u.Hostname(), "pvc-fs", time.Minute); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got error %v for a wrong token, want status 401", err)
+	}
+
+	frozen, err := client.Freeze(ctx, u.Hostname(), "pvc-fs", time.Minute)
+	if err != nil {
+		t.Fatalf("got error freezing: %s", err)
+	}
+	if !frozen {
+		t.Error("got filesystem not frozen, want frozen")
+	}
+
+	if _, err := client.Freeze(ctx, u.Hostname(), "pvc-fs", time.Minute); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got error %v freezing twice, want status 409", err)
+	}
+
+	for _, volumeName := range []string{"pvc-unstaged", "pvc-detached"} {
+		frozen, err := client.Freeze(ctx, u.Hostname(), volumeName, time.Minute)
+		if err != nil {
+			t.Fatalf("got error freezing %s: %s", volumeName, err)
+		}
+		if frozen {
+			t.Errorf("got filesystem of %s frozen, want not frozen", volumeName)
+		}
+	}
+
+	if _, err := client.Freeze(ctx, u.Hostname(), "pvc-fs", 5*time.Minute); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got error %v for a timeout above the maximum, want status 400", err)
+	}
+
+	thawed, err := client.Thaw(ctx, u.Hostname(), "pvc-fs")
+	if err != nil {
+		t.Fatalf("got error thawing: %s", err)
+	}
+	if !thawed {
+		t.Error("got filesystem not thawed, want thawed")
+	}
+
+	thawed, err = client.Thaw(ctx, u.Hostname(), "pvc-fs")
+	if err != nil {
+		t.Fatalf("got error thawing twice: %s", err)
+	}
+	if thawed {
+		t.Error("got filesystem thawed twice, want thawed once")
+	}
+
+	want := []string{"freeze " + staging, "thaw " + staging}
+	if got := freezer.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestFreezeServerTimeout(t *testing.T) {
+	s, freezer, staging := newTestFreezeServer(t)
+
+	if _, err := s.Freeze("pvc-fs", 10*time.Millisecond); err != nil {
+		t.Fatalf("got error freezing: %s", err)
+	}
+
+	want := []string{"freeze " + staging, "thaw " + staging}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(freezer.Calls(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got calls %v, want %v", freezer.Calls(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	resp, err := s.Thaw("pvc-fs")
+	if err != nil {
+		t.Fatalf("got error thawing: %s", err)
+	}
+	if resp.Thawed {
+		t.Error("got filesystem thawed after timeout, want thawed by the timeout only")
+	}
+
+	// a new freeze must not be thawed by the timer of the previous one
+	if _, err := s.Freeze("pvc-fs", time.Minute); err != nil {
+		t.Fatalf("got error freezing again: %s", err)
+	}
+	s.ThawAll()
+	want = append(want, "freeze "+staging, "thaw "+staging)
+	if got := freezer.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestFreezeServerRestart(t *testing.T) {
+	s, freezer, staging := newTestFreezeServer(t)
+	if _, err := s.Freeze("pvc-fs", time.Minute); err != nil {
+		t.Fatalf("got error freezing: %s", err)
+	}
+
+	// a new instance of the node plugin knows nothing about the frozen
+	// filesystem, but must thaw it on request
+	restarted := newFreezeServer(logrus.New().WithField("test_enabled", true), DefaultDriverName, "secret")
+	restarted.mountInfoPath = s.mountInfoPath
+	restarted.diskIDPath = s.diskIDPath
+	restarted.kubeletDir = s.kubeletDir
+	restarted.sysPath = s.sysPath
+	restarted.freeze = s.freeze
+	restarted.thaw = s.thaw
+
+	resp, err := restarted.Thaw("pvc-fs")
+	if err != nil {
+		t.Fatalf("got error thawing: %s", err)
+	}
+	if !resp.Thawed {
+		t.Error("got filesystem not thawed, want thawed")
+	}
+	resp, err = restarted.Thaw("pvc-fs")
+	if err != nil {
+		t.Fatalf("got error thawing twice: %s", err)
+	}
+	if resp.Thawed {
+		t.Error("got filesystem thawed twice, want thawed once")
+	}
+
+	// or on startup
+	if _, err := s.Freeze("pvc-fs", time.Minute); err == nil {
+		t.Fatal("got no error freezing a frozen filesystem")
+	}
+	s.ThawAll()
+	if _, err := s.Freeze("pvc-fs", time.Minute); err != nil {
+		t.Fatalf("got error freezing again: %s", err)
+	}
+	if err := restarted.ThawStale(); err != nil {
+		t.Fatalf("got error thawing stale filesystems: %s", err)
+	}
+	// thawing filesystems that are not frozen is harmless
+	if err := restarted.ThawStale(); err != nil {
+		t.Fatalf("got error thawing stale filesystems twice: %s", err)
+	}
+
+	want := []string{"freeze " + staging, "thaw " + staging, "freeze " + staging, "thaw " + staging}
+	if got := freezer.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestFreezeServerSlowFreeze(t *testing.T) {
+	s, _, _ := newTestFreezeServer(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	freeze := s.freeze
+	s.freeze = func(path string) error {
+		close(started)
+		<-release
+		return freeze(path)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Freeze("pvc-fs", time.Minute)
+		done <- err
+	}()
+	<-started
+
+	// other requests are not held up by the pending freeze
+	if _, err := s.Thaw("pvc-unstaged"); err != nil {
+		t.Errorf("got error thawing another volume: %s", err)
+	}
+	if _, err := s.Thaw("pvc-fs"); !errors.Is(err, errFreezeInProgress) {
+		t.Errorf("got error %v thawing while freezing, want %v", err, errFreezeInProgress)
+	}
+	if _, err := s.Freeze("pvc-fs", time.Minute); !errors.Is(err, errFreezeInProgress) {
+		t.Errorf("got error %v freezing while freezing, want %v", err, errFreezeInProgress)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("got error freezing: %s", err)
+	}
+	resp, err := s.Thaw("pvc-fs")
+	if err != nil {
+		t.Fatalf("got error thawing: %s", err)
+	}
+	if !resp.Thawed {
+		t.Error("got filesystem not thawed, want thawed")
+	}
+}
+
+// fakeFreezeClient records freeze and thaw requests along with the number of
+// snapshots existing at the time.
+type fakeFreezeClient struct {
+	storage   *fakeStorageDriver
+	frozen    bool
+	freezeErr error
+	calls     []string
+}
+
+func (f *fakeFreezeClient) Freeze(ctx context.Context, nodeAddr, volumeName string, timeout time.Duration) (bool, error) {
+	f.calls = append(f.calls, fmt.Sprintf("freeze %s %s %s snapshots=%d", nodeAddr, volumeName, timeout, len(f.storage.snapshots)))
+	return f.frozen, f.freezeErr
+}
+
+func (f *fakeFreezeClient) Thaw(ctx context.Context, nodeAddr, volumeName string) (bool, error) {
+	f.calls = append(f.calls, fmt.Sprintf("thaw %s %s snapshots=%d", nodeAddr, volumeName, len(f.storage.snapshots)))
+	return true, nil
+}
+
+func TestCreateSnapshotFreeze(t *testing.T) {
+	freezeParams := map[string]string{parameterFreeze: "true"}
+
+	tests := []struct {
+		name        string
+		params      map[string]string
+		dropletIDs  []int
+		noClient    bool
+		frozen      bool
+		freezeErr   error
+		wantCode    codes.Code
+		wantCalls   []string
+		wantCreated bool
+	}{
+		{
+			name:        "freezing not requested",
+			dropletIDs:  []int{1},
+			frozen:      true,
+			wantCreated: true,
+		},
+		{
+			name:        "filesystem frozen while snapshotting",
+			params:      freezeParams,
+			dropletIDs:  []int{1},
+			frozen:      true,
+			wantCalls:   []string{"freeze 10.0.0.1 pvc-db 30s snapshots=0", "thaw 10.0.0.1 pvc-db snapshots=1"},
+			wantCreated: true,
+		},
+		{
+			name:        "volume not staged as filesystem",
+			params:      freezeParams,
+			dropletIDs:  []int{1},
+			wantCalls:   []string{"freeze 10.0.0.1 pvc-db 30s snapshots=0"},
+			wantCreated: true,
+		},
+		{
+			name:        "volume not attached",
+			params:      freezeParams,
+			wantCreated: true,
+		},
+		{
+			name:       "freezing fails",
+			params:     freezeParams,
+			dropletIDs: []int{1},
+			freezeErr:  errors.New("connection refused"),
+			wantCode:   codes.Unavailable,
+			wantCalls:  []string{"freeze 10.0.0.1 pvc-db 30s snapshots=0"},
+		},
+		{
+			name:       "freezing disabled",
+			params:     freezeParams,
+			dropletIDs: []int{1},
+			noClient:   true,
+			wantCode:   codes.FailedPrecondition,
+		},
+		{
+			name:     "invalid parameter",
+			params:   map[string]string{parameterFreeze: "yes please"},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &fakeStorageDriver{
+				volumes: map[string]*godo.Volume{
+					"vol-1": {ID: "vol-1", Name: "pvc-db", DropletIDs: test.dropletIDs},
+				},
+				snapshots: map[string]*godo.Snapshot{},
+			}
+			droplets := &fakeDropletsDriver{
+				droplets: map[int]*godo.Droplet{
+					1: {
+						ID: 1,
+						Networks: &godo.Networks{
+							V4: []godo.NetworkV4{{IPAddress: "10.0.0.1", Type: "private"}},
+						},
+					},
+				},
+			}
+			client := &fakeFreezeClient{storage: storage, frozen: test.frozen, freezeErr: test.freezeErr}
+
+			d := &Driver{
+				storage:       storage,
+				droplets:      droplets,
+				freezeClient:  client,
+				freezeTimeout: 30 * time.Second,
+				log:           logrus.New().WithField("test_enabled", true),
+			}
+			if test.noClient {
+				d.freezeClient = nil
+			}
+
+			_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+				Name:           "snapshot-1",
+				SourceVolumeId: "vol-1",
+				Parameters:     test.params,
+			})
+			if code := status.Code(err); code != test.wantCode {
+				t.Fatalf("got code %s (error %v), want %s", code, err, test.wantCode)
+			}
+			if !reflect.DeepEqual(client.calls, test.wantCalls) {
+				t.Errorf("got freeze calls %v, want %v", client.calls, test.wantCalls)
+			}
+			if created := len(storage.snapshots) == 1; created != test.wantCreated {
+				t.Errorf("got snapshot created %t, want %t", created, test.wantCreated)
+			}
+		})
+	}
+}
+
+func TestPrivateIPv4(t *testing.T) {
+	tests := []struct {
+		name string
+		md   string
+		want string
+	}{
+		{
+			name: "public and private interfaces",
+			md:   `{"interfaces":{"public":[{"ipv4":{"ip_address":"203.0.113.10"}}],"private":[{"ipv4":{"ip_address":"10.110.0.2"}}]}}`,
+			want: "10.110.0.2",
+		},
+		{
+			name: "public interface only",
+			md:   `{"interfaces":{"public":[{"ipv4":{"ip_address":"203.0.113.10"}}]}}`,
+		},
+		{
+			name: "private interface without IPv4",
+			md:   `{"interfaces":{"private":[{"ipv6":{"ip_address":"fd00::2"}}]}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var md metadata.Metadata
+			if err := json.Unmarshal([]byte(test.md), &md); err != nil {
+				t.Fatal(err)
+			}
+			if got := privateIPv4(&md); got != test.want {
+				t.Errorf("got private IP %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// parameterFsckPolicy is the StorageClass parameter that defines the fsck
+// policy of a volume. It overrides the driver-wide default.
+const parameterFsckPolicy = DefaultDriverName + "/fsck-policy"
+
+// fsckPolicy defines whether and how filesystems are checked before they are
+// mounted.
+type fsckPolicy string
+
+const (
+	// fsckPolicyNever mounts filesystems without checking them.
+	fsckPolicyNever fsckPolicy = "never"
+
+	// fsckPolicyCheckOnly checks filesystems without modifying them and
+	// refuses to mount filesystems with errors.
+	// The journal of ext filesystems is replayed first, like mounting the
+	// filesystem would, unless the volume is staged read-only.
+	fsckPolicyCheckOnly fsckPolicy = "check-only"
+
+	// fsckPolicyAutoRepair repairs filesystem errors that can be fixed
+	// safely and refuses to mount filesystems with remaining errors.
+	fsckPolicyAutoRepair fsckPolicy = "auto-repair"
+)
+
+// e2fsck exit codes, see e2fsck(8). The codes are bit flags.
+const (
+	e2fsckErrorsCorrected       = 1
+	e2fsckErrorsCorrectedReboot = 2
+	e2fsckErrorsUncorrected     = 4
+	e2fsckCanceled              = 32
+)
+
+// xfs_repair exit codes, see xfs_repair(8).
+const (
+	xfsRepairCorruption = 1
+	xfsRepairDirtyLog   = 2
+)
+
+// parseFsckPolicy parses the given fsck policy.
+func parseFsckPolicy(policy string) (fsckPolicy, error) {
+	switch p := fsckPolicy(policy); p {
+	case fsckPolicyNever, fsckPolicyCheckOnly, fsckPolicyAutoRepair:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid fsck policy %q, must be one of %q, %q, or %q", policy, fsckPolicyNever, fsckPolicyCheckOnly, fsckPolicyAutoRepair)
+}
+
+// fsckResult holds the outcome of a filesystem check.
+type fsckResult struct {
+	ExitCode int
+	Output   string
+}
+
+// fsckCommand returns the command and arguments to check the given filesystem
+// type, repairing errors if requested. It returns false if checking the
+// filesystem type is not supported.
+func fsckCommand(fsType string, repair bool) (string, []string, bool) {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		if repair {
+			// preen mode only fixes problems that are safe to fix
+			// without human intervention
+			return "e2fsck", []string{"-p"}, true
+		}
+		return "e2fsck", []string{"-n"}, true
+	case "xfs":
+		if repair {
+			return "xfs_repair", nil, true
+		}
+		return "xfs_repair", []string{"-n"}, true
+	}
+	return "", nil, false
+}
+
+// volumeFsckPolicy returns the fsck policy for the volume with the given
+// volume context.
+func (d *Driver) volumeFsckPolicy(volCtx map[string]string) (fsckPolicy, error) {
+	policy, ok := volCtx[parameterFsckPolicy]
+	if !ok {
+		return d.defaultFsckPolicy, nil
+	}
+	return parseFsckPolicy(policy)
+}
+
+// checkFilesystem checks the filesystem on the given source device according
+// to the policy. It returns a gRPC error if the filesystem must not be
+// mounted. The journal of read-only volumes is never replayed.
+func (d *Driver) checkFilesystem(volumeID, source, fsType string, policy fsckPolicy, readOnly bool, log *logrus.Entry) error {
+	if policy == fsckPolicyNever || policy == "" {
+		return nil
+	}
+
+	repair := policy == fsckPolicyAutoRepair
+	if _, _, ok := fsckCommand(fsType, repair); !ok {
+		log.WithField("fsck_policy", policy).Info("checking the filesystem type is not supported, skipping filesystem check")
+		return nil
+	}
+
+	log = log.WithField("fsck_policy", policy)
+
+	// e2fsck -n skips the recovery of the journal, e.g., after a node crash,
+	// and would report the metadata the journal fixes as errors. Preen mode
+	// replays the journal itself.
+	if !repair && !readOnly && fsType != "xfs" {
+		log.Info("replaying the filesystem journal before checking the filesystem")
+		if err := d.mounter.ReplayJournal(source); err != nil {
+			return status.Errorf(codes.Internal, "failed to replay the journal of volume %q: %v", volumeID, err)
+		}
+	}
+
+	log.Info("checking the filesystem")
+	res, err := d.mounter.Fsck(source, fsType, repair)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check filesystem of volume %q: %v", volumeID, err)
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"fsck_exit_code": res.ExitCode,
+		"fsck_output":    res.Output,
+	})
+	return fsckResultError(volumeID, fsType, repair, res, log)
+}
+
+// fsckResultError maps the outcome of a filesystem check to a gRPC error. It
+// returns nil if the filesystem can be mounted.
+func fsckResultError(volumeID, fsType string, repair bool, res *fsckResult, log *logrus.Entry) error {
+	if res.ExitCode == 0 {
+		log.Info("filesystem is clean")
+		return nil
+	}
+
+	if fsType == "xfs" {
+		switch res.ExitCode {
+		case xfsRepairDirtyLog:
+			// the log is replayed when the filesystem is mounted
+			log.Warn("filesystem log needs to be replayed, leaving it to the mount")
+			return nil
+		case xfsRepairCorruption:
+			log.Error("filesystem is corrupted")
+			if repair {
+				return status.Errorf(codes.FailedPrecondition, "filesystem of volume %q is corrupted and could not be repaired", volumeID)
+			}
+			return status.Errorf(codes.FailedPrecondition, "filesystem of volume %q is corrupted", volumeID)
+		}
+		log.Error("filesystem check failed")
+		return status.Errorf(codes.Internal, "filesystem check of volume %q failed with exit code %d", volumeID, res.ExitCode)
+	}
+
+	switch {
+	case res.ExitCode&e2fsckCanceled != 0:
+		log.Error("filesystem check was canceled")
+		return status.Errorf(codes.Aborted, "filesystem check of volume %q was canceled", volumeID)
+	case res.ExitCode&e2fsckErrorsUncorrected != 0:
+		log.Error("filesystem has uncorrected errors")
+		return status.Errorf(codes.FailedPrecondition, "filesystem of volume %q has uncorrected errors", volumeID)
+	case res.ExitCode&^(e2fsckErrorsCorrected|e2fsckErrorsCorrectedReboot) == 0:
+		log.Warn("filesystem errors were corrected")
+		return nil
+	}
+
+	log.Error("filesystem check failed")
+	return status.Errorf(codes.Internal, "filesystem check of volume %q failed with exit code %d", volumeID, res.ExitCode)
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseFsckPolicy(t *testing.T) {
+	for _, policy := range []string{"never", "check-only", "auto-repair"} {
+		if _, err := parseFsckPolicy(policy); err != nil {
+			t.Errorf("got error for policy %q: %s", policy, err)
+		}
+	}
+
+	for _, policy := range []string{"", "always", "Never"} {
+		if _, err := parseFsckPolicy(policy); err == nil {
+			t.Errorf("got no error for invalid policy %q", policy)
+		}
+	}
+}
+
+func TestFsckResultError(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsType   string
+		repair   bool
+		exitCode int
+		output   string
+		wantCode codes.Code
+	}{
+		{
+			name:     "clean ext4",
+			fsType:   "ext4",
+			exitCode: 0,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "ext4 errors corrected",
+			fsType:   "ext4",
+			repair:   true,
+			exitCode: e2fsckErrorsCorrected,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "ext4 errors corrected, reboot required",
+			fsType:   "ext4",
+			repair:   true,
+			exitCode: e2fsckErrorsCorrected | e2fsckErrorsCorrectedReboot,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "ext4 errors uncorrected",
+			fsType:   "ext4",
+			exitCode: e2fsckErrorsUncorrected,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "ext4 errors partially corrected",
+			fsType:   "ext4",
+			repair:   true,
+			exitCode: e2fsckErrorsCorrected | e2fsckErrorsUncorrected,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "ext4 operational error",
+			fsType:   "ext4",
+			exitCode: 8,
+			wantCode: codes.Internal,
+		},
+		{
+			name:     "ext4 check canceled",
+			fsType:   "ext4",
+			exitCode: e2fsckCanceled,
+			wantCode: codes.Aborted,
+		},
+		{
+			name:     "ext4 dirty journal with errors",
+			fsType:   "ext4",
+			exitCode: e2fsckErrorsUncorrected,
+			output:   "Warning: skipping journal recovery because doing a read-only filesystem check.\n",
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "clean xfs",
+			fsType:   "xfs",
+			exitCode: 0,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "xfs corrupted",
+			fsType:   "xfs",
+			exitCode: xfsRepairCorruption,
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "xfs dirty log",
+			fsType:   "xfs",
+			repair:   true,
+			exitCode: xfsRepairDirtyLog,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "xfs unknown exit code",
+			fsType:   "xfs",
+			exitCode: 4,
+			wantCode: codes.Internal,
+		},
+	}
+
+	log := logrus.New().WithField("test_enabled", true)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := fsckResultError("vol-id", test.fsType, test.repair, &fsckResult{ExitCode: test.exitCode, Output: test.output}, log)
+			if code := status.Code(err); code != test.wantCode {
+				t.Errorf("got code %s, want %s (error: %v)", code, test.wantCode, err)
+			}
+		})
+	}
+}
+
+// journalMounter records the journal replays and filesystem checks.
+type journalMounter struct {
+	*fakeMounter
+	calls []string
+	res   fsckResult
+}
+
+func (m *journalMounter) ReplayJournal(source string) error {
+	m.calls = append(m.calls, "replay "+source)
+	return nil
+}
+
+func (m *journalMounter) Fsck(source, fsType string, repair bool) (*fsckResult, error) {
+	m.calls = append(m.calls, fmt.Sprintf("fsck repair=%t %s", repair, source))
+	res := m.res
+	return &res, nil
+}
+
+func TestCheckFilesystemJournal(t *testing.T) {
+	tests := []struct {
+		name      string
+		fsType    string
+		policy    fsckPolicy
+		readOnly  bool
+		exitCode  int
+		wantCalls []string
+		wantCode  codes.Code
+	}{
+		{
+			name:      "check-only replays the journal first",
+			fsType:    "ext4",
+			policy:    fsckPolicyCheckOnly,
+			wantCalls: []string{"replay /dev/sda", "fsck repair=false /dev/sda"},
+		},
+		{
+			name:      "check-only reports errors after replaying the journal",
+			fsType:    "ext4",
+			policy:    fsckPolicyCheckOnly,
+			exitCode:  e2fsckErrorsUncorrected,
+			wantCalls: []string{"replay /dev/sda", "fsck repair=false /dev/sda"},
+			wantCode:  codes.FailedPrecondition,
+		},
+		{
+			name:      "read-only volumes keep their journal",
+			fsType:    "ext4",
+			policy:    fsckPolicyCheckOnly,
+			readOnly:  true,
+			wantCalls: []string{"fsck repair=false /dev/sda"},
+		},
+		{
+			name:      "auto-repair replays the journal itself",
+			fsType:    "ext4",
+			policy:    fsckPolicyAutoRepair,
+			wantCalls: []string{"fsck repair=true /dev/sda"},
+		},
+		{
+			name:      "xfs log is left to the mount",
+			fsType:    "xfs",
+			policy:    fsckPolicyCheckOnly,
+			wantCalls: []string{"fsck repair=false /dev/sda"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &journalMounter{res: fsckResult{ExitCode: test.exitCode}}
+			d := &Driver{mounter: m}
+
+			err := d.checkFilesystem("vol-id", "/dev/sda", test.fsType, test.policy, test.readOnly, logrus.New().WithField("test_enabled", true))
+			if code := status.Code(err); code != test.wantCode {
+				t.Errorf("got code %s, want %s (error: %v)", code, test.wantCode, err)
+			}
+			if !reflect.DeepEqual(m.calls, test.wantCalls) {
+				t.Errorf("got calls %q, want %q", m.calls, test.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+)
+
+func TestGetPluginCapabilitiesVolumeExpansion(t *testing.T) {
+	d := &Driver{
+		log: logrus.New().WithField("test_enabled", true),
+	}
+
+	resp, err := d.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	got := map[csi.PluginCapability_VolumeExpansion_Type]bool{}
+	for _, c := range resp.GetCapabilities() {
+		if exp := c.GetVolumeExpansion(); exp != nil {
+			got[exp.GetType()] = true
+		}
+	}
+
+	for _, want := range []csi.PluginCapability_VolumeExpansion_Type{
+		csi.PluginCapability_VolumeExpansion_ONLINE,
+		csi.PluginCapability_VolumeExpansion_OFFLINE,
+	} {
+		if !got[want] {
+			t.Errorf("got no %s volume expansion capability, want it advertised", want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sectorSize is the unit of the sector counters in block device stat files,
+// regardless of the device's actual sector size.
+const sectorSize = 512
+
+// blockIOStats holds the counters of a block device stat file. See the
+// kernel's Documentation/block/stat.rst for details.
+type blockIOStats struct {
+	ReadOps      uint64
+	ReadSectors  uint64
+	ReadTicks    uint64
+	WriteOps     uint64
+	WriteSectors uint64
+	WriteTicks   uint64
+	InFlight     uint64
+	IOTicks      uint64
+	// TimeInQueue is the weighted number of milliseconds spent doing I/O,
+	// i.e., the time requests spent in the queue and being serviced.
+	TimeInQueue uint64
+}
+
+// readBlockIOStats reads the block device stat file at the given path.
+func readBlockIOStats(path string) (blockIOStats, error) {
+	var stats blockIOStats
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return stats, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) < 11 {
+		return stats, fmt.Errorf("malformed block device stats in %s: got %d fields, want at least 11", path, len(fields))
+	}
+
+	values := make([]uint64, 11)
+	for i := range values {
+		values[i], err = strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return stats, fmt.Errorf("malformed block device stats in %s: field %d: %s", path, i+1, err)
+		}
+	}
+
+	// the read and write merge counters (fields 2 and 6) are of no interest
+	return blockIOStats{
+		ReadOps:      values[0],
+		ReadSectors:  values[2],
+		ReadTicks:    values[3],
+		WriteOps:     values[4],
+		WriteSectors: values[6],
+		WriteTicks:   values[7],
+		InFlight:     values[8],
+		IOTicks:      values[9],
+		TimeInQueue:  values[10],
+	}, nil
+}
+
+// volumeIOStats holds the I/O counters of a volume.
+type volumeIOStats struct {
+	volumeID string
+	device   string
+	stats    blockIOStats
+}
+
+// ioStatsCollector exposes the I/O counters of the volumes staged or published
+// as block devices by this driver as Prometheus metrics.
+type ioStatsCollector struct {
+	log        *logrus.Entry
+	driverName string
+
+	mountInfoPath string
+	kubeletDir    string
+	sysPath       string
+}
+
+// newIOStatsCollector returns a new ioStatsCollector operating on the host's
+// kubelet directory.
+func newIOStatsCollector(log *logrus.Entry, driverName string) *ioStatsCollector {
+	return &ioStatsCollector{
+		log:           log.WithField("component", "io_stats_collector"),
+		driverName:    driverName,
+		mountInfoPath: procMountInfoPath,
+		kubeletDir:    defaultKubeletDir,
+		sysPath:       "/sys",
+	}
+}
+
+// Collect returns the I/O counters of all volumes of this driver mounted on
+// the node, ordered by volume ID. Volumes whose counters cannot be read are
+// logged and left out.
+func (c *ioStatsCollector) Collect() ([]volumeIOStats, error) {
+	infos, err := readMountInfo(c.mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %s", err)
+	}
+
+	csiPluginDir := filepath.Join(c.kubeletDir, "plugins", "kubernetes.io", "csi")
+	blockPublishDir := filepath.Join(csiPluginDir, "volumeDevices", "publish")
+
+	seen := map[string]bool{}
+	var volumes []volumeIOStats
+	for _, m := range ownedMounts(c.kubeletDir, c.driverName, infos) {
+		var volDataPath, devDir string
+		switch {
+		case m.kind == mountKindStaging:
+			volDataPath = filepath.Join(filepath.Dir(m.info.MountPoint), volDataFileName)
+			devDir = filepath.Join(c.sysPath, "dev", "block", fmt.Sprintf("%d:%d", m.info.Major, m.info.Minor))
+		case strings.HasPrefix(m.info.MountPoint, blockPublishDir+"/"):
+			// block volumes are bind mounted from devtmpfs, with the device
+			// as the root of the mount
+			pvName := filepath.Base(filepath.Dir(m.info.MountPoint))
+			volDataPath = filepath.Join(csiPluginDir, "volumeDevices", pvName, "data", volDataFileName)
+			devDir = filepath.Join(c.sysPath, "class", "block", filepath.Base(m.info.Root))
+		default:
+			// filesystem publish mounts are bind mounts of staging mounts
+			continue
+		}
+
+		log := c.log.WithField("path", m.info.MountPoint)
+		data, err := readVolData(volDataPath)
+		if err != nil || data.VolumeHandle == "" {
+			log.WithError(err).Debug("failed to determine the volume ID of the mount")
+			continue
+		}
+		if seen[data.VolumeHandle] {
+			continue
+		}
+
+		device, stats, err := c.deviceIOStats(devDir)
+		if err != nil {
+			log.WithError(err).WithField("volume_id", data.VolumeHandle).Warn("failed to read I/O stats of the volume")
+			continue
+		}
+		seen[data.VolumeHandle] = true
+		volumes = append(volumes, volumeIOStats{
+			volumeID: data.VolumeHandle,
+			device:   device,
+			stats:    stats,
+		})
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].volumeID < volumes[j].volumeID
+	})
+	return volumes, nil
+}
+
+// deviceIOStats returns the name and the I/O counters of the block device with
+// the given sysfs directory. The counters of a device mapper device with a
+// single underlying device, such as the LUKS device of an encrypted volume,
+// are taken from the underlying device, as that is the one subject to the
+// volume's limits.
+func (c *ioStatsCollector) deviceIOStats(devDir string) (string, blockIOStats, error) {
+	dir, err := filepath.EvalSymlinks(devDir)
+	if err != nil {
+		return "", blockIOStats{}, err
+	}
+
+	slaves, err := os.ReadDir(filepath.Join(dir, "slaves"))
+	if err == nil && len(slaves) == 1 {
+		dir = filepath.Join(c.sysPath, "class", "block", slaves[0].Name())
+	}
+
+	stats, err := readBlockIOStats(filepath.Join(dir, "stat"))
+	if err != nil {
+		return "", blockIOStats{}, err
+	}
+	return filepath.Base(dir), stats, nil
+}
+
+// ioStatsMetric describes a metric derived from block device stats.
+type ioStatsMetric struct {
+	name  string
+	help  string
+	typ   string
+	value func(s blockIOStats) float64
+}
+
+var ioStatsMetrics = []ioStatsMetric{
+	{
+		name:  "dobs_volume_read_ops_total",
+		help:  "Number of read operations completed on the volume.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.ReadOps) },
+	},
+	{
+		name:  "dobs_volume_write_ops_total",
+		help:  "Number of write operations completed on the volume.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.WriteOps) },
+	},
+	{
+		name:  "dobs_volume_read_bytes_total",
+		help:  "Number of bytes read from the volume.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.ReadSectors * sectorSize) },
+	},
+	{
+		name:  "dobs_volume_written_bytes_total",
+		help:  "Number of bytes written to the volume.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.WriteSectors * sectorSize) },
+	},
+	{
+		name:  "dobs_volume_read_time_seconds_total",
+		help:  "Total time spent on read operations on the volume.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.ReadTicks) / 1000 },
+	},
+	{
+		name:  "dobs_volume_write_time_seconds_total",
+		help:  "Total time spent on write operations on the volume.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.WriteTicks) / 1000 },
+	},
+	{
+		name:  "dobs_volume_io_time_seconds_total",
+		help:  "Total time the volume had operations in flight.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.IOTicks) / 1000 },
+	},
+	{
+		name:  "dobs_volume_io_queue_time_seconds_total",
+		help:  "Total time operations on the volume spent queued and in flight, weighted by the number of operations.",
+		typ:   "counter",
+		value: func(s blockIOStats) float64 { return float64(s.TimeInQueue) / 1000 },
+	},
+	{
+		name:  "dobs_volume_io_in_flight",
+		help:  "Number of operations in flight on the volume.",
+		typ:   "gauge",
+		value: func(s blockIOStats) float64 { return float64(s.InFlight) },
+	},
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeIOStatsMetrics writes the given volume I/O counters in the Prometheus
+// text exposition format.
+func writeIOStatsMetrics(buf *bytes.Buffer, volumes []volumeIOStats) {
+	for _, m := range ioStatsMetrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.typ)
+		for _, v := range volumes {
+			fmt.Fprintf(buf, "%s{volume_id=\"%s\",device=\"%s\"} %s\n",
+				m.name,
+				labelValueEscaper.Replace(v.volumeID),
+				labelValueEscaper.Replace(v.device),
+				strconv.FormatFloat(m.value(v.stats), 'g', -1, 64))
+		}
+	}
+}
+
+// ServeHTTP serves the I/O counters of the volumes on the node as Prometheus
+// metrics.
+func (c *ioStatsCollector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	volumes, err := c.Collect()
+	if err != nil {
+		c.log.WithError(err).Error("failed to collect volume I/O stats")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	writeIOStatsMetrics(&buf, volumes)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		c.log.WithError(err).Error("failed to write volume I/O stats")
+	}
+}
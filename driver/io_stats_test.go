@@ -0,0 +1,203 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadBlockIOStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stat")
+
+	tests := []struct {
+		name    string
+		stat    string
+		want    blockIOStats
+		wantErr bool
+	}{
+		{
+			name: "with discard and flush fields",
+			stat: "    1520      12   98304     830     4210     300  1048576    9120        2     5400    10120      10       0     2048       4       30      12\n",
+			want: blockIOStats{
+				ReadOps:      1520,
+				ReadSectors:  98304,
+				ReadTicks:    830,
+				WriteOps:     4210,
+				WriteSectors: 1048576,
+				WriteTicks:   9120,
+				InFlight:     2,
+				IOTicks:      5400,
+				TimeInQueue:  10120,
+			},
+		},
+		{
+			name:    "too few fields",
+			stat:    "1520 12 98304 830\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed field",
+			stat:    "1520 12 98304 830 4210 300 1048576 9120 x 5400 10120\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mustWriteFile(t, path, test.stat)
+			got, err := readBlockIOStats(path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got stats %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIOStatsCollector(t *testing.T) {
+	root := t.TempDir()
+	kubeletDir := filepath.Join(root, "kubelet")
+	sysPath := filepath.Join(root, "sys")
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+
+	volData := func(t *testing.T, dir, driverName, volumeID string) {
+		mustMkdirAll(t, dir)
+		mustWriteFile(t, filepath.Join(dir, volDataFileName), fmt.Sprintf(`{"driverName":%q,"volumeHandle":%q}`, driverName, volumeID))
+	}
+	device := func(t *testing.T, name, majorMinor, stat string, slaves ...string) {
+		devDir := filepath.Join(sysPath, "devices", "virtual", "block", name)
+		mustMkdirAll(t, filepath.Join(devDir, "slaves"))
+		mustWriteFile(t, filepath.Join(devDir, "stat"), stat)
+		for _, slave := range slaves {
+			mustWriteFile(t, filepath.Join(devDir, "slaves", slave), "")
+		}
+		for _, link := range []string{
+			filepath.Join(sysPath, "class", "block", name),
+			filepath.Join(sysPath, "dev", "block", majorMinor),
+		} {
+			mustMkdirAll(t, filepath.Dir(link))
+			if err := os.Symlink(devDir, link); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// filesystem volume on sda
+	fsStaging := filepath.Join(csiDir, DefaultDriverName, "aaa", "globalmount")
+	volData(t, filepath.Dir(fsStaging), DefaultDriverName, "vol-fs")
+	fsPublish := filepath.Join(kubeletDir, "pods", "pod1", "volumes", "kubernetes.io~csi", "pvc-1", "mount")
+	volData(t, filepath.Dir(fsPublish), DefaultDriverName, "vol-fs")
+	device(t, "sda", "8:0", "10 0 16 20 30 0 64 40 1 50 60\n")
+
+	// encrypted volume on sdb, mounted through dm-0
+	encryptedStaging := filepath.Join(csiDir, DefaultDriverName, "bbb", "globalmount")
+	volData(t, filepath.Dir(encryptedStaging), DefaultDriverName, "vol-encrypted")
+	device(t, "sdb", "8:16", "1 0 2 3 4 0 8 5 0 6 7\n")
+	device(t, "dm-0", "252:0", "100 0 200 300 400 0 800 500 0 600 700\n", "sdb")
+
+	// block volume on sdc
+	blockPublish := filepath.Join(csiDir, "volumeDevices", "publish", "pvc-3", "pod3")
+	volData(t, filepath.Join(csiDir, "volumeDevices", "pvc-3", "data"), DefaultDriverName, "vol-block")
+	device(t, "sdc", "8:32", "5 0 10 15 20 0 40 25 0 30 35\n")
+
+	// volume of another driver on sdd
+	foreignStaging := filepath.Join(csiDir, "other.csi.example.com", "ddd", "globalmount")
+	volData(t, filepath.Dir(foreignStaging), "other.csi.example.com", "vol-foreign")
+	device(t, "sdd", "8:48", "1 0 1 1 1 0 1 1 0 1 1\n")
+
+	// volume whose device vanished on 8:64
+	vanishedStaging := filepath.Join(csiDir, DefaultDriverName, "eee", "globalmount")
+	volData(t, filepath.Dir(vanishedStaging), DefaultDriverName, "vol-vanished")
+
+	mountInfo := strings.Join([]string{
+		"22 1 252:1 / / rw shared:1 - ext4 /dev/vda1 rw",
+		"30 22 8:0 / " + fsStaging + " rw shared:2 - ext4 /dev/sda rw",
+		"31 22 8:0 / " + fsPublish + " rw shared:2 - ext4 /dev/sda rw",
+		"32 22 252:0 / " + encryptedStaging + " rw shared:3 - ext4 /dev/mapper/luks-vol-encrypted rw",
+		"33 22 0:5 /sdc " + blockPublish + " rw shared:4 - devtmpfs udev rw",
+		"34 22 8:48 / " + foreignStaging + " rw shared:5 - ext4 /dev/sdd rw",
+		"35 22 8:64 / " + vanishedStaging + " rw shared:6 - ext4 /dev/sde rw",
+	}, "\n")
+	mountInfoPath := filepath.Join(root, "mountinfo")
+	mustWriteFile(t, mountInfoPath, mountInfo)
+
+	c := newIOStatsCollector(logrus.New().WithField("test_enabled", true), DefaultDriverName)
+	c.mountInfoPath = mountInfoPath
+	c.kubeletDir = kubeletDir
+	c.sysPath = sysPath
+
+	volumes, err := c.Collect()
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	want := []volumeIOStats{
+		{
+			volumeID: "vol-block",
+			device:   "sdc",
+			stats:    blockIOStats{ReadOps: 5, ReadSectors: 10, ReadTicks: 15, WriteOps: 20, WriteSectors: 40, WriteTicks: 25, IOTicks: 30, TimeInQueue: 35},
+		},
+		{
+			volumeID: "vol-encrypted",
+			device:   "sdb",
+			stats:    blockIOStats{ReadOps: 1, ReadSectors: 2, ReadTicks: 3, WriteOps: 4, WriteSectors: 8, WriteTicks: 5, IOTicks: 6, TimeInQueue: 7},
+		},
+		{
+			volumeID: "vol-fs",
+			device:   "sda",
+			stats:    blockIOStats{ReadOps: 10, ReadSectors: 16, ReadTicks: 20, WriteOps: 30, WriteSectors: 64, WriteTicks: 40, InFlight: 1, IOTicks: 50, TimeInQueue: 60},
+		},
+	}
+	if !reflect.DeepEqual(volumes, want) {
+		t.Errorf("got volumes\n%+v\nwant\n%+v", volumes, want)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE dobs_volume_read_ops_total counter",
+		`dobs_volume_read_ops_total{volume_id="vol-fs",device="sda"} 10`,
+		`dobs_volume_written_bytes_total{volume_id="vol-fs",device="sda"} 32768`,
+		`dobs_volume_io_queue_time_seconds_total{volume_id="vol-fs",device="sda"} 0.06`,
+		"# TYPE dobs_volume_io_in_flight gauge",
+		`dobs_volume_io_in_flight{volume_id="vol-fs",device="sda"} 1`,
+		`dobs_volume_read_bytes_total{volume_id="vol-block",device="sdc"} 5120`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("got metrics without line %q:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "vol-foreign") || strings.Contains(body, "vol-vanished") {
+		t.Errorf("got metrics of foreign or vanished volumes:\n%s", body)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mapperDir is the directory device mapper devices are exposed in.
+	mapperDir = "/dev/mapper"
+
+	// luksMapperPrefix prefixes the device mapper names of opened LUKS
+	// volumes.
+	luksMapperPrefix = "dobs-"
+
+	// cryptsetupExitStatusNotLuks is the exit code returned from `cryptsetup
+	// isLuks` if the device is not a LUKS device.
+	cryptsetupExitStatusNotLuks = 1
+)
+
+// Encryptor is responsible for setting up LUKS encryption on volumes.
+type Encryptor interface {
+	// IsLuks checks whether the source device is LUKS formatted.
+	IsLuks(source string) (bool, error)
+
+	// LuksFormat formats the source device with LUKS, protected by the given
+	// key.
+	LuksFormat(source, key string) error
+
+	// LuksOpen opens the LUKS formatted source device under the given device
+	// mapper name using the given key, read-only if requested. It is a no-op
+	// if the device mapper exists already.
+	LuksOpen(source, mapperName, key string, readOnly bool) error
+
+	// LuksClose closes the device mapper with the given name. It is a no-op
+	// if the device mapper does not exist.
+	LuksClose(mapperName string) error
+
+	// LuksResize grows the device mapper with the given name to the size of
+	// its backing device.
+	LuksResize(mapperName, key string) error
+
+	// IsLuksOpen checks whether a device mapper with the given name exists.
+	IsLuksOpen(mapperName string) (bool, error)
+}
+
+type luksEncryptor struct {
+	log *logrus.Entry
+}
+
+// newLuksEncryptor returns a new Encryptor backed by cryptsetup.
+func newLuksEncryptor(log *logrus.Entry) *luksEncryptor {
+	return &luksEncryptor{
+		log: log,
+	}
+}
+
+// luksMapperName returns the device mapper name for the given volume.
+func luksMapperName(volumeID string) string {
+	return luksMapperPrefix + volumeID
+}
+
+// luksMapperPath returns the device path of the given device mapper name.
+func luksMapperPath(mapperName string) string {
+	return filepath.Join(mapperDir, mapperName)
+}
+
+func (e *luksEncryptor) IsLuks(source string) (bool, error) {
+	if source == "" {
+		return false, errors.New("source is not specified")
+	}
+
+	err := e.cryptsetup("", "isLuks", source)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == cryptsetupExitStatusNotLuks {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (e *luksEncryptor) LuksFormat(source, key string) error {
+	if source == "" {
+		return errors.New("source is not specified for LUKS formatting the volume")
+	}
+
+	if key == "" {
+		return errors.New("key is not specified for LUKS formatting the volume")
+	}
+
+	return e.cryptsetup(key, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", source)
+}
+
+func (e *luksEncryptor) LuksOpen(source, mapperName, key string, readOnly bool) error {
+	open, err := e.IsLuksOpen(mapperName)
+	if err != nil {
+		return err
+	}
+
+	if open {
+		e.log.WithField("mapper_name", mapperName).Info("LUKS device is already open")
+		return nil
+	}
+
+	args := []string{"luksOpen", "--key-file", "-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	return e.cryptsetup(key, append(args, source, mapperName)...)
+}
+
+func (e *luksEncryptor) LuksClose(mapperName string) error {
+	open, err := e.IsLuksOpen(mapperName)
+	if err != nil {
+		return err
+	}
+
+	if !open {
+		return nil
+	}
+
+	return e.cryptsetup("", "luksClose", mapperName)
+}
+
+func (e *luksEncryptor) LuksResize(mapperName, key string) error {
+	// LUKS2 devices keep the volume key in the kernel keyring, in which case
+	// no key is needed
+	if key == "" {
+		return e.cryptsetup("", "resize", mapperName)
+	}
+
+	return e.cryptsetup(key, "resize", "--key-file", "-", mapperName)
+}
+
+func (e *luksEncryptor) IsLuksOpen(mapperName string) (bool, error) {
+	_, err := os.Stat(luksMapperPath(mapperName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// cryptsetup runs cryptsetup with the given arguments. The key, if given, is
+// passed through stdin so that it never shows up in the process list or logs.
+func (e *luksEncryptor) cryptsetup(key string, args ...string) error {
+	cryptsetupCmd := "cryptsetup"
+	_, err := exec.LookPath(cryptsetupCmd)
+	if err != nil {
+		if err == exec.ErrNotFound {
+			return fmt.Errorf("%q executable not found in $PATH", cryptsetupCmd)
+		}
+		return err
+	}
+
+	e.log.WithFields(logrus.Fields{
+		"cmd":  cryptsetupCmd,
+		"args": args,
+	}).Info("executing cryptsetup command")
+
+	cmd := exec.Command(cryptsetupCmd, args...)
+	if key != "" {
+		cmd.Stdin = strings.NewReader(key)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup failed: %w cmd: '%s %s' output: %q",
+			err, cryptsetupCmd, strings.Join(args, " "), string(out))
+	}
+
+	return nil
+}
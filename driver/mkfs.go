@@ -0,0 +1,173 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// parameterMkfsInodeRatio is the StorageClass parameter that defines the
+	// bytes-per-inode ratio of ext filesystems.
+	parameterMkfsInodeRatio = DefaultDriverName + "/mkfs-inode-ratio"
+
+	// parameterMkfsBlockSize is the StorageClass parameter that defines the
+	// filesystem block size in bytes.
+	parameterMkfsBlockSize = DefaultDriverName + "/mkfs-block-size"
+
+	// parameterMkfsReservedBlocksPercentage is the StorageClass parameter
+	// that defines the percentage of ext filesystem blocks reserved for the
+	// super-user.
+	parameterMkfsReservedBlocksPercentage = DefaultDriverName + "/mkfs-reserved-blocks-percentage"
+
+	// parameterMkfsLazyInit is the StorageClass parameter that defines
+	// whether ext inode tables and journals are initialized lazily after
+	// mounting.
+	parameterMkfsLazyInit = DefaultDriverName + "/mkfs-lazy-init"
+
+	// parameterMkfsReflink is the StorageClass parameter that defines whether
+	// reflinks are enabled on xfs filesystems.
+	parameterMkfsReflink = DefaultDriverName + "/mkfs-reflink"
+)
+
+// mkfsOption converts the value of a mkfs parameter to mkfs arguments.
+type mkfsOption func(val string) ([]string, error)
+
+var (
+	// mkfsParameters lists the StorageClass parameters that configure mkfs,
+	// in the order their arguments are passed.
+	mkfsParameters = []string{
+		parameterMkfsBlockSize,
+		parameterMkfsInodeRatio,
+		parameterMkfsReservedBlocksPercentage,
+		parameterMkfsLazyInit,
+		parameterMkfsReflink,
+	}
+
+	extMkfsOptions = map[string]mkfsOption{
+		parameterMkfsBlockSize: func(val string) ([]string, error) {
+			if err := validateBlockSize(val); err != nil {
+				return nil, err
+			}
+			return []string{"-b", val}, nil
+		},
+		parameterMkfsInodeRatio: func(val string) ([]string, error) {
+			ratio, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, errors.New("must be an integer")
+			}
+			if ratio < 1024 || ratio > 67108864 {
+				return nil, errors.New("must be between 1024 and 67108864")
+			}
+			return []string{"-i", val}, nil
+		},
+		parameterMkfsReservedBlocksPercentage: func(val string) ([]string, error) {
+			pct, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, errors.New("must be a number")
+			}
+			if pct < 0 || pct > 50 {
+				return nil, errors.New("must be between 0 and 50")
+			}
+			return []string{"-m", val}, nil
+		},
+		parameterMkfsLazyInit: func(val string) ([]string, error) {
+			lazy, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, errors.New("must be a boolean")
+			}
+			n := boolToInt(lazy)
+			return []string{"-E", fmt.Sprintf("lazy_itable_init=%d,lazy_journal_init=%d", n, n)}, nil
+		},
+	}
+
+	xfsMkfsOptions = map[string]mkfsOption{
+		parameterMkfsBlockSize: func(val string) ([]string, error) {
+			if err := validateBlockSize(val); err != nil {
+				return nil, err
+			}
+			return []string{"-b", "size=" + val}, nil
+		},
+		parameterMkfsReflink: func(val string) ([]string, error) {
+			reflink, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, errors.New("must be a boolean")
+			}
+			return []string{"-m", fmt.Sprintf("reflink=%d", boolToInt(reflink))}, nil
+		},
+	}
+
+	// mkfsOptions is the allowlist of mkfs parameters per filesystem type.
+	mkfsOptions = map[string]map[string]mkfsOption{
+		"ext3": extMkfsOptions,
+		"ext4": extMkfsOptions,
+		"xfs":  xfsMkfsOptions,
+	}
+)
+
+// mkfsArgs returns the mkfs arguments for the given filesystem type as
+// configured through the given parameters. It fails if a parameter is not
+// supported for the filesystem type or has an invalid value.
+func mkfsArgs(fsType string, params map[string]string) ([]string, error) {
+	var args []string
+	for _, key := range mkfsParameters {
+		val, ok := params[key]
+		if !ok {
+			continue
+		}
+
+		opt, ok := mkfsOptions[fsType][key]
+		if !ok {
+			return nil, fmt.Errorf("parameter %q is not supported for filesystem type %q", key, fsType)
+		}
+
+		optArgs, err := opt(val)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q has invalid value %q: %s", key, val, err)
+		}
+		args = append(args, optArgs...)
+	}
+
+	return args, nil
+}
+
+// hasMkfsParameters checks whether any mkfs parameter is set.
+func hasMkfsParameters(params map[string]string) bool {
+	for _, key := range mkfsParameters {
+		if _, ok := params[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func validateBlockSize(val string) error {
+	switch val {
+	case "1024", "2048", "4096":
+		return nil
+	}
+	return errors.New("must be one of 1024, 2048, or 4096")
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMkfsArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsType   string
+		params   map[string]string
+		wantArgs []string
+		wantErr  bool
+	}{
+		{
+			name:   "no parameters",
+			fsType: "ext4",
+		},
+		{
+			name:   "unrelated parameters",
+			fsType: "ext4",
+			params: map[string]string{parameterEncrypted: "true"},
+		},
+		{
+			name:   "all ext4 options",
+			fsType: "ext4",
+			params: map[string]string{
+				parameterMkfsInodeRatio:               "4096",
+				parameterMkfsBlockSize:                "4096",
+				parameterMkfsReservedBlocksPercentage: "0.5",
+				parameterMkfsLazyInit:                 "false",
+			},
+			wantArgs: []string{"-b", "4096", "-i", "4096", "-m", "0.5", "-E", "lazy_itable_init=0,lazy_journal_init=0"},
+		},
+		{
+			name:   "all xfs options",
+			fsType: "xfs",
+			params: map[string]string{
+				parameterMkfsBlockSize: "2048",
+				parameterMkfsReflink:   "true",
+			},
+			wantArgs: []string{"-b", "size=2048", "-m", "reflink=1"},
+		},
+		{
+			name:    "xfs option for ext4",
+			fsType:  "ext4",
+			params:  map[string]string{parameterMkfsReflink: "true"},
+			wantErr: true,
+		},
+		{
+			name:    "ext4 option for xfs",
+			fsType:  "xfs",
+			params:  map[string]string{parameterMkfsInodeRatio: "4096"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported filesystem type",
+			fsType:  "btrfs",
+			params:  map[string]string{parameterMkfsBlockSize: "4096"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid block size",
+			fsType:  "ext4",
+			params:  map[string]string{parameterMkfsBlockSize: "3000"},
+			wantErr: true,
+		},
+		{
+			name:    "inode ratio out of range",
+			fsType:  "ext4",
+			params:  map[string]string{parameterMkfsInodeRatio: "512"},
+			wantErr: true,
+		},
+		{
+			name:    "injected argument",
+			fsType:  "ext4",
+			params:  map[string]string{parameterMkfsInodeRatio: "4096 -O ^has_journal"},
+			wantErr: true,
+		},
+		{
+			name:    "reserved blocks percentage out of range",
+			fsType:  "ext4",
+			params:  map[string]string{parameterMkfsReservedBlocksPercentage: "75"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := mkfsArgs(test.fsType, test.params)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got args %v, want error", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if !reflect.DeepEqual(args, test.wantArgs) {
+				t.Errorf("got args %v, want %v", args, test.wantArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountGroupXattr is the extended attribute on the root directory of a
+// filesystem that records the group the directory was handed over to. Trusted
+// attributes are hidden from unprivileged users.
+const mountGroupXattr = "trusted.dobs.mount-group"
+
+// mountGroupOptionFsTypes are the filesystem types that assign ownership
+// through mount options rather than storing it on disk.
+var mountGroupOptionFsTypes = map[string]bool{
+	"vfat":  true,
+	"msdos": true,
+	"exfat": true,
+	"ntfs3": true,
+}
+
+// parseMountGroup parses the volume_mount_group of a volume capability, which
+// is a numeric group ID. It returns -1 if no group is set.
+func parseMountGroup(mountGroup string) (int, error) {
+	if mountGroup == "" {
+		return -1, nil
+	}
+
+	gid, err := strconv.ParseUint(mountGroup, 10, 32)
+	if err != nil {
+		return -1, fmt.Errorf("volume mount group %q is not a numeric group ID", mountGroup)
+	}
+	return int(gid), nil
+}
+
+// mountGroupMountOptions returns the mount options that apply the given group
+// to a filesystem of the given type, or nil if the filesystem type does not
+// support them.
+func mountGroupMountOptions(fsType string, gid int) []string {
+	if !mountGroupOptionFsTypes[fsType] {
+		return nil
+	}
+	// let the group write as kubelet does for fsGroup
+	return []string{fmt.Sprintf("gid=%d", gid), "dmask=0002", "fmask=0113"}
+}
+
+// applyMountGroup hands the root directory of the filesystem mounted at the
+// given path over to the given group, instead of the recursive ownership
+// change kubelet performs for fsGroup. The change is recorded on the root
+// directory and only made once per group, so later changes by the workload
+// are kept. It returns whether the ownership was changed.
+func applyMountGroup(root string, gid int) (bool, error) {
+	want := strconv.Itoa(gid)
+
+	buf := make([]byte, 16)
+	n, err := unix.Getxattr(root, mountGroupXattr, buf)
+	switch {
+	case err == nil:
+		if string(buf[:n]) == want {
+			return false, nil
+		}
+	case errors.Is(err, unix.ENODATA), errors.Is(err, unix.ERANGE):
+	default:
+		return false, fmt.Errorf("failed to read the mount group of %q: %v", root, err)
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Lchown(root, -1, gid); err != nil {
+		return false, fmt.Errorf("failed to change the group of %q: %v", root, err)
+	}
+
+	// group read, write, and search, with new entries inheriting the group
+	mode := fi.Mode().Perm() | 0070 | os.ModeSetgid
+	if err := os.Chmod(root, mode); err != nil {
+		return false, fmt.Errorf("failed to change the mode of %q: %v", root, err)
+	}
+
+	if err := unix.Setxattr(root, mountGroupXattr, []byte(want), 0); err != nil {
+		return false, fmt.Errorf("failed to record the mount group of %q: %v", root, err)
+	}
+	return true, nil
+}
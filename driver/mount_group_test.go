@@ -0,0 +1,128 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountGroup(t *testing.T) {
+	tests := []struct {
+		mountGroup string
+		want       int
+		wantErr    bool
+	}{
+		{mountGroup: "", want: -1},
+		{mountGroup: "0", want: 0},
+		{mountGroup: "2000", want: 2000},
+		{mountGroup: "-1", want: -1, wantErr: true},
+		{mountGroup: "staff", want: -1, wantErr: true},
+		{mountGroup: "4294967296", want: -1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mountGroup, func(t *testing.T) {
+			got, err := parseMountGroup(test.mountGroup)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got group %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMountGroupMountOptions(t *testing.T) {
+	if got := mountGroupMountOptions("ext4", 2000); got != nil {
+		t.Errorf("got options %v for ext4, want none", got)
+	}
+
+	want := []string{"gid=2000", "dmask=0002", "fmask=0113"}
+	if got := mountGroupMountOptions("vfat", 2000); !reflect.DeepEqual(got, want) {
+		t.Errorf("got options %v for vfat, want %v", got, want)
+	}
+}
+
+func TestApplyMountGroup(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Chmod(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(root, mountGroupXattr+"-probe", []byte("1"), 0); err != nil {
+		t.Skipf("trusted extended attributes are not supported: %s", err)
+	}
+
+	assertGroup := func(t *testing.T, wantGID int) {
+		t.Helper()
+		fi, err := os.Stat(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gid := int(fi.Sys().(*syscall.Stat_t).Gid); gid != wantGID {
+			t.Errorf("got group %d, want %d", gid, wantGID)
+		}
+		if want := os.ModeDir | os.ModeSetgid | 0775; fi.Mode() != want {
+			t.Errorf("got mode %s, want %s", fi.Mode(), want)
+		}
+	}
+
+	changed, err := applyMountGroup(root, 2000)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !changed {
+		t.Error("got unchanged ownership on first application")
+	}
+	assertGroup(t, 2000)
+
+	// changes by the workload are kept
+	if err := os.Chown(root, -1, 3000); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = applyMountGroup(root, 2000)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if changed {
+		t.Error("got changed ownership on repeated application")
+	}
+	assertGroup(t, 3000)
+
+	changed, err = applyMountGroup(root, 4000)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !changed {
+		t.Error("got unchanged ownership for another group")
+	}
+	assertGroup(t, 4000)
+
+	buf := make([]byte, 16)
+	n, err := unix.Getxattr(root, mountGroupXattr, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "4000" {
+		t.Errorf("got recorded group %q, want %q", got, "4000")
+	}
+}
@@ -66,6 +66,9 @@ type fileSystem struct {
 type volumeStatistics struct {
 	availableBytes, totalBytes, usedBytes    int64
 	availableInodes, totalInodes, usedInodes int64
+
+	// ioStats holds the I/O counters of block volumes, if available.
+	ioStats *blockIOStats
 }
 
 const (
@@ -77,8 +80,9 @@ const (
 // TODO(timoreimann): find a more suitable name since the interface encompasses
 // more than just mounting functionality by now.
 type Mounter interface {
-	// Format formats the source with the given filesystem type
-	Format(source, fsType string) error
+	// Format formats the source with the given filesystem type and
+	// additional mkfs options
+	Format(source, fsType string, opts ...string) error
 
 	// Mount mounts source to target with the given fstype and options.
 	Mount(source, target, fsType string, options ...string) error
@@ -89,15 +93,33 @@ type Mounter interface {
 	// IsAttached checks whether the source device is in the running state.
 	IsAttached(source string) error
 
-	// IsFormatted checks whether the source device is formatted or not. It
-	// returns true if the source device is already formatted.
-	IsFormatted(source string) (bool, error)
+	// Fsck checks the filesystem of the given type on the source device,
+	// repairing errors if requested.
+	Fsck(source, fsType string, repair bool) (*fsckResult, error)
+
+	// ReplayJournal replays the journal of the ext filesystem on the source
+	// device, if it needs to be recovered, without checking the filesystem.
+	ReplayJournal(source string) error
+
+	// ProbeDevice returns the filesystem, partition table, and other
+	// signatures found on the source device. The returned signature is empty
+	// if the source device is pristine.
+	ProbeDevice(source string) (*deviceSignature, error)
+
+	// ApplyMountGroup hands the root directory of the filesystem mounted at
+	// the given path over to the given group, once per group. It returns
+	// whether the ownership was changed.
+	ApplyMountGroup(root string, gid int) (bool, error)
 
 	// IsMounted checks whether the target path is a correct mount (i.e:
 	// propagated). It returns true if it's mounted. An error is returned in
 	// case of system errors or if it's mounted incorrectly.
 	IsMounted(target string) (bool, error)
 
+	// MountContext returns the SELinux context the filesystem mounted at the
+	// target path was mounted with, or an empty string if there is none.
+	MountContext(target string) (string, error)
+
 	GetDeviceName(mounter mount.Interface, mountPath string) (string, error)
 
 	// GetStatistics returns capacity-related volume statistics for the given
@@ -108,6 +130,23 @@ type Mounter interface {
 	IsBlockDevice(volumePath string) (bool, error)
 }
 
+// FilesystemResizer grows filesystems to the size of their devices.
+type FilesystemResizer interface {
+	// NeedResize checks whether the filesystem on the device at the given
+	// path, mounted at the given mount path, is smaller than the device.
+	NeedResize(devicePath, deviceMountPath string) (bool, error)
+
+	// Resize grows the filesystem on the device at the given path, mounted
+	// at the given mount path, to the size of the device.
+	Resize(devicePath, deviceMountPath string) (bool, error)
+}
+
+// newFilesystemResizer returns a new FilesystemResizer backed by the resize
+// tools of the filesystems.
+func newFilesystemResizer() FilesystemResizer {
+	return mount.NewResizeFs(kexec.New())
+}
+
 // TODO(arslan): this is Linux only for now. Refactor this into a package with
 // architecture specific code in the future, such as mounter_darwin.go,
 // mounter_linux.go, etc..
@@ -131,7 +170,7 @@ func newMounter(log *logrus.Entry) *mounter {
 	}
 }
 
-func (m *mounter) Format(source, fsType string) error {
+func (m *mounter) Format(source, fsType string, opts ...string) error {
 	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
 
 	_, err := exec.LookPath(mkfsCmd)
@@ -152,10 +191,11 @@ func (m *mounter) Format(source, fsType string) error {
 		return errors.New("source is not specified for formatting the volume")
 	}
 
-	mkfsArgs = append(mkfsArgs, source)
 	if fsType == "ext4" || fsType == "ext3" {
-		mkfsArgs = []string{"-F", source}
+		mkfsArgs = append(mkfsArgs, "-F")
 	}
+	mkfsArgs = append(mkfsArgs, opts...)
+	mkfsArgs = append(mkfsArgs, source)
 
 	m.log.WithFields(logrus.Fields{
 		"cmd":  mkfsCmd,
@@ -262,44 +302,122 @@ func (m *mounter) IsAttached(source string) error {
 	return nil
 }
 
-func (m *mounter) IsFormatted(source string) (bool, error) {
+func (m *mounter) Fsck(source, fsType string, repair bool) (*fsckResult, error) {
 	if source == "" {
-		return false, errors.New("source is not specified")
+		return nil, errors.New("source is not specified for checking the filesystem")
+	}
+
+	fsckCmd, fsckArgs, ok := fsckCommand(fsType, repair)
+	if !ok {
+		return nil, fmt.Errorf("checking filesystem type %q is not supported", fsType)
+	}
+
+	_, err := exec.LookPath(fsckCmd)
+	if err != nil {
+		if err == exec.ErrNotFound {
+			return nil, fmt.Errorf("%q executable not found in $PATH", fsckCmd)
+		}
+		return nil, err
+	}
+
+	fsckArgs = append(fsckArgs, source)
+
+	m.log.WithFields(logrus.Fields{
+		"cmd":  fsckCmd,
+		"args": fsckArgs,
+	}).Info("executing fsck command")
+
+	out, err := exec.Command(fsckCmd, fsckArgs...).CombinedOutput()
+	res := &fsckResult{Output: string(out)}
+	if err != nil {
+		// a non-zero exit code reports the state of the filesystem and is
+		// interpreted by the caller
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("checking filesystem failed: %v cmd: '%s %s' output: %q",
+				err, fsckCmd, strings.Join(fsckArgs, " "), string(out))
+		}
+		res.ExitCode = exitErr.ExitCode()
+	}
+
+	return res, nil
+}
+
+func (m *mounter) ReplayJournal(source string) error {
+	if source == "" {
+		return errors.New("source is not specified for replaying the journal")
+	}
+
+	args := []string{"-p", "-E", "journal_only", source}
+	m.log.WithFields(logrus.Fields{
+		"cmd":  "e2fsck",
+		"args": args,
+	}).Info("executing journal replay command")
+
+	out, err := exec.Command("e2fsck", args...).CombinedOutput()
+	if err != nil {
+		// replaying the journal is reported as corrected errors
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode()&^(e2fsckErrorsCorrected|e2fsckErrorsCorrectedReboot) == 0 {
+			return nil
+		}
+		return fmt.Errorf("replaying the journal failed: %v cmd: 'e2fsck %s' output: %q",
+			err, strings.Join(args, " "), string(out))
+	}
+	return nil
+}
+
+func (m *mounter) MountContext(target string) (string, error) {
+	if target == "" {
+		return "", errors.New("target is not specified for checking the mount context")
+	}
+	return mountContext(procMountInfoPath, target)
+}
+
+func (m *mounter) ApplyMountGroup(root string, gid int) (bool, error) {
+	if root == "" {
+		return false, errors.New("root is not specified")
+	}
+	return applyMountGroup(root, gid)
+}
+
+func (m *mounter) ProbeDevice(source string) (*deviceSignature, error) {
+	if source == "" {
+		return nil, errors.New("source is not specified")
 	}
 
 	blkidCmd := "blkid"
 	_, err := exec.LookPath(blkidCmd)
 	if err != nil {
 		if err == exec.ErrNotFound {
-			return false, fmt.Errorf("%q executable not found in $PATH", blkidCmd)
+			return nil, fmt.Errorf("%q executable not found in $PATH", blkidCmd)
 		}
-		return false, err
+		return nil, err
 	}
 
-	blkidArgs := []string{source}
+	// low-level probing bypasses the blkid cache and also reports partition
+	// tables and non-filesystem signatures such as LVM or md members
+	blkidArgs := []string{"-p", "-o", "export", source}
 
 	m.log.WithFields(logrus.Fields{
 		"cmd":  blkidCmd,
 		"args": blkidArgs,
-	}).Info("checking if source is formatted")
+	}).Info("probing source device for signatures")
 
-	exitCode := 0
-	cmd := exec.Command(blkidCmd, blkidArgs...)
-	err = cmd.Run()
+	out, err := exec.Command(blkidCmd, blkidArgs...).Output()
 	if err != nil {
 		exitError, ok := err.(*exec.ExitError)
 		if !ok {
-			return false, fmt.Errorf("checking formatting failed: %v cmd: %q, args: %q", err, blkidCmd, blkidArgs)
+			return nil, fmt.Errorf("probing device failed: %v cmd: %q, args: %q", err, blkidCmd, blkidArgs)
 		}
 		ws := exitError.Sys().(syscall.WaitStatus)
-		exitCode = ws.ExitStatus()
-		if exitCode == blkidExitStatusNoIdentifiers {
-			return false, nil
+		if ws.ExitStatus() == blkidExitStatusNoIdentifiers {
+			return &deviceSignature{}, nil
 		}
-		return false, fmt.Errorf("checking formatting failed: %v cmd: %q, args: %q", err, blkidCmd, blkidArgs)
+		return nil, fmt.Errorf("probing device failed: %v cmd: %q, args: %q, output: %q", err, blkidCmd, blkidArgs, string(exitError.Stderr))
 	}
 
-	return true, nil
+	return parseDeviceSignature(string(out)), nil
 }
 
 func (m *mounter) IsMounted(target string) (bool, error) {
@@ -384,9 +502,9 @@ func (m *mounter) GetStatistics(volumePath string) (volumeStatistics, error) {
 			return volumeStatistics{}, fmt.Errorf("failed to parse size %s into int", strOut)
 		}
 
-		return volumeStatistics{
+		return withBlockIOStats(m.log, "/sys", unix.Stat, volumePath, volumeStatistics{
 			totalBytes: gotSizeBytes,
-		}, nil
+		}), nil
 	}
 
 	var statfs unix.Statfs_t
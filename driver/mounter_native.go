@@ -0,0 +1,314 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// mounterNative selects the mounter based on system calls and procfs.
+	mounterNative = "native"
+	// mounterExec selects the mounter executing mount, findmnt, and blkid.
+	mounterExec = "exec"
+
+	// maxUnmountAttempts bounds the number of mounts stacked on a single
+	// target that are unmounted.
+	maxUnmountAttempts = 10
+)
+
+// mountFlags maps mount options to the mount flags they set or clear.
+var mountFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"defaults":    {false, 0},
+	"ro":          {false, unix.MS_RDONLY},
+	"rw":          {true, unix.MS_RDONLY},
+	"nosuid":      {false, unix.MS_NOSUID},
+	"suid":        {true, unix.MS_NOSUID},
+	"nodev":       {false, unix.MS_NODEV},
+	"dev":         {true, unix.MS_NODEV},
+	"noexec":      {false, unix.MS_NOEXEC},
+	"exec":        {true, unix.MS_NOEXEC},
+	"sync":        {false, unix.MS_SYNCHRONOUS},
+	"async":       {true, unix.MS_SYNCHRONOUS},
+	"dirsync":     {false, unix.MS_DIRSYNC},
+	"remount":     {false, unix.MS_REMOUNT},
+	"mand":        {false, unix.MS_MANDLOCK},
+	"nomand":      {true, unix.MS_MANDLOCK},
+	"noatime":     {false, unix.MS_NOATIME},
+	"atime":       {true, unix.MS_NOATIME},
+	"nodiratime":  {false, unix.MS_NODIRATIME},
+	"diratime":    {true, unix.MS_NODIRATIME},
+	"relatime":    {false, unix.MS_RELATIME},
+	"norelatime":  {true, unix.MS_RELATIME},
+	"strictatime": {false, unix.MS_STRICTATIME},
+	"lazytime":    {false, unix.MS_LAZYTIME},
+	"nolazytime":  {true, unix.MS_LAZYTIME},
+	"bind":        {false, unix.MS_BIND},
+	"rbind":       {false, unix.MS_BIND | unix.MS_REC},
+}
+
+// nativeMounter is a Mounter that uses system calls and procfs instead of
+// executing mount, findmnt, and blkid. Operations without a native
+// counterpart, such as formatting and checking filesystems, are delegated to
+// the exec-based mounter.
+type nativeMounter struct {
+	*mounter
+	mountInfoPath string
+	sysPath       string
+	stat          func(string, *unix.Stat_t) error
+}
+
+// newNativeMounter returns a new native mounter instance.
+func newNativeMounter(log *logrus.Entry) *nativeMounter {
+	return &nativeMounter{
+		mounter:       newMounter(log),
+		mountInfoPath: procMountInfoPath,
+		sysPath:       "/sys",
+		stat:          unix.Stat,
+	}
+}
+
+// newMounterByName returns the mounter with the given name.
+func newMounterByName(name string, log *logrus.Entry) (Mounter, error) {
+	switch name {
+	case mounterExec, "":
+		return newMounter(log), nil
+	case mounterNative:
+		return newNativeMounter(log), nil
+	}
+	return nil, fmt.Errorf("invalid mounter %q, must be one of %q or %q", name, mounterNative, mounterExec)
+}
+
+// parseMountOptions splits mount options into mount flags and the data
+// passed on to the filesystem.
+func parseMountOptions(opts []string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, opt := range opts {
+		mf, ok := mountFlags[opt]
+		if !ok {
+			data = append(data, opt)
+			continue
+		}
+		if mf.clear {
+			flags &^= mf.flag
+		} else {
+			flags |= mf.flag
+		}
+	}
+	return flags, strings.Join(data, ",")
+}
+
+func (m *nativeMounter) Mount(source, target, fsType string, opts ...string) error {
+	if source == "" {
+		return errors.New("source is not specified for mounting the volume")
+	}
+
+	if target == "" {
+		return errors.New("target is not specified for mounting the volume")
+	}
+
+	// This is a raw block device mount. Create the mount point as a file
+	// since bind mount device node requires it to be a file
+	if fsType == "" {
+		// create directory for target, os.Mkdirall is noop if directory exists
+		err := os.MkdirAll(filepath.Dir(target), 0750)
+		if err != nil {
+			return fmt.Errorf("failed to create target directory for raw block bind mount: %v", err)
+		}
+
+		file, err := os.OpenFile(target, os.O_CREATE, 0660)
+		if err != nil {
+			return fmt.Errorf("failed to create target file for raw block bind mount: %v", err)
+		}
+		file.Close()
+	} else {
+		// create target, os.Mkdirall is noop if directory exists
+		err := os.MkdirAll(target, 0750)
+		if err != nil {
+			return err
+		}
+	}
+
+	// By default, xfs does not allow mounting of two volumes with the same filesystem uuid.
+	// Force ignore this uuid to be able to mount volume + its clone / restored snapshot on the same node.
+	if fsType == "xfs" {
+		opts = append(opts, "nouuid")
+	}
+
+	flags, data := parseMountOptions(opts)
+
+	log := m.log.WithFields(logrus.Fields{
+		"source":  source,
+		"target":  target,
+		"fs_type": fsType,
+		"flags":   fmt.Sprintf("%#x", flags),
+		"data":    data,
+	})
+	log.Info("mounting")
+
+	if flags&unix.MS_BIND == 0 {
+		if err := unix.Mount(source, target, fsType, flags, data); err != nil {
+			return fmt.Errorf("mounting %q to %q failed: %v", source, target, err)
+		}
+		return nil
+	}
+
+	// Bind mounts ignore all flags but MS_REC initially. Like mount(8), apply
+	// the remaining flags through a subsequent remount.
+	bindFlags := flags & (unix.MS_BIND | unix.MS_REC)
+	if err := unix.Mount(source, target, "", bindFlags, ""); err != nil {
+		return fmt.Errorf("bind mounting %q to %q failed: %v", source, target, err)
+	}
+
+	if remountFlags := flags &^ (unix.MS_BIND | unix.MS_REC); remountFlags != 0 {
+		log.Info("remounting bind mount to apply mount flags")
+		if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|remountFlags, ""); err != nil {
+			// do not leave a bind mount with the wrong flags behind
+			_ = unix.Unmount(target, 0)
+			return fmt.Errorf("remounting bind mount %q failed: %v", target, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *nativeMounter) Unmount(target string) error {
+	if target == "" {
+		return errors.New("target is not specified for unmounting the volume")
+	}
+
+	for i := 0; i < maxUnmountAttempts; i++ {
+		err := unix.Unmount(target, 0)
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT) {
+			// nothing (left) mounted at the target
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unmounting %q failed: %v", target, err)
+		}
+		m.log.WithField("target", target).Info("unmounted target")
+	}
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing mount point %q failed: %v", target, err)
+	}
+
+	return nil
+}
+
+func (m *nativeMounter) IsMounted(target string) (bool, error) {
+	if target == "" {
+		return false, errors.New("target is not specified for checking the mount")
+	}
+
+	infos, err := readMountInfo(m.mountInfoPath)
+	if err != nil {
+		return false, fmt.Errorf("checking mounted failed: %v", err)
+	}
+
+	targetFound := false
+	for _, info := range infos {
+		if info.MountPoint != target {
+			continue
+		}
+
+		// check if the mount is propagated correctly. It should be set to shared.
+		if !info.isShared() {
+			return true, fmt.Errorf("mount propagation for target %q is not enabled", target)
+		}
+		targetFound = true
+	}
+
+	return targetFound, nil
+}
+
+func (m *nativeMounter) MountContext(target string) (string, error) {
+	if target == "" {
+		return "", errors.New("target is not specified for checking the mount context")
+	}
+	return mountContext(m.mountInfoPath, target)
+}
+
+func (m *nativeMounter) ProbeDevice(source string) (*deviceSignature, error) {
+	if source == "" {
+		return nil, errors.New("source is not specified")
+	}
+
+	dev, err := os.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("probing device failed: %v", err)
+	}
+	defer dev.Close()
+
+	size, err := dev.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("probing device failed: failed to determine size of %q: %v", source, err)
+	}
+
+	sig, err := probeDeviceSignature(dev, size)
+	if err != nil {
+		return nil, fmt.Errorf("probing device failed: %v", err)
+	}
+
+	if sig == nil {
+		// never mistake data we cannot identify for a blank device
+		m.log.WithField("source", source).Info("no known signature found on non-blank source device, falling back to blkid")
+		return m.mounter.ProbeDevice(source)
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"source":    source,
+		"signature": sig.String(),
+	}).Info("probed source device for signatures")
+	return sig, nil
+}
+
+func (m *nativeMounter) GetStatistics(volumePath string) (volumeStatistics, error) {
+	var st unix.Stat_t
+	if err := m.stat(volumePath, &st); err != nil {
+		return volumeStatistics{}, fmt.Errorf("failed to determine if volume %s is block device: %v", volumePath, err)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return m.mounter.GetStatistics(volumePath)
+	}
+
+	devDir, err := blockDeviceSysfsDir(m.sysPath, m.stat, volumePath)
+	if err != nil {
+		return volumeStatistics{}, fmt.Errorf("error when getting size of block volume at path %s: %v", volumePath, err)
+	}
+	size, err := readBlockDeviceSize(devDir)
+	if err != nil {
+		return volumeStatistics{}, fmt.Errorf("error when getting size of block volume at path %s: %v", volumePath, err)
+	}
+
+	return withBlockIOStats(m.log, m.sysPath, m.stat, volumePath, volumeStatistics{
+		totalBytes: size,
+	}), nil
+}
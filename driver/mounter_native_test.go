@@ -0,0 +1,156 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []string
+		wantFlags uintptr
+		wantData  string
+	}{
+		{
+			name: "no options",
+		},
+		{
+			name:      "read-only bind mount",
+			opts:      []string{"bind", "ro"},
+			wantFlags: unix.MS_BIND | unix.MS_RDONLY,
+		},
+		{
+			name:      "flags and data",
+			opts:      []string{"noatime", "discard", "nouuid"},
+			wantFlags: unix.MS_NOATIME,
+			wantData:  "discard,nouuid",
+		},
+		{
+			name:      "later options override earlier ones",
+			opts:      []string{"ro", "noexec", "rw"},
+			wantFlags: unix.MS_NOEXEC,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags, data := parseMountOptions(test.opts)
+			if flags != test.wantFlags {
+				t.Errorf("got flags %#x, want %#x", flags, test.wantFlags)
+			}
+			if data != test.wantData {
+				t.Errorf("got data %q, want %q", data, test.wantData)
+			}
+		})
+	}
+}
+
+func TestNativeMounterIsMounted(t *testing.T) {
+	mountInfoPath := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(mountInfoPath, []byte(testMountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newNativeMounter(logrus.New().WithField("test_enabled", true))
+	m.mountInfoPath = mountInfoPath
+
+	tests := []struct {
+		name        string
+		target      string
+		wantMounted bool
+		wantErr     bool
+	}{
+		{
+			name:        "shared mount",
+			target:      "/var/lib/kubelet/plugins/kubernetes.io/csi/dobs.csi.digitalocean.com/abc/globalmount",
+			wantMounted: true,
+		},
+		{
+			name:   "not mounted",
+			target: "/mnt/other",
+		},
+		{
+			name:        "unshared mount",
+			target:      "/mnt/with space",
+			wantMounted: true,
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mounted, err := m.IsMounted(test.target)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if mounted != test.wantMounted {
+				t.Errorf("got mounted %t, want %t", mounted, test.wantMounted)
+			}
+		})
+	}
+}
+
+func TestNativeMounterGetStatisticsBlock(t *testing.T) {
+	const devicePath = "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod1"
+
+	sysPath := t.TempDir()
+	devDir := filepath.Join(sysPath, "dev", "block", "8:16")
+	mustMkdirAll(t, devDir)
+	mustWriteFile(t, filepath.Join(devDir, "size"), "20971520\n")
+	mustWriteFile(t, filepath.Join(devDir, "stat"), "1520 12 98304 830 4210 300 1048576 9120 2 5400 10120\n")
+
+	m := newNativeMounter(logrus.New().WithField("test_enabled", true))
+	m.sysPath = sysPath
+	m.stat = func(path string, st *unix.Stat_t) error {
+		st.Mode = unix.S_IFBLK | 0660
+		st.Rdev = unix.Mkdev(8, 16)
+		return nil
+	}
+
+	stats, err := m.GetStatistics(devicePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if want := int64(10 * giB); stats.totalBytes != want {
+		t.Errorf("got total bytes %d, want %d", stats.totalBytes, want)
+	}
+	if stats.ioStats == nil {
+		t.Fatal("got no I/O counters")
+	}
+	if stats.ioStats.ReadOps != 1520 || stats.ioStats.WriteOps != 4210 {
+		t.Errorf("got read ops %d and write ops %d, want 1520 and 4210", stats.ioStats.ReadOps, stats.ioStats.WriteOps)
+	}
+
+	// the capacity is still reported without the I/O counters
+	if err := os.Remove(filepath.Join(devDir, "stat")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = m.GetStatistics(devicePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if stats.ioStats != nil {
+		t.Errorf("got I/O counters %+v, want none", *stats.ioStats)
+	}
+}
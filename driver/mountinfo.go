@@ -0,0 +1,213 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// procMountInfoPath is the mountinfo file of the driver's mount namespace.
+const procMountInfoPath = "/proc/self/mountinfo"
+
+// mountInfo is a single entry of a mountinfo file. See proc(5) for details.
+type mountInfo struct {
+	ID       int
+	ParentID int
+	Major    int
+	Minor    int
+	// Root is the path of the directory in the filesystem that forms the
+	// root of the mount.
+	Root string
+	// MountPoint is the path of the mount point.
+	MountPoint string
+	// Options are the per-mount options.
+	Options []string
+	// OptionalFields holds tagged fields such as shared:N or master:N.
+	OptionalFields []string
+	FsType         string
+	// Source is the filesystem specific mount source (e.g., the device).
+	Source string
+	// SuperOptions are the per-superblock options.
+	SuperOptions []string
+}
+
+// isShared checks whether the mount is part of a shared peer group.
+func (mi *mountInfo) isShared() bool {
+	for _, field := range mi.OptionalFields {
+		if strings.HasPrefix(field, "shared:") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOption checks whether the mount or its superblock has the given option.
+func (mi *mountInfo) hasOption(option string) bool {
+	for _, opts := range [][]string{mi.Options, mi.SuperOptions} {
+		for _, opt := range opts {
+			if opt == option {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selinuxContext returns the SELinux context the filesystem was mounted with,
+// or an empty string if there is none.
+func (mi *mountInfo) selinuxContext() string {
+	for _, opt := range mi.SuperOptions {
+		if context, ok := strings.CutPrefix(opt, selinuxContextOption); ok {
+			return unquoteSELinuxContext(context)
+		}
+	}
+	return ""
+}
+
+// readMountInfo reads and parses the mountinfo file at the given path.
+func readMountInfo(path string) ([]mountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
+
+// parseMountInfo parses mountinfo entries, one per line.
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var infos []mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		info, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+func parseMountInfoLine(line string) (mountInfo, error) {
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	fields := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep == -1 || len(fields) < sep+3 {
+		return mountInfo{}, fmt.Errorf("malformed mountinfo line %q", line)
+	}
+
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return mountInfo{}, fmt.Errorf("malformed mount ID in mountinfo line %q", line)
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return mountInfo{}, fmt.Errorf("malformed parent ID in mountinfo line %q", line)
+	}
+
+	majorStr, minorStr, ok := strings.Cut(fields[2], ":")
+	if !ok {
+		return mountInfo{}, fmt.Errorf("malformed device number in mountinfo line %q", line)
+	}
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return mountInfo{}, fmt.Errorf("malformed major device number in mountinfo line %q", line)
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil {
+		return mountInfo{}, fmt.Errorf("malformed minor device number in mountinfo line %q", line)
+	}
+
+	info := mountInfo{
+		ID:             id,
+		ParentID:       parentID,
+		Major:          major,
+		Minor:          minor,
+		Root:           unescapeMountInfoField(fields[3]),
+		MountPoint:     unescapeMountInfoField(fields[4]),
+		Options:        splitMountOptions(fields[5]),
+		OptionalFields: fields[6:sep],
+		FsType:         fields[sep+1],
+		Source:         unescapeMountInfoField(fields[sep+2]),
+	}
+	if len(fields) > sep+3 {
+		info.SuperOptions = splitMountOptions(fields[sep+3])
+	}
+
+	return info, nil
+}
+
+// splitMountOptions splits comma-separated mount options, keeping commas
+// within double quotes, e.g., of SELinux contexts with multiple categories.
+func splitMountOptions(options string) []string {
+	var opts []string
+	start, quoted := 0, false
+	for i := 0; i < len(options); i++ {
+		switch options[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				opts = append(opts, options[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(opts, options[start:])
+}
+
+// unescapeMountInfoField replaces the octal escapes the kernel uses for
+// spaces, tabs, newlines, and backslashes in mountinfo fields.
+func unescapeMountInfoField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
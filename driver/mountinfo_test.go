@@ -0,0 +1,83 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMountInfo = `22 1 252:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+36 22 8:0 / /var/lib/kubelet/plugins/kubernetes.io/csi/dobs.csi.digitalocean.com/abc/globalmount rw,relatime shared:120 - ext4 /dev/sda rw,errors=remount-ro
+37 22 8:0 / /var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount rw,relatime shared:120 master:3 - ext4 /dev/sda rw,errors=remount-ro
+38 22 8:16 / /mnt/with\040space ro,noatime - xfs /dev/sdb ro,nouuid
+`
+
+func TestParseMountInfo(t *testing.T) {
+	infos, err := parseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	if len(infos) != 4 {
+		t.Fatalf("got %d entries, want 4", len(infos))
+	}
+
+	want := mountInfo{
+		ID:             37,
+		ParentID:       22,
+		Major:          8,
+		Minor:          0,
+		Root:           "/",
+		MountPoint:     "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount",
+		Options:        []string{"rw", "relatime"},
+		OptionalFields: []string{"shared:120", "master:3"},
+		FsType:         "ext4",
+		Source:         "/dev/sda",
+		SuperOptions:   []string{"rw", "errors=remount-ro"},
+	}
+	if !reflect.DeepEqual(infos[2], want) {
+		t.Errorf("got entry %+v, want %+v", infos[2], want)
+	}
+	if !infos[2].isShared() {
+		t.Error("got unshared mount, want shared")
+	}
+
+	last := infos[3]
+	if last.MountPoint != "/mnt/with space" {
+		t.Errorf("got mount point %q, want %q", last.MountPoint, "/mnt/with space")
+	}
+	if last.isShared() {
+		t.Error("got shared mount, want unshared")
+	}
+	if !last.hasOption("ro") || !last.hasOption("nouuid") || last.hasOption("rw") {
+		t.Errorf("got unexpected options %v / %v", last.Options, last.SuperOptions)
+	}
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	for _, line := range []string{
+		"22 1 252:1 / / rw,relatime shared:1 ext4 /dev/vda1 rw",
+		"x 1 252:1 / / rw - ext4 /dev/vda1 rw",
+		"22 1 252 / / rw - ext4 /dev/vda1 rw",
+	} {
+		if _, err := parseMountInfo(strings.NewReader(line)); err == nil {
+			t.Errorf("got no error for malformed line %q", line)
+		}
+	}
+}
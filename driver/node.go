@@ -27,7 +27,6 @@ package driver
 import (
 	"context"
 	"fmt"
-	"k8s.io/klog/v2"
 	"os"
 	"path/filepath"
 	"strings"
@@ -37,8 +36,6 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/mount-utils"
-	mountutil "k8s.io/mount-utils"
-	utilexec "k8s.io/utils/exec"
 )
 
 const (
@@ -99,17 +96,28 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	source := getDeviceByIDPath(volumeName)
+	source, err := d.deviceResolver.Resolve(ctx, volumeName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to find device path for volume %s. %v", volumeName, err)
+	}
 	target := req.StagingTargetPath
 
 	mnt := req.VolumeCapability.GetMount()
 	options := mnt.MountFlags
 
-	fsType := "ext4"
+	fsType := defaultFsType
 	if mnt.FsType != "" {
 		fsType = mnt.FsType
 	}
 
+	mountGroup, err := parseMountGroup(mnt.VolumeMountGroup)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if mountGroup >= 0 {
+		options = append(options, mountGroupMountOptions(fsType, mountGroup)...)
+	}
+
 	log = d.log.WithFields(logrus.Fields{
 		"volume_mode":     volumeModeFilesystem,
 		"volume_name":     volumeName,
@@ -127,25 +135,128 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 			break
 		}
 	}
+
+	// a read-only volume is staged without writing anything to it
+	readOnly := d.isPublishedReadOnly(req.PublishContext) || isReadOnlyAccessMode(req.VolumeCapability)
+	if readOnly {
+		options = append(options, readOnlyMountOptions(fsType)...)
+		log = log.WithFields(logrus.Fields{
+			"read_only":     true,
+			"mount_options": options,
+		})
+	}
+
+	if !noFormat && d.validateAttachment {
+		if err := d.mounter.IsAttached(source); err != nil {
+			return nil, fmt.Errorf("error retrieving the attachement status %q: %s", source, err)
+		}
+	}
+
+	if d.verifyDeviceIdentity {
+		if err := d.deviceResolver.Verify(source, req.VolumeId, volumeName); err != nil {
+			log.WithError(err).Error("device identity verification failed")
+			return nil, status.Errorf(codes.FailedPrecondition, "device %q of volume %q failed identity verification: %v", source, req.VolumeId, err)
+		}
+	}
+
+	encrypted, err := boolParameter(req.VolumeContext, parameterEncrypted, false)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if encrypted {
+		// from here on, the filesystem lives on the opened LUKS device
+		source, err = d.openEncryptedVolume(req, source, noFormat || readOnly, readOnly, log)
+		if err != nil {
+			return nil, err
+		}
+		log = log.WithField("luks_device", source)
+	}
+
+	fsckPolicy, err := d.volumeFsckPolicy(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if readOnly && fsckPolicy == fsckPolicyAutoRepair {
+		fsckPolicy = fsckPolicyCheckOnly
+	}
+
+	trim, err := boolParameter(req.VolumeContext, parameterTrim, true)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// a filesystem created by this call does not need to be checked
+	var formattedNow bool
 	if noFormat {
 		log.Info("skipping formatting the source device")
 	} else {
-		if d.validateAttachment {
-			if err := d.mounter.IsAttached(source); err != nil {
-				return nil, fmt.Errorf("error retrieving the attachement status %q: %s", source, err)
+		formatPolicy, err := d.volumeFormatPolicy(req.VolumeContext)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		requireLabel, err := boolParameter(req.VolumeContext, parameterRequireVolumeLabel, false)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		var label string
+		if requireLabel {
+			if !supportsVolumeLabel(fsType) {
+				return nil, status.Errorf(codes.InvalidArgument, "volume labels are not supported for filesystem type %q", fsType)
 			}
+			label = volumeLabel(req.VolumeId)
+		}
+
+		sig, err := d.mounter.ProbeDevice(source)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 
-		formatted, err := d.mounter.IsFormatted(source)
+		log = log.WithFields(logrus.Fields{
+			"format_policy":   formatPolicy,
+			"device_fs_type":  sig.Type,
+			"device_usage":    sig.Usage,
+			"device_label":    sig.Label,
+			"partition_table": sig.PartitionTable,
+		})
+
+		format, err := needsFormat(req.VolumeId, sig, fsType, formatPolicy, label)
 		if err != nil {
+			log.WithError(err).Error("refusing to stage the volume")
 			return nil, err
 		}
 
-		if !formatted {
-			log.Info("formatting the volume for staging")
-			if err := d.mounter.Format(source, fsType); err != nil {
+		if format && readOnly {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %q is published read-only but needs to be formatted", req.VolumeId)
+		}
+
+		preformattedFsType := req.VolumeContext[volumeContextPreformattedFsType]
+		if format {
+			if preformattedFsType != "" {
+				log.WithField("preformatted_fs_type", preformattedFsType).Warn("source device was expected to be formatted by DO but is not")
+			}
+			mkfsOpts, err := mkfsArgs(fsType, req.VolumeContext)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			if label != "" {
+				mkfsOpts = append(mkfsOpts, "-L", label)
+			}
+
+			log.WithField("mkfs_options", mkfsOpts).Info("formatting the volume for staging")
+			if err := d.mounter.Format(source, fsType, mkfsOpts...); err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
+			formattedNow = true
+		} else if preformattedFsType != "" {
+			// make sure we do not mount something other than what DO
+			// formatted the volume with
+			if sig.Type != preformattedFsType {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %q was formatted with %s by DO but source device %q carries %q", req.VolumeId, preformattedFsType, source, sig.Type)
+			}
+			log.WithField("preformatted_fs_type", preformattedFsType).Info("source device was formatted by DO")
 		} else {
 			log.Info("source device is already formatted")
 		}
@@ -158,34 +269,122 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, err
 	}
 
+	// the SELinux context option is passed through to the staging mount, as
+	// bind mounts cannot change the context
+	selinuxContext, _ := splitSELinuxContext(options)
+
 	if !mounted {
+		if !formattedNow {
+			if err := d.checkFilesystem(req.VolumeId, source, fsType, fsckPolicy, readOnly, log); err != nil {
+				return nil, err
+			}
+		}
+
 		if err := d.mounter.Mount(source, target, fsType, options...); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
 		log.Info("source device is already mounted to the target path")
+
+		stagedContext, err := d.mounter.MountContext(target)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := checkSELinuxContext(stagedContext, selinuxContext); err != nil {
+			log.WithError(err).Error("volume is staged with a conflicting SELinux context")
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %q cannot be staged at %q: %v", req.VolumeId, target, err)
+		}
 	}
 
-	if _, err := os.Stat(source); err == nil {
-		r := mountutil.NewResizeFs(utilexec.New())
-		needResize, err := r.NeedResize(source, target)
+	// The volume may have been created from a smaller snapshot or volume, or
+	// it may have been expanded while it was detached (i.e., offline). In
+	// either case, the filesystem needs to be grown to the device size.
+	if readOnly {
+		log.Info("skipping resizing the filesystem of the read-only volume")
+	} else if _, err := os.Stat(source); err == nil {
+		needResize, err := d.fsResizer.NeedResize(source, target)
 
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "Could not determine if volume %q need to be resized: %v", req.VolumeId, err)
 		}
 
 		if needResize {
-			klog.V(4).Infof("NodeStageVolume: Resizing volume %q created from a snapshot/volume", req.VolumeId)
-			if _, err := r.Resize(source, target); err != nil {
+			log.Info("resizing the filesystem to the size of the staged volume")
+			if _, err := d.fsResizer.Resize(source, target); err != nil {
 				return nil, status.Errorf(codes.Internal, "Could not resize volume %q:  %v", req.VolumeId, err)
 			}
 		}
 	}
 
+	if mountGroup >= 0 && !readOnly {
+		if err := d.applyVolumeMountGroup(target, fsType, mountGroup, log); err != nil {
+			return nil, err
+		}
+	}
+
+	// the opt-out is recorded regardless of whether trimming is enabled, so
+	// that it is honored once it is
+	if err := recordTrimOptOut(target, !trim, log); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	log.Info("formatting and mounting stage volume is finished")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// openEncryptedVolume opens the LUKS device on the given source device,
+// LUKS formatting the source first if it is pristine. Read-only volumes are
+// opened read-only, so that not even the LUKS header is written to. It returns
+// the path of the opened device.
+func (d *Driver) openEncryptedVolume(req *csi.NodeStageVolumeRequest, source string, noFormat, readOnly bool, log *logrus.Entry) (string, error) {
+	key := req.GetSecrets()[secretEncryptionKey]
+	if key == "" {
+		return "", status.Errorf(codes.InvalidArgument, "NodeStageVolume secret %q must be provided for encrypted volumes", secretEncryptionKey)
+	}
+
+	isLuks, err := d.encryptor.IsLuks(source)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	if !isLuks {
+		if noFormat {
+			return "", status.Errorf(codes.FailedPrecondition, "volume %q is not LUKS formatted and may not be formatted", req.VolumeId)
+		}
+
+		// never encrypt over existing data
+		sig, err := d.mounter.ProbeDevice(source)
+		if err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		if !sig.isEmpty() {
+			return "", status.Errorf(codes.FailedPrecondition, "volume %q carries an unencrypted signature (%s), refusing to LUKS format it", req.VolumeId, sig)
+		}
+
+		log.Info("LUKS formatting the source device")
+		if err := d.encryptor.LuksFormat(source, key); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	mapperName := luksMapperName(req.VolumeId)
+	isOpen, err := d.encryptor.IsLuksOpen(mapperName)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	if !isOpen {
+		log.Info("opening the LUKS device")
+		if err := d.encryptor.LuksOpen(source, mapperName, key, readOnly); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		log.Info("LUKS device is already open")
+	}
+
+	return luksMapperPath(mapperName), nil
+}
+
 // NodeUnstageVolume unstages the volume from the staging path
 func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -218,6 +417,19 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 		log.Info("staging target path is already unmounted")
 	}
 
+	mapperName := luksMapperName(req.VolumeId)
+	isOpen, err := d.encryptor.IsLuksOpen(mapperName)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if isOpen {
+		log.Info("closing the LUKS device")
+		if err := d.encryptor.LuksClose(mapperName); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	log.Info("unmounting stage volume is finished")
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -228,6 +440,10 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume ID must be provided")
 	}
 
+	if isEphemeralVolume(req.VolumeContext) {
+		return d.nodePublishEphemeral(ctx, req)
+	}
+
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Staging Target Path must be provided")
 	}
@@ -249,14 +465,14 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	log.Info("node publish volume called")
 
 	options := []string{"bind"}
-	if req.Readonly {
+	if req.Readonly || isReadOnlyAccessMode(req.VolumeCapability) || d.isPublishedReadOnly(req.PublishContext) {
 		options = append(options, "ro")
 	}
 
 	var err error
 	switch req.GetVolumeCapability().GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
-		err = d.nodePublishVolumeForBlock(req, options, log)
+		err = d.nodePublishVolumeForBlock(ctx, req, options, log)
 	case *csi.VolumeCapability_Mount:
 		err = d.nodePublishVolumeForFileSystem(req, options, log)
 	default:
@@ -271,6 +487,32 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// nodePublishEphemeral publishes a CSI ephemeral inline volume, which comes
+// without a staging path.
+func (d *Driver) nodePublishEphemeral(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must be provided")
+	}
+
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
+	}
+
+	log := d.log.WithFields(logrus.Fields{
+		"volume_id":   req.VolumeId,
+		"target_path": req.TargetPath,
+		"method":      "node_publish_volume",
+	})
+	log.Info("node publish ephemeral volume called")
+
+	if err := d.nodePublishEphemeralVolume(ctx, req, log); err != nil {
+		return nil, err
+	}
+
+	log.Info("publishing ephemeral volume is finished")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
 // NodeUnpublishVolume unmounts the volume from the target path
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -293,6 +535,13 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, err
 	}
 
+	// inline volumes live and die with the pod
+	if d.ephemeralVolumes && strings.HasPrefix(req.VolumeId, ephemeralVolumeIDPrefix) {
+		if err := d.nodeUnpublishEphemeralVolume(ctx, req.VolumeId, log); err != nil {
+			return nil, err
+		}
+	}
+
 	log.Info("unmounting volume is finished")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -321,6 +570,27 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 				},
 			},
 		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				},
+			},
+		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+				},
+			},
+		},
 	}
 
 	d.log.WithFields(logrus.Fields{
@@ -340,7 +610,7 @@ func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (
 	d.log.WithField("method", "node_get_info").Info("node get info called")
 	return &csi.NodeGetInfoResponse{
 		NodeId:            d.hostID(),
-		MaxVolumesPerNode: int64(d.volumeLimit),
+		MaxVolumesPerNode: d.nodeVolumeLimit(),
 
 		// make sure that the driver works on this particular region only
 		AccessibleTopology: &csi.Topology{
@@ -389,12 +659,33 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		return nil, status.Errorf(codes.Internal, "failed to retrieve capacity statistics for volume path %q: %s", volumePath, err)
 	}
 
+	// a failing health check must not hide the usage
+	condition, err := d.volumeHealth.Condition(volumePath, isBlock)
+	if err != nil {
+		log.WithError(err).Warn("failed to determine volume condition")
+	} else if condition.Abnormal {
+		log.WithField("volume_condition", condition.Message).Warn("volume is abnormal")
+	}
+
 	// only can retrieve total capacity for a block device
 	if isBlock {
-		log.WithFields(logrus.Fields{
+		log = log.WithFields(logrus.Fields{
 			"volume_mode": volumeModeBlock,
 			"bytes_total": stats.totalBytes,
-		}).Info("node capacity statistics retrieved")
+		})
+		// CSI has no unit for I/O counters, so they are only logged here
+		// and exported as metrics by the debug server
+		if io := stats.ioStats; io != nil {
+			log = log.WithFields(logrus.Fields{
+				"read_ops":         io.ReadOps,
+				"read_bytes":       io.ReadSectors * sectorSize,
+				"write_ops":        io.WriteOps,
+				"written_bytes":    io.WriteSectors * sectorSize,
+				"io_in_flight":     io.InFlight,
+				"io_queue_time_ms": io.TimeInQueue,
+			})
+		}
+		log.Info("node capacity statistics retrieved")
 
 		return &csi.NodeGetVolumeStatsResponse{
 			Usage: []*csi.VolumeUsage{
@@ -403,6 +694,7 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 					Total: stats.totalBytes,
 				},
 			},
+			VolumeCondition: condition,
 		}, nil
 	}
 
@@ -431,6 +723,7 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 				Unit:      csi.VolumeUsage_INODES,
 			},
 		},
+		VolumeCondition: condition,
 	}, nil
 }
 
@@ -452,14 +745,6 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 	})
 	log.Info("node expand volume called")
 
-	if req.GetVolumeCapability() != nil {
-		switch req.GetVolumeCapability().GetAccessType().(type) {
-		case *csi.VolumeCapability_Block:
-			log.Info("filesystem expansion is skipped for block volumes")
-			return &csi.NodeExpandVolumeResponse{}, nil
-		}
-	}
-
 	mounted, err := d.mounter.IsMounted(volumePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume failed to check if volume path %q is mounted: %s", volumePath, err)
@@ -469,6 +754,21 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 		return nil, status.Errorf(codes.NotFound, "NodeExpandVolume volume path %q is not mounted", volumePath)
 	}
 
+	var isBlock bool
+	if volCap := req.GetVolumeCapability(); volCap != nil {
+		_, isBlock = volCap.GetAccessType().(*csi.VolumeCapability_Block)
+	} else {
+		// older COs do not pass the capability
+		isBlock, err = d.mounter.IsBlockDevice(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeExpandVolume failed to determine if %q is block device: %s", volumePath, err)
+		}
+	}
+
+	if isBlock {
+		return d.nodeExpandBlockVolume(ctx, req, log)
+	}
+
 	mounter := mount.New("")
 	devicePath, err := d.mounter.GetDeviceName(mounter, volumePath)
 	if err != nil {
@@ -479,12 +779,27 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 		return nil, status.Errorf(codes.NotFound, "NodeExpandVolume device path for volume path %q not found", volumePath)
 	}
 
-	r := mount.NewResizeFs(utilexec.New())
 	log = log.WithFields(logrus.Fields{
 		"device_path": devicePath,
 	})
+
+	// the LUKS device of encrypted volumes must be grown before the
+	// filesystem on top of it
+	mapperName := luksMapperName(volumeID)
+	isOpen, err := d.encryptor.IsLuksOpen(mapperName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeExpandVolume failed to check LUKS device of volume %q: %v", volumeID, err)
+	}
+
+	if isOpen {
+		log.Info("resizing LUKS device")
+		if err := d.encryptor.LuksResize(mapperName, req.GetSecrets()[secretEncryptionKey]); err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeExpandVolume could not resize LUKS device of volume %q: %v", volumeID, err)
+		}
+	}
+
 	log.Info("resizing volume")
-	if _, err := r.Resize(devicePath, volumePath); err != nil {
+	if _, err := d.fsResizer.Resize(devicePath, volumePath); err != nil {
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume could not resize volume %q (%q):  %v", volumeID, req.GetVolumePath(), err)
 	}
 
@@ -492,6 +807,26 @@ func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolume
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
+// nodeExpandBlockVolume makes the kernel pick up the new size of the device of
+// a raw block volume. Unlike filesystems, block devices cannot be grown by the
+// node service, so the device must already have been resized by DO.
+func (d *Driver) nodeExpandBlockVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest, log *logrus.Entry) (*csi.NodeExpandVolumeResponse, error) {
+	requiredBytes := req.GetCapacityRange().GetRequiredBytes()
+	log = log.WithFields(logrus.Fields{
+		"volume_mode":    volumeModeBlock,
+		"bytes_required": requiredBytes,
+	})
+
+	log.Info("refreshing size of block device")
+	size, err := d.blockDeviceResizer.Resize(ctx, req.VolumePath, requiredBytes)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeExpandVolume could not refresh size of block device of volume %q (%q): %v", req.VolumeId, req.VolumePath, err)
+	}
+
+	log.WithField("bytes_total", size).Info("block device was resized")
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
+}
+
 func (d *Driver) nodePublishVolumeForFileSystem(req *csi.NodePublishVolumeRequest, mountOptions []string, log *logrus.Entry) error {
 	source := req.StagingTargetPath
 	target := req.TargetPath
@@ -501,11 +836,37 @@ func (d *Driver) nodePublishVolumeForFileSystem(req *csi.NodePublishVolumeReques
 		mountOptions = append(mountOptions, flag)
 	}
 
-	fsType := "ext4"
+	// the SELinux context was applied when staging the volume and all
+	// publish mounts share it
+	selinuxContext, mountOptions := splitSELinuxContext(mountOptions)
+	if selinuxContext != "" {
+		stagedContext, err := d.mounter.MountContext(source)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := checkSELinuxContext(stagedContext, selinuxContext); err != nil {
+			log.WithError(err).Error("volume is staged with a conflicting SELinux context")
+			return status.Errorf(codes.FailedPrecondition, "volume %q cannot be published to %q: %v", req.VolumeId, target, err)
+		}
+	}
+
+	fsType := defaultFsType
 	if mnt.FsType != "" {
 		fsType = mnt.FsType
 	}
 
+	// the group may differ from the one the volume was staged with, e.g., for
+	// a pod with another fsGroup
+	mountGroup, err := parseMountGroup(mnt.VolumeMountGroup)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if mountGroup >= 0 && !hasOptionIn(mountOptions, "ro") {
+		if err := d.applyVolumeMountGroup(source, fsType, mountGroup, log); err != nil {
+			return err
+		}
+	}
+
 	mounted, err := d.mounter.IsMounted(target)
 	if err != nil {
 		return err
@@ -530,17 +891,29 @@ func (d *Driver) nodePublishVolumeForFileSystem(req *csi.NodePublishVolumeReques
 	return nil
 }
 
-func (d *Driver) nodePublishVolumeForBlock(req *csi.NodePublishVolumeRequest, mountOptions []string, log *logrus.Entry) error {
+func (d *Driver) nodePublishVolumeForBlock(ctx context.Context, req *csi.NodePublishVolumeRequest, mountOptions []string, log *logrus.Entry) error {
 	volumeName, ok := req.GetPublishContext()[d.publishInfoVolumeName]
 	if !ok {
 		return status.Error(codes.InvalidArgument, fmt.Sprintf("Could not find the volume name from the publish context %q", d.publishInfoVolumeName))
 	}
 
-	source, err := findAbsoluteDeviceByIDPath(volumeName)
+	devicePath, err := d.deviceResolver.Resolve(ctx, volumeName)
 	if err != nil {
 		return status.Errorf(codes.Internal, "Failed to find device path for volume %s. %v", volumeName, err)
 	}
 
+	source, err := findAbsoluteDevicePath(devicePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to find device path for volume %s. %v", volumeName, err)
+	}
+
+	if d.verifyDeviceIdentity {
+		if err := d.deviceResolver.Verify(source, req.VolumeId, volumeName); err != nil {
+			log.WithError(err).Error("device identity verification failed")
+			return status.Errorf(codes.FailedPrecondition, "device %q of volume %q failed identity verification: %v", source, req.VolumeId, err)
+		}
+	}
+
 	target := req.TargetPath
 
 	mounted, err := d.mounter.IsMounted(target)
@@ -566,16 +939,8 @@ func (d *Driver) nodePublishVolumeForBlock(req *csi.NodePublishVolumeRequest, mo
 	return nil
 }
 
-// getDeviceByIDPath returns the absolute path of the attached volume for the given
-// DO volume name
-func getDeviceByIDPath(volumeName string) string {
-	return filepath.Join(diskIDPath, fmt.Sprintf("%s%s", diskDOPrefix, volumeName))
-}
-
-// findAbsoluteDeviceByIDPath follows the /dev/disk/by-id symlink to find the absolute path of a device
-func findAbsoluteDeviceByIDPath(volumeName string) (string, error) {
-	path := getDeviceByIDPath(volumeName)
-
+// findAbsoluteDevicePath follows the /dev/disk/by-id symlink to find the absolute path of a device
+func findAbsoluteDevicePath(path string) (string, error) {
 	// EvalSymlinks returns relative link if the file is not a symlink
 	// so we do not have to check if it is symlink prior to evaluation
 	resolved, err := filepath.EvalSymlinks(path)
@@ -589,3 +954,49 @@ func findAbsoluteDeviceByIDPath(volumeName string) (string, error) {
 
 	return resolved, nil
 }
+
+// isReadOnlyAccessMode checks whether the capability only grants read access
+// to the volume.
+func isReadOnlyAccessMode(cap *csi.VolumeCapability) bool {
+	return cap.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+}
+
+// isPublishedReadOnly checks whether ControllerPublishVolume published the
+// volume read-only.
+func (d *Driver) isPublishedReadOnly(publishContext map[string]string) bool {
+	return publishContext[d.publishInfoReadOnly] == "true"
+}
+
+// readOnlyMountOptions returns the options to mount a filesystem of the given
+// type without writing to the device. Mounting read-only alone still replays
+// the journal.
+func readOnlyMountOptions(fsType string) []string {
+	switch fsType {
+	case "ext3", "ext4":
+		return []string{"ro", "noload"}
+	case "xfs":
+		return []string{"ro", "norecovery"}
+	default:
+		return []string{"ro"}
+	}
+}
+
+// applyVolumeMountGroup hands the filesystem mounted at the given path over to
+// the given group unless the filesystem was mounted with the group already.
+func (d *Driver) applyVolumeMountGroup(root, fsType string, gid int, log *logrus.Entry) error {
+	if mountGroupOptionFsTypes[fsType] {
+		return nil
+	}
+
+	log = log.WithField("mount_group", gid)
+	changed, err := d.mounter.ApplyMountGroup(root, gid)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to apply volume mount group %d: %v", gid, err)
+	}
+	if changed {
+		log.Info("changed the group of the filesystem root")
+	} else {
+		log.Debug("filesystem root already belongs to the volume mount group")
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// probingMounter is a fakeMounter that reports the given signatures of
+// devices and records the devices it formats.
+type probingMounter struct {
+	*fakeMounter
+	// signatures maps device paths to their signatures. Devices without a
+	// signature are pristine.
+	signatures map[string]*deviceSignature
+	formatted  map[string]string
+}
+
+func (m *probingMounter) ProbeDevice(source string) (*deviceSignature, error) {
+	if sig, ok := m.signatures[source]; ok {
+		return sig, nil
+	}
+	return &deviceSignature{}, nil
+}
+
+func (m *probingMounter) Format(source string, fsType string, opts ...string) error {
+	m.formatted[source] = fsType
+	m.signatures[source] = &deviceSignature{Type: fsType, Usage: blkidUsageFilesystem}
+	return nil
+}
+
+// recordingFilesystemResizer records the filesystems it grows among the calls
+// of the encryptor, so that the order of both can be checked.
+type recordingFilesystemResizer struct {
+	calls *[]string
+}
+
+func (r *recordingFilesystemResizer) NeedResize(devicePath, deviceMountPath string) (bool, error) {
+	return false, nil
+}
+
+func (r *recordingFilesystemResizer) Resize(devicePath, deviceMountPath string) (bool, error) {
+	*r.calls = append(*r.calls, "resizefs "+devicePath)
+	return true, nil
+}
+
+func newEncryptionTestDriver() (*Driver, *probingMounter, *fakeEncryptor) {
+	m := &probingMounter{
+		fakeMounter: &fakeMounter{mounted: map[string]string{}},
+		signatures:  map[string]*deviceSignature{},
+		formatted:   map[string]string{},
+	}
+	enc := newFakeEncryptor()
+	return &Driver{
+		publishInfoVolumeName: DefaultDriverName + "/volume-name",
+		publishInfoReadOnly:   DefaultDriverName + "/read-only",
+		mounter:               m,
+		encryptor:             enc,
+		deviceResolver:        &fakeDeviceResolver{},
+		fsResizer:             &recordingFilesystemResizer{calls: &enc.calls},
+		log:                   logrus.New().WithField("test_enabled", true),
+	}, m, enc
+}
+
+func TestNodeStageEncryptedVolume(t *testing.T) {
+	const (
+		volumeID   = "3be4aa5b-5fd4-11ea-8bab-0a58ac14c7b2"
+		volumeName = "pvc-encrypted"
+		mapperName = luksMapperPrefix + volumeID
+	)
+	source := filepath.Join(diskIDPath, diskDOPrefix+volumeName)
+	mapperPath := luksMapperPath(mapperName)
+
+	tests := []struct {
+		name string
+		// luks marks the source device as LUKS formatted.
+		luks bool
+		// opened marks the LUKS device as opened already.
+		opened   bool
+		readOnly bool
+		// readerOnly requests the SINGLE_NODE_READER_ONLY access mode.
+		readerOnly bool
+		signatures map[string]*deviceSignature
+		stages     int
+
+		wantCode      codes.Code
+		wantCalls     []string
+		wantFormatted map[string]string
+		wantMounted   bool
+	}{
+		{
+			name:          "blank device",
+			stages:        1,
+			wantCalls:     []string{"format " + source, "open " + mapperName},
+			wantFormatted: map[string]string{mapperPath: defaultFsType},
+			wantMounted:   true,
+		},
+		{
+			name: "unencrypted filesystem",
+			signatures: map[string]*deviceSignature{
+				source: {Type: "ext4", Usage: blkidUsageFilesystem},
+			},
+			stages:        1,
+			wantCode:      codes.FailedPrecondition,
+			wantFormatted: map[string]string{},
+		},
+		{
+			name: "encrypted filesystem",
+			luks: true,
+			signatures: map[string]*deviceSignature{
+				mapperPath: {Type: "ext4", Usage: blkidUsageFilesystem},
+			},
+			stages:        2,
+			wantCalls:     []string{"open " + mapperName},
+			wantFormatted: map[string]string{},
+			wantMounted:   true,
+		},
+		{
+			name:     "read-only",
+			luks:     true,
+			readOnly: true,
+			signatures: map[string]*deviceSignature{
+				mapperPath: {Type: "ext4", Usage: blkidUsageFilesystem},
+			},
+			stages:        1,
+			wantCalls:     []string{"open --readonly " + mapperName},
+			wantFormatted: map[string]string{},
+			wantMounted:   true,
+		},
+		{
+			name:       "read-only access mode",
+			luks:       true,
+			readerOnly: true,
+			signatures: map[string]*deviceSignature{
+				mapperPath: {Type: "ext4", Usage: blkidUsageFilesystem},
+			},
+			stages:        1,
+			wantCalls:     []string{"open --readonly " + mapperName},
+			wantFormatted: map[string]string{},
+			wantMounted:   true,
+		},
+		{
+			name:          "read-only access mode blank device",
+			readerOnly:    true,
+			stages:        1,
+			wantCode:      codes.FailedPrecondition,
+			wantFormatted: map[string]string{},
+		},
+		{
+			name:          "read-only blank device",
+			readOnly:      true,
+			stages:        1,
+			wantCode:      codes.FailedPrecondition,
+			wantFormatted: map[string]string{},
+		},
+		{
+			name:   "opened already",
+			luks:   true,
+			opened: true,
+			signatures: map[string]*deviceSignature{
+				mapperPath: {Type: "ext4", Usage: blkidUsageFilesystem},
+			},
+			stages:        1,
+			wantFormatted: map[string]string{},
+			wantMounted:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, m, enc := newEncryptionTestDriver()
+			if test.luks {
+				enc.luks[source] = true
+			}
+			if test.opened {
+				enc.opened[mapperName] = source
+			}
+			for path, sig := range test.signatures {
+				m.signatures[path] = sig
+			}
+
+			target := filepath.Join(t.TempDir(), "globalmount")
+			req := &csi.NodeStageVolumeRequest{
+				VolumeId:          volumeID,
+				StagingTargetPath: target,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+				PublishContext: map[string]string{d.publishInfoVolumeName: volumeName},
+				VolumeContext:  map[string]string{parameterEncrypted: "true"},
+				Secrets:        map[string]string{secretEncryptionKey: "secret"},
+			}
+			if test.readOnly {
+				req.PublishContext[d.publishInfoReadOnly] = "true"
+			}
+			if test.readerOnly {
+				req.VolumeCapability.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+			}
+
+			var err error
+			for i := 0; i < test.stages && err == nil; i++ {
+				_, err = d.NodeStageVolume(context.Background(), req)
+			}
+			if got := status.Code(err); got != test.wantCode {
+				t.Fatalf("got error code %s (%v), want %s", got, err, test.wantCode)
+			}
+
+			if !reflect.DeepEqual(enc.calls, test.wantCalls) {
+				t.Errorf("got encryptor calls %v, want %v", enc.calls, test.wantCalls)
+			}
+			if !reflect.DeepEqual(m.formatted, test.wantFormatted) {
+				t.Errorf("got formatted devices %v, want %v", m.formatted, test.wantFormatted)
+			}
+			mounted, ok := m.mounted[target]
+			if ok != test.wantMounted {
+				t.Fatalf("got staging path mounted %t, want %t", ok, test.wantMounted)
+			}
+			if ok && mounted != mapperPath {
+				t.Errorf("got %q mounted to the staging path, want %q", mounted, mapperPath)
+			}
+		})
+	}
+}
+
+func TestNodeStageEncryptedVolumeWithoutKey(t *testing.T) {
+	d, _, enc := newEncryptionTestDriver()
+
+	_, err := d.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "3be4aa5b-5fd4-11ea-8bab-0a58ac14c7b2",
+		StagingTargetPath: filepath.Join(t.TempDir(), "globalmount"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+		},
+		PublishContext: map[string]string{d.publishInfoVolumeName: "pvc-encrypted"},
+		VolumeContext:  map[string]string{parameterEncrypted: "true"},
+	})
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Errorf("got error code %s (%v), want %s", got, err, codes.InvalidArgument)
+	}
+	if len(enc.calls) != 0 {
+		t.Errorf("got encryptor calls %v, want none", enc.calls)
+	}
+}
+
+func TestNodeUnstageEncryptedVolume(t *testing.T) {
+	const volumeID = "3be4aa5b-5fd4-11ea-8bab-0a58ac14c7b2"
+	mapperName := luksMapperName(volumeID)
+	target := "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-encrypted/globalmount"
+
+	d, m, enc := newEncryptionTestDriver()
+	enc.luks["/dev/sda"] = true
+	enc.opened[mapperName] = "/dev/sda"
+	m.mounted[target] = luksMapperPath(mapperName)
+
+	req := &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: target,
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.NodeUnstageVolume(context.Background(), req); err != nil {
+			t.Fatalf("got error unstaging: %s", err)
+		}
+	}
+
+	if _, ok := m.mounted[target]; ok {
+		t.Error("got staging path mounted, want unmounted")
+	}
+	want := []string{"close " + mapperName}
+	if !reflect.DeepEqual(enc.calls, want) {
+		t.Errorf("got encryptor calls %v, want %v", enc.calls, want)
+	}
+}
+
+func TestNodeExpandEncryptedVolume(t *testing.T) {
+	const volumeID = "3be4aa5b-5fd4-11ea-8bab-0a58ac14c7b2"
+	mapperName := luksMapperName(volumeID)
+	volumePath := "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-encrypted/mount"
+
+	tests := []struct {
+		name      string
+		encrypted bool
+		wantCalls []string
+	}{
+		{
+			name:      "encrypted",
+			encrypted: true,
+			// the fake mounter reports /mnt/sda1 as device of all mounts
+			wantCalls: []string{"resize " + mapperName, "resizefs /mnt/sda1"},
+		},
+		{
+			name:      "unencrypted",
+			wantCalls: []string{"resizefs /mnt/sda1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, m, enc := newEncryptionTestDriver()
+			m.mounted[volumePath] = "/dev/sda"
+			if test.encrypted {
+				enc.luks["/dev/sda"] = true
+				enc.opened[mapperName] = "/dev/sda"
+			}
+
+			_, err := d.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:   volumeID,
+				VolumePath: volumePath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+				Secrets: map[string]string{secretEncryptionKey: "secret"},
+			})
+			if err != nil {
+				t.Fatalf("got error expanding: %s", err)
+			}
+
+			if !reflect.DeepEqual(enc.calls, test.wantCalls) {
+				t.Errorf("got calls %v, want %v", enc.calls, test.wantCalls)
+			}
+		})
+	}
+}
@@ -25,6 +25,9 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// maxAPIPageSize is the largest page size accepted by the DO API.
+const maxAPIPageSize = 200
+
 type godoLister func(ctx context.Context, listOpts *godo.ListOptions) ([]interface{}, *godo.Response, error)
 
 func listResources(ctx context.Context, log *logrus.Entry, startingToken, maxEntries int32, lister godoLister) ([]interface{}, int32, error) {
@@ -133,3 +136,78 @@ func listResources(ctx context.Context, log *logrus.Entry, startingToken, maxEnt
 
 	return resources, nextToken, nil
 }
+
+// listFilteredResources pages through the resources returned by lister and
+// applies keep to each of them before StartingToken and MaxEntries are
+// evaluated. This is needed whenever a filter cannot be pushed down to the DO
+// API: the page arithmetic in listResources assumes that every resource
+// returned by the API also ends up in the response, which does not hold once
+// resources are dropped in memory.
+func listFilteredResources(ctx context.Context, log *logrus.Entry, startingToken, maxEntries int32, lister godoLister, keep func(interface{}) bool) ([]interface{}, int32, error) {
+	// StartingToken is one-based, with zero denoting the first entry as well.
+	var skip int
+	if startingToken > 0 {
+		skip = int(startingToken) - 1
+	}
+
+	// We need to see every resource up to the last one we return, so use the
+	// largest page size possible to minimize the number of requests.
+	listOpts := &godo.ListOptions{
+		Page:    1,
+		PerPage: maxAPIPageSize,
+	}
+
+	log = log.WithField("filtered", true)
+
+	var (
+		// matched counts all resources passing the filter so far, including
+		// the ones skipped because they precede StartingToken.
+		matched int
+		// hasMore indicates if NextToken must be set.
+		hasMore   bool
+		resources []interface{}
+	)
+	for {
+		res, resp, err := lister(ctx, listOpts)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.Internal, "listing resources failed: %s", err)
+		}
+
+		for _, r := range res {
+			if !keep(r) {
+				continue
+			}
+
+			matched++
+			if matched <= skip {
+				continue
+			}
+
+			if maxEntries > 0 && len(resources) == int(maxEntries) {
+				hasMore = true
+				break
+			}
+			resources = append(resources, r)
+		}
+
+		if hasMore || resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		listOpts.Page = page + 1
+	}
+
+	log.WithField("num_matched", matched).Debug("filtered resources listed")
+
+	var nextToken int32
+	if hasMore {
+		nextToken = int32(skip + len(resources) + 1)
+	}
+
+	return resources, nextToken, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	// defaultFsType is the filesystem used if none is specified in the volume
+	// capability.
+	defaultFsType = "ext4"
+
+	// parameterPreformat is the StorageClass parameter that defines whether
+	// DO should format new volumes at creation time. It overrides the
+	// driver-wide default.
+	parameterPreformat = DefaultDriverName + "/preformat"
+
+	// parameterFsLabel is the StorageClass parameter that defines the
+	// filesystem label DO sets when it formats new volumes.
+	parameterFsLabel = DefaultDriverName + "/fs-label"
+
+	// parameterEncrypted is the StorageClass parameter that enables LUKS
+	// encryption of volumes by the node service.
+	parameterEncrypted = DefaultDriverName + "/encrypted"
+
+	// secretEncryptionKey is the key of the node stage and node expand secret
+	// entry that holds the LUKS passphrase of encrypted volumes.
+	secretEncryptionKey = "encryptionKey"
+
+	// volumeContextPreformattedFsType is used to pass the filesystem type a
+	// volume was formatted with by DO from `CreateVolume` to
+	// `NodeStageVolume`.
+	volumeContextPreformattedFsType = DefaultDriverName + "/preformatted-fs-type"
+)
+
+var (
+	// volumeContextParameters lists the StorageClass parameters that are
+	// passed on to the node service through the volume context.
+	volumeContextParameters = append([]string{
+		parameterEncrypted,
+		parameterFsckPolicy,
+		parameterFormatPolicy,
+		parameterRequireVolumeLabel,
+		parameterTrim,
+	}, mkfsParameters...)
+
+	// preformatFsTypes lists the filesystem types DO can format volumes with,
+	// mapped to the maximum filesystem label length.
+	preformatFsTypes = map[string]int{
+		"ext4": 16,
+		"xfs":  12,
+	}
+)
+
+// boolParameter parses the boolean parameter with the given key. It returns
+// the default value if the parameter is not set.
+func boolParameter(params map[string]string, key string, defaultValue bool) (bool, error) {
+	val, ok := params[key]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("parameter %q must be a boolean, got %q", key, val)
+	}
+	return b, nil
+}
+
+// requestedFsType returns the filesystem type requested by the given volume
+// capabilities. It returns an empty string if only block access is requested.
+func requestedFsType(caps []*csi.VolumeCapability) string {
+	for _, cap := range caps {
+		mnt := cap.GetMount()
+		if mnt == nil {
+			continue
+		}
+		if mnt.FsType != "" {
+			return mnt.FsType
+		}
+		return defaultFsType
+	}
+	return ""
+}
+
+// newVolumeContext returns the volume context for a volume created with the
+// given parameters and formatted by DO with the given filesystem type, if
+// any.
+func newVolumeContext(params map[string]string, preformattedFsType string) map[string]string {
+	volCtx := map[string]string{}
+	for _, key := range volumeContextParameters {
+		if val, ok := params[key]; ok {
+			volCtx[key] = val
+		}
+	}
+
+	if preformattedFsType != "" {
+		volCtx[volumeContextPreformattedFsType] = preformattedFsType
+	}
+
+	if len(volCtx) == 0 {
+		return nil
+	}
+	return volCtx
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// probeHeadSize is the number of bytes read from the start of a device
+	// to probe for signatures. It covers the btrfs superblock at 64 KiB.
+	probeHeadSize = 128 * 1024
+
+	extSuperblockOffset     = 1024
+	extMagic                = 0xEF53
+	extFeatureCompatJournal = 0x4
+	extFeatureIncompatJdev  = 0x8
+	// ext3 supports only these features; anything beyond makes it ext4
+	ext3FeatureIncompatSupp = 0x2 | 0x4 | 0x10
+	ext3FeatureRoCompatSupp = 0x1 | 0x2 | 0x4
+
+	btrfsSuperblockOffset = 64 * 1024
+
+	mdMagic = 0xa92b4efc
+)
+
+var (
+	luksMagic  = []byte("LUKS\xba\xbe")
+	xfsMagic   = []byte("XFSB")
+	btrfsMagic = []byte("_BHRfS_M")
+	lvmLabel   = []byte("LABELONE")
+	lvmType    = []byte("LVM2 001")
+	gptMagic   = []byte("EFI PART")
+	swapMagics = [][]byte{[]byte("SWAPSPACE2"), []byte("SWAP-SPACE")}
+)
+
+// probeDeviceSignature probes the device of the given size for the
+// filesystem, partition table, and other signatures the driver knows about.
+// It returns nil if no known signature was found on a device that is not
+// blank either, in which case the device must be probed by blkid.
+func probeDeviceSignature(dev io.ReaderAt, size int64) (*deviceSignature, error) {
+	headSize := int64(probeHeadSize)
+	if size < headSize {
+		headSize = size
+	}
+	head := make([]byte, headSize)
+	if _, err := dev.ReadAt(head, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if sig := probeHead(head); sig != nil {
+		return sig, nil
+	}
+
+	// md superblocks of format 0.90 and 1.0 live at the end of the device
+	for _, off := range mdEndSuperblockOffsets(size) {
+		magic := make([]byte, 4)
+		if _, err := dev.ReadAt(magic, off); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint32(magic) == mdMagic {
+			return &deviceSignature{Type: "linux_raid_member", Usage: "raid"}, nil
+		}
+	}
+
+	if isZero(head) {
+		return &deviceSignature{}, nil
+	}
+	return nil, nil
+}
+
+// probeHead probes the start of a device for known signatures.
+func probeHead(head []byte) *deviceSignature {
+	at := func(off int, magic []byte) bool {
+		return len(head) >= off+len(magic) && bytes.Equal(head[off:off+len(magic)], magic)
+	}
+	label := func(off, n int) string {
+		if len(head) < off+n {
+			return ""
+		}
+		return cString(head[off : off+n])
+	}
+
+	switch {
+	case at(0, luksMagic):
+		return &deviceSignature{Type: "crypto_LUKS", Usage: "crypto"}
+	case at(0, xfsMagic):
+		return &deviceSignature{Type: "xfs", Usage: blkidUsageFilesystem, Label: label(108, 12)}
+	}
+
+	if sig := probeExt(head); sig != nil {
+		return sig
+	}
+
+	if at(btrfsSuperblockOffset+0x40, btrfsMagic) {
+		return &deviceSignature{Type: "btrfs", Usage: blkidUsageFilesystem, Label: label(btrfsSuperblockOffset+0x12b, 256)}
+	}
+
+	for _, pageSize := range []int{4096, 8192, 16384, 65536} {
+		for _, magic := range swapMagics {
+			if at(pageSize-len(magic), magic) {
+				return &deviceSignature{Type: "swap", Usage: "other"}
+			}
+		}
+	}
+
+	// the LVM label may be in any of the first four sectors
+	for sector := 0; sector < 4; sector++ {
+		if at(sector*512, lvmLabel) && at(sector*512+0x18, lvmType) {
+			return &deviceSignature{Type: "LVM2_member", Usage: "raid"}
+		}
+	}
+
+	// md superblocks of format 1.1 and 1.2
+	for _, off := range []int{0, 4096} {
+		if len(head) >= off+4 && binary.LittleEndian.Uint32(head[off:]) == mdMagic {
+			return &deviceSignature{Type: "linux_raid_member", Usage: "raid"}
+		}
+	}
+
+	if at(512, gptMagic) || at(4096, gptMagic) {
+		return &deviceSignature{PartitionTable: "gpt"}
+	}
+
+	if len(head) >= 512 && head[510] == 0x55 && head[511] == 0xaa {
+		// only treat the boot signature as a partition table if any of the
+		// four primary partitions is in use
+		for i := 0; i < 4; i++ {
+			if head[446+16*i+4] != 0 {
+				return &deviceSignature{PartitionTable: "dos"}
+			}
+		}
+	}
+
+	return nil
+}
+
+// probeExt detects ext2, ext3, and ext4 filesystems the way blkid tells them
+// apart, based on their feature flags.
+func probeExt(head []byte) *deviceSignature {
+	if len(head) < extSuperblockOffset+1024 {
+		return nil
+	}
+	sb := head[extSuperblockOffset : extSuperblockOffset+1024]
+	if binary.LittleEndian.Uint16(sb[0x38:]) != extMagic {
+		return nil
+	}
+
+	compat := binary.LittleEndian.Uint32(sb[0x5c:])
+	incompat := binary.LittleEndian.Uint32(sb[0x60:])
+	roCompat := binary.LittleEndian.Uint32(sb[0x64:])
+	label := cString(sb[0x78 : 0x78+16])
+
+	switch {
+	case incompat&extFeatureIncompatJdev != 0:
+		return &deviceSignature{Type: "jbd", Usage: "other", Label: label}
+	case incompat&^ext3FeatureIncompatSupp != 0 || roCompat&^ext3FeatureRoCompatSupp != 0:
+		return &deviceSignature{Type: "ext4", Usage: blkidUsageFilesystem, Label: label}
+	case compat&extFeatureCompatJournal != 0:
+		return &deviceSignature{Type: "ext3", Usage: blkidUsageFilesystem, Label: label}
+	}
+	return &deviceSignature{Type: "ext2", Usage: blkidUsageFilesystem, Label: label}
+}
+
+// mdEndSuperblockOffsets returns the offsets of the md superblocks of format
+// 0.90 and 1.0 on a device of the given size.
+func mdEndSuperblockOffsets(size int64) []int64 {
+	if size < probeHeadSize {
+		return nil
+	}
+	return []int64{
+		(size &^ (64*1024 - 1)) - 64*1024,
+		(size - 8*1024) &^ (4*1024 - 1),
+	}
+}
+
+// cString returns the NUL-terminated string at the start of b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
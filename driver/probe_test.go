@@ -0,0 +1,149 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestProbeDeviceSignature(t *testing.T) {
+	const size = 1024 * 1024
+
+	extDevice := func(compat, incompat, roCompat uint32, label string) []byte {
+		dev := make([]byte, size)
+		sb := dev[extSuperblockOffset:]
+		binary.LittleEndian.PutUint16(sb[0x38:], extMagic)
+		binary.LittleEndian.PutUint32(sb[0x5c:], compat)
+		binary.LittleEndian.PutUint32(sb[0x60:], incompat)
+		binary.LittleEndian.PutUint32(sb[0x64:], roCompat)
+		copy(sb[0x78:], label)
+		return dev
+	}
+
+	deviceWith := func(off int, data []byte) []byte {
+		dev := make([]byte, size)
+		copy(dev[off:], data)
+		return dev
+	}
+
+	mdMagicBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(mdMagicBytes, mdMagic)
+
+	mbr := make([]byte, 512)
+	mbr[446+4] = 0x83
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	lvm := make([]byte, 32)
+	copy(lvm, lvmLabel)
+	copy(lvm[0x18:], lvmType)
+
+	xfs := make([]byte, 120)
+	copy(xfs, xfsMagic)
+	copy(xfs[108:], "data")
+
+	tests := []struct {
+		name    string
+		dev     []byte
+		wantSig *deviceSignature
+	}{
+		{
+			name:    "blank",
+			dev:     make([]byte, size),
+			wantSig: &deviceSignature{},
+		},
+		{
+			name:    "unknown data",
+			dev:     deviceWith(8192, []byte("some data")),
+			wantSig: nil,
+		},
+		{
+			name:    "ext4",
+			dev:     extDevice(extFeatureCompatJournal, 0x2|0x40, 0x1, "data"),
+			wantSig: &deviceSignature{Type: "ext4", Usage: "filesystem", Label: "data"},
+		},
+		{
+			name:    "ext3",
+			dev:     extDevice(extFeatureCompatJournal, 0x2, 0x1, ""),
+			wantSig: &deviceSignature{Type: "ext3", Usage: "filesystem"},
+		},
+		{
+			name:    "ext2",
+			dev:     extDevice(0, 0x2, 0x1, ""),
+			wantSig: &deviceSignature{Type: "ext2", Usage: "filesystem"},
+		},
+		{
+			name:    "xfs",
+			dev:     deviceWith(0, xfs),
+			wantSig: &deviceSignature{Type: "xfs", Usage: "filesystem", Label: "data"},
+		},
+		{
+			name:    "btrfs",
+			dev:     deviceWith(btrfsSuperblockOffset+0x40, btrfsMagic),
+			wantSig: &deviceSignature{Type: "btrfs", Usage: "filesystem"},
+		},
+		{
+			name:    "LUKS",
+			dev:     deviceWith(0, luksMagic),
+			wantSig: &deviceSignature{Type: "crypto_LUKS", Usage: "crypto"},
+		},
+		{
+			name:    "LVM",
+			dev:     deviceWith(512, lvm),
+			wantSig: &deviceSignature{Type: "LVM2_member", Usage: "raid"},
+		},
+		{
+			name:    "md 1.2",
+			dev:     deviceWith(4096, mdMagicBytes),
+			wantSig: &deviceSignature{Type: "linux_raid_member", Usage: "raid"},
+		},
+		{
+			name:    "md 1.0",
+			dev:     deviceWith(int(mdEndSuperblockOffsets(size)[1]), mdMagicBytes),
+			wantSig: &deviceSignature{Type: "linux_raid_member", Usage: "raid"},
+		},
+		{
+			name:    "swap",
+			dev:     deviceWith(4096-10, []byte("SWAPSPACE2")),
+			wantSig: &deviceSignature{Type: "swap", Usage: "other"},
+		},
+		{
+			name:    "GPT",
+			dev:     deviceWith(512, gptMagic),
+			wantSig: &deviceSignature{PartitionTable: "gpt"},
+		},
+		{
+			name:    "MBR",
+			dev:     deviceWith(0, mbr),
+			wantSig: &deviceSignature{PartitionTable: "dos"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sig, err := probeDeviceSignature(bytes.NewReader(test.dev), int64(len(test.dev)))
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+			if !reflect.DeepEqual(sig, test.wantSig) {
+				t.Errorf("got signature %+v, want %+v", sig, test.wantSig)
+			}
+		})
+	}
+}
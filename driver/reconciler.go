@@ -0,0 +1,389 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultKubeletDir is the root directory of the kubelet, which holds the
+	// staging and publish paths of CSI volumes.
+	defaultKubeletDir = "/var/lib/kubelet"
+
+	// volDataFileName is the file the kubelet records the driver of a CSI
+	// volume in, next to the volume's staging or publish path.
+	volDataFileName = "vol_data.json"
+
+	// mountStatTimeout bounds how long the reconciler waits for a mount to
+	// respond before considering it hung.
+	mountStatTimeout = 5 * time.Second
+
+	// reconcileTimeout bounds the startup reconciliation as a whole.
+	reconcileTimeout = 2 * time.Minute
+
+	mountKindStaging = "staging"
+	mountKindPublish = "publish"
+)
+
+// reconcileReport describes the outcome of a mount reconciliation.
+type reconcileReport struct {
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+	Checked    int               `json:"checked"`
+	Mounts     []reconciledMount `json:"mounts"`
+	Files      []reconciledFile  `json:"files"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// reconciledMount describes a stale mount found by the reconciler.
+type reconciledMount struct {
+	Path   string `json:"path"`
+	Source string `json:"source"`
+	Kind   string `json:"kind"`
+	Reason string `json:"reason"`
+	// Action is what the reconciler did about the mount (unmounted,
+	// skipped, or failed).
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// reconciledFile describes an orphaned block volume target file found by the
+// reconciler.
+type reconciledFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// mountReconciler cleans up this driver's staging and publish mounts whose
+// devices vanished or fail with I/O errors, e.g., after a node plugin restart
+// or crash, as well as orphaned block volume target files.
+type mountReconciler struct {
+	log        *logrus.Entry
+	driverName string
+	mounter    Mounter
+	encryptor  Encryptor
+
+	mountInfoPath string
+	kubeletDir    string
+	sysPath       string
+	statTimeout   time.Duration
+	statfs        func(path string, buf *unix.Statfs_t) error
+
+	mu     sync.Mutex
+	report *reconcileReport
+}
+
+// newMountReconciler returns a new mountReconciler operating on the host's
+// kubelet directory.
+func newMountReconciler(log *logrus.Entry, driverName string, mounter Mounter, encryptor Encryptor) *mountReconciler {
+	return &mountReconciler{
+		log:           log.WithField("component", "mount_reconciler"),
+		driverName:    driverName,
+		mounter:       mounter,
+		encryptor:     encryptor,
+		mountInfoPath: procMountInfoPath,
+		kubeletDir:    defaultKubeletDir,
+		sysPath:       "/sys",
+		statTimeout:   mountStatTimeout,
+		statfs:        unix.Statfs,
+	}
+}
+
+// Reconcile finds and cleans up stale mounts and orphaned target files. The
+// outcome is logged and kept for the debug endpoint.
+func (r *mountReconciler) Reconcile(ctx context.Context) *reconcileReport {
+	report := &reconcileReport{
+		StartedAt: time.Now(),
+		Mounts:    []reconciledMount{},
+		Files:     []reconciledFile{},
+	}
+	defer func() {
+		report.FinishedAt = time.Now()
+		r.mu.Lock()
+		r.report = report
+		r.mu.Unlock()
+	}()
+
+	r.log.Info("reconciling staging and publish mounts")
+
+	infos, err := readMountInfo(r.mountInfoPath)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to read mounts: %s", err))
+		r.log.WithError(err).Error("failed to read mounts, skipping reconciliation")
+		return report
+	}
+
+	owned := ownedMounts(r.kubeletDir, r.driverName, infos)
+	// unmount publish mounts before the staging mounts they were bind
+	// mounted from
+	sort.SliceStable(owned, func(i, j int) bool {
+		return owned[i].kind == mountKindPublish && owned[j].kind == mountKindStaging
+	})
+
+	mounted := map[string]bool{}
+	for _, info := range infos {
+		mounted[info.MountPoint] = true
+	}
+
+	for _, m := range owned {
+		if ctx.Err() != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("reconciliation aborted: %s", ctx.Err()))
+			break
+		}
+
+		report.Checked++
+		reason := r.staleReason(m.info)
+		if reason == "" {
+			continue
+		}
+
+		rm := reconciledMount{
+			Path:   m.info.MountPoint,
+			Source: m.info.Source,
+			Kind:   m.kind,
+			Reason: reason,
+		}
+		log := r.log.WithFields(logrus.Fields{
+			"path":   rm.Path,
+			"source": rm.Source,
+			"kind":   rm.Kind,
+			"reason": rm.Reason,
+		})
+
+		if reason == staleReasonHung {
+			// unmounting a hung mount may block as well; leave it to an
+			// operator
+			rm.Action = "skipped"
+			log.Warn("mount is not responding, not cleaning it up")
+			report.Mounts = append(report.Mounts, rm)
+			continue
+		}
+
+		if err := r.mounter.Unmount(rm.Path); err != nil {
+			rm.Action = "failed"
+			rm.Error = err.Error()
+			log.WithError(err).Error("failed to unmount stale mount")
+			report.Mounts = append(report.Mounts, rm)
+			continue
+		}
+		rm.Action = "unmounted"
+		delete(mounted, rm.Path)
+		log.Warn("unmounted stale mount")
+
+		if m.kind == mountKindStaging && strings.HasPrefix(rm.Source, mapperDir+"/"+luksMapperPrefix) {
+			mapperName := filepath.Base(rm.Source)
+			if err := r.encryptor.LuksClose(mapperName); err != nil {
+				rm.Error = fmt.Sprintf("failed to close LUKS device: %s", err)
+				log.WithError(err).Error("failed to close LUKS device of stale mount")
+			}
+		}
+		report.Mounts = append(report.Mounts, rm)
+	}
+
+	report.Files = r.removeOrphanedBlockTargets(mounted)
+
+	r.log.WithFields(logrus.Fields{
+		"checked":       report.Checked,
+		"stale_mounts":  len(report.Mounts),
+		"removed_files": len(report.Files),
+		"errors":        len(report.Errors),
+	}).Info("reconciled staging and publish mounts")
+	return report
+}
+
+// Report returns the outcome of the last reconciliation, if any.
+func (r *mountReconciler) Report() *reconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.report
+}
+
+// ServeHTTP serves the outcome of the last reconciliation as JSON.
+func (r *mountReconciler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Report()
+	if report == nil {
+		http.Error(w, "mounts have not been reconciled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		r.log.WithError(err).Error("failed to encode reconcile report")
+	}
+}
+
+type ownedMount struct {
+	info mountInfo
+	kind string
+}
+
+// ownedMounts returns the staging and publish mounts of the given driver
+// below the given kubelet directory.
+func ownedMounts(kubeletDir, driverName string, infos []mountInfo) []ownedMount {
+	csiPluginDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+	blockPublishDir := filepath.Join(csiPluginDir, "volumeDevices", "publish")
+	podsDir := filepath.Join(kubeletDir, "pods")
+
+	var owned []ownedMount
+	for _, info := range infos {
+		path := info.MountPoint
+		switch {
+		case strings.HasPrefix(path, blockPublishDir+"/"):
+			// .../volumeDevices/publish/<pv>/<pod uid>
+			pvName := filepath.Base(filepath.Dir(path))
+			volData := filepath.Join(csiPluginDir, "volumeDevices", pvName, "data", volDataFileName)
+			if isOwnVolData(driverName, volData) {
+				owned = append(owned, ownedMount{info: info, kind: mountKindPublish})
+			}
+		case strings.HasPrefix(path, csiPluginDir+"/") && filepath.Base(path) == "globalmount":
+			// .../csi/<driver>/<hash>/globalmount or .../csi/pv/<pv>/globalmount
+			if strings.HasPrefix(path, filepath.Join(csiPluginDir, driverName)+"/") ||
+				isOwnVolData(driverName, filepath.Join(filepath.Dir(path), volDataFileName)) {
+				owned = append(owned, ownedMount{info: info, kind: mountKindStaging})
+			}
+		case strings.HasPrefix(path, podsDir+"/") && strings.Contains(path, "/volumes/kubernetes.io~csi/"):
+			// .../pods/<pod uid>/volumes/kubernetes.io~csi/<pv>/mount
+			if isOwnVolData(driverName, filepath.Join(filepath.Dir(path), volDataFileName)) {
+				owned = append(owned, ownedMount{info: info, kind: mountKindPublish})
+			}
+		}
+	}
+	return owned
+}
+
+// volData is the part of a kubelet volume data file the driver cares about.
+type volData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// readVolData reads the kubelet volume data file at the given path.
+func readVolData(path string) (volData, error) {
+	var data volData
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return data, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return data, nil
+}
+
+// isOwnVolData checks whether the kubelet volume data file at the given path
+// belongs to a volume of the given driver.
+func isOwnVolData(driverName, path string) bool {
+	data, err := readVolData(path)
+	if err != nil {
+		return false
+	}
+	return data.DriverName == driverName
+}
+
+const (
+	staleReasonDeviceVanished = "device vanished"
+	staleReasonDeviceOffline  = "device offline"
+	staleReasonIOError        = "I/O error"
+	staleReasonHung           = "mount not responding"
+)
+
+// staleReason returns why the given mount is stale, or an empty string if it
+// is healthy.
+func (r *mountReconciler) staleReason(info mountInfo) string {
+	devDir := filepath.Join(r.sysPath, "dev", "block", fmt.Sprintf("%d:%d", info.Major, info.Minor))
+	if info.FsType == "devtmpfs" {
+		// block volumes are bind mounted from devtmpfs, with the device as
+		// the root of the mount, so the mount carries the dev number of
+		// devtmpfs rather than the one of the device
+		devDir = filepath.Join(r.sysPath, "class", "block", filepath.Base(info.Root))
+	}
+	if reason := blockDeviceProblem(devDir); reason != "" {
+		return reason
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		var statfs unix.Statfs_t
+		errCh <- r.statfs(info.MountPoint, &statfs)
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, unix.EIO) || errors.Is(err, unix.ENOTCONN) || errors.Is(err, unix.ENXIO) || errors.Is(err, unix.ESTALE) {
+			return staleReasonIOError
+		}
+	case <-time.After(r.statTimeout):
+		return staleReasonHung
+	}
+
+	return ""
+}
+
+// removeOrphanedBlockTargets removes the target files of this driver's block
+// volumes that are not mounted anymore.
+func (r *mountReconciler) removeOrphanedBlockTargets(mounted map[string]bool) []reconciledFile {
+	csiPluginDir := filepath.Join(r.kubeletDir, "plugins", "kubernetes.io", "csi")
+	targets, err := filepath.Glob(filepath.Join(csiPluginDir, "volumeDevices", "publish", "*", "*"))
+	if err != nil {
+		return nil
+	}
+
+	files := []reconciledFile{}
+	for _, target := range targets {
+		if mounted[target] {
+			continue
+		}
+
+		pvName := filepath.Base(filepath.Dir(target))
+		if !isOwnVolData(r.driverName, filepath.Join(csiPluginDir, "volumeDevices", pvName, "data", volDataFileName)) {
+			continue
+		}
+
+		// target files are created empty for bind mounting the device
+		fi, err := os.Lstat(target)
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() != 0 {
+			continue
+		}
+
+		rf := reconciledFile{Path: target, Action: "removed"}
+		log := r.log.WithField("path", target)
+		if err := os.Remove(target); err != nil {
+			rf.Action = "failed"
+			rf.Error = err.Error()
+			log.WithError(err).Error("failed to remove orphaned block volume target file")
+		} else {
+			log.Warn("removed orphaned block volume target file")
+		}
+		files = append(files, rf)
+	}
+	return files
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func TestMountReconciler(t *testing.T) {
+	root := t.TempDir()
+	kubeletDir := filepath.Join(root, "kubelet")
+	sysPath := filepath.Join(root, "sys")
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+
+	volData := func(t *testing.T, dir, driverName string) {
+		mustMkdirAll(t, dir)
+		mustWriteFile(t, filepath.Join(dir, volDataFileName), fmt.Sprintf(`{"driverName":%q}`, driverName))
+	}
+	device := func(t *testing.T, majorMinor, state string) {
+		devDir := filepath.Join(sysPath, "dev", "block", majorMinor)
+		mustMkdirAll(t, filepath.Join(devDir, "device"))
+		mustWriteFile(t, filepath.Join(devDir, "device", "state"), state+"\n")
+	}
+	blockDevice := func(t *testing.T, name, state string) {
+		devDir := filepath.Join(sysPath, "class", "block", name)
+		mustMkdirAll(t, filepath.Join(devDir, "device"))
+		mustWriteFile(t, filepath.Join(devDir, "device", "state"), state+"\n")
+	}
+
+	// healthy volume on 8:0
+	healthyStaging := filepath.Join(csiDir, DefaultDriverName, "aaa", "globalmount")
+	healthyPublish := filepath.Join(kubeletDir, "pods", "pod1", "volumes", "kubernetes.io~csi", "pvc-1", "mount")
+	volData(t, filepath.Dir(healthyPublish), DefaultDriverName)
+	device(t, "8:0", "running")
+
+	// volume whose device vanished on 8:16
+	vanishedStaging := filepath.Join(csiDir, DefaultDriverName, "bbb", "globalmount")
+	vanishedPublish := filepath.Join(kubeletDir, "pods", "pod2", "volumes", "kubernetes.io~csi", "pvc-2", "mount")
+	volData(t, filepath.Dir(vanishedPublish), DefaultDriverName)
+
+	// volume whose device is offline on 8:32, staged by an older kubelet
+	offlineStaging := filepath.Join(csiDir, "pv", "pvc-3", "globalmount")
+	volData(t, filepath.Dir(offlineStaging), DefaultDriverName)
+	device(t, "8:32", "offline")
+
+	// volume failing with I/O errors on 8:48
+	ioErrorStaging := filepath.Join(csiDir, DefaultDriverName, "ddd", "globalmount")
+	device(t, "8:48", "running")
+
+	// block volume whose device sde vanished
+	blockPublish := filepath.Join(csiDir, "volumeDevices", "publish", "pvc-5", "pod5")
+	volData(t, filepath.Join(csiDir, "volumeDevices", "pvc-5", "data"), DefaultDriverName)
+
+	// healthy block volume on sdg
+	healthyBlockPublish := filepath.Join(csiDir, "volumeDevices", "publish", "pvc-9", "pod9")
+	volData(t, filepath.Join(csiDir, "volumeDevices", "pvc-9", "data"), DefaultDriverName)
+	blockDevice(t, "sdg", "running")
+
+	// orphaned block target file of this driver, and one of another driver
+	orphanedTarget := filepath.Join(csiDir, "volumeDevices", "publish", "pvc-6", "pod6")
+	volData(t, filepath.Join(csiDir, "volumeDevices", "pvc-6", "data"), DefaultDriverName)
+	mustMkdirAll(t, filepath.Dir(orphanedTarget))
+	mustWriteFile(t, orphanedTarget, "")
+	foreignTarget := filepath.Join(csiDir, "volumeDevices", "publish", "pvc-7", "pod7")
+	volData(t, filepath.Join(csiDir, "volumeDevices", "pvc-7", "data"), "other.csi.example.com")
+	mustMkdirAll(t, filepath.Dir(foreignTarget))
+	mustWriteFile(t, foreignTarget, "")
+
+	// publish mount of another driver on a vanished device on 8:80
+	foreignPublish := filepath.Join(kubeletDir, "pods", "pod8", "volumes", "kubernetes.io~csi", "pvc-8", "mount")
+	volData(t, filepath.Dir(foreignPublish), "other.csi.example.com")
+
+	mountInfo := strings.Join([]string{
+		"22 1 252:1 / / rw shared:1 - ext4 /dev/vda1 rw",
+		"30 22 8:0 / " + healthyStaging + " rw shared:2 - ext4 /dev/sda rw",
+		"31 22 8:16 / " + vanishedStaging + " rw shared:3 - ext4 /dev/sdb rw",
+		"32 22 8:32 / " + offlineStaging + " rw shared:4 - ext4 /dev/sdc rw",
+		"33 22 8:48 / " + ioErrorStaging + " rw shared:5 - ext4 /dev/sdd rw",
+		"34 22 8:0 / " + healthyPublish + " rw shared:2 - ext4 /dev/sda rw",
+		"35 22 8:16 / " + vanishedPublish + " rw shared:3 - ext4 /dev/sdb rw",
+		"36 22 0:5 /sde " + blockPublish + " rw shared:6 - devtmpfs udev rw",
+		"37 22 8:80 / " + foreignPublish + " rw shared:7 - ext4 /dev/sdf rw",
+		"38 22 0:5 /sdg " + healthyBlockPublish + " rw shared:6 - devtmpfs udev rw",
+	}, "\n")
+	mountInfoPath := filepath.Join(root, "mountinfo")
+	mustWriteFile(t, mountInfoPath, mountInfo)
+
+	unmounted := []string{}
+	m := &fakeReconcilerMounter{unmount: func(target string) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}}
+
+	r := newMountReconciler(logrus.New().WithField("test_enabled", true), DefaultDriverName, m, newFakeEncryptor())
+	r.mountInfoPath = mountInfoPath
+	r.kubeletDir = kubeletDir
+	r.sysPath = sysPath
+	r.statfs = func(path string, buf *unix.Statfs_t) error {
+		if path == ioErrorStaging {
+			return unix.EIO
+		}
+		return nil
+	}
+
+	report := r.Reconcile(context.Background())
+
+	if report.Checked != 8 {
+		t.Errorf("got %d checked mounts, want 8", report.Checked)
+	}
+
+	wantUnmounted := []string{vanishedPublish, blockPublish, vanishedStaging, offlineStaging, ioErrorStaging}
+	if strings.Join(unmounted, ",") != strings.Join(wantUnmounted, ",") {
+		t.Errorf("got unmounted\n%s\nwant\n%s", strings.Join(unmounted, "\n"), strings.Join(wantUnmounted, "\n"))
+	}
+
+	reasons := map[string]string{}
+	for _, rm := range report.Mounts {
+		reasons[rm.Path] = rm.Reason
+		if rm.Action != "unmounted" {
+			t.Errorf("got action %q for %q, want unmounted", rm.Action, rm.Path)
+		}
+	}
+	for path, want := range map[string]string{
+		vanishedStaging: staleReasonDeviceVanished,
+		offlineStaging:  staleReasonDeviceOffline,
+		ioErrorStaging:  staleReasonIOError,
+		blockPublish:    staleReasonDeviceVanished,
+	} {
+		if reasons[path] != want {
+			t.Errorf("got reason %q for %q, want %q", reasons[path], path, want)
+		}
+	}
+
+	var removed []string
+	for _, f := range report.Files {
+		removed = append(removed, f.Path)
+	}
+	sort.Strings(removed)
+	if len(removed) != 1 || removed[0] != orphanedTarget {
+		t.Errorf("got removed files %v, want %v", removed, []string{orphanedTarget})
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reconcile", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	var served reconcileReport
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatalf("failed to decode report: %s", err)
+	}
+	if len(served.Mounts) != len(report.Mounts) {
+		t.Errorf("got %d mounts in served report, want %d", len(served.Mounts), len(report.Mounts))
+	}
+}
+
+func TestMountReconcilerNoReport(t *testing.T) {
+	r := newMountReconciler(logrus.New().WithField("test_enabled", true), DefaultDriverName, &fakeReconcilerMounter{}, newFakeEncryptor())
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reconcile", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+type fakeReconcilerMounter struct {
+	fakeMounter
+	unmount func(target string) error
+}
+
+func (f *fakeReconcilerMounter) Unmount(target string) error {
+	return f.unmount(target)
+}
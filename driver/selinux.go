@@ -0,0 +1,87 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selinuxContextOption is the mount option that labels all files of a
+// filesystem with the given SELinux context. Kubelet passes it for volumes
+// of drivers with `seLinuxMount` enabled in their CSIDriver object, so that
+// the container runtime does not need to relabel each file.
+const selinuxContextOption = "context="
+
+// splitSELinuxContext splits the SELinux context option off the given mount
+// options. It returns the unquoted context, or an empty string if there is
+// none, and the remaining options.
+func splitSELinuxContext(options []string) (string, []string) {
+	var context string
+	rest := make([]string, 0, len(options))
+	for _, opt := range options {
+		if c, ok := strings.CutPrefix(opt, selinuxContextOption); ok {
+			context = unquoteSELinuxContext(c)
+			continue
+		}
+		rest = append(rest, opt)
+	}
+	return context, rest
+}
+
+// unquoteSELinuxContext strips the double quotes that protect the commas of
+// SELinux contexts with multiple categories.
+func unquoteSELinuxContext(context string) string {
+	return strings.Trim(context, `"`)
+}
+
+// checkSELinuxContext checks that a volume mounted with the given SELinux
+// context can be used with the requested one. The context of a filesystem
+// can only be set when it is first mounted, so a volume staged with one
+// context, or without any, cannot be published with another.
+func checkSELinuxContext(mounted, requested string) error {
+	if requested == "" || mounted == requested {
+		return nil
+	}
+	if mounted == "" {
+		return fmt.Errorf("volume is mounted without an SELinux context, but context %q was requested", requested)
+	}
+	return fmt.Errorf("volume is mounted with SELinux context %q, but context %q was requested", mounted, requested)
+}
+
+// mountContext returns the SELinux context of the filesystem mounted at the
+// given target according to the given mountinfo file.
+func mountContext(mountInfoPath, target string) (string, error) {
+	infos, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return "", err
+	}
+
+	var context string
+	found := false
+	for _, info := range infos {
+		// the last entry is the one visible at the target
+		if info.MountPoint == target {
+			context = info.selinuxContext()
+			found = true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("target %q is not mounted", target)
+	}
+	return context, nil
+}
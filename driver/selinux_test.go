@@ -0,0 +1,112 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testSELinuxMountInfo = `22 1 252:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw,seclabel
+36 22 8:0 / /staging/a rw,relatime shared:120 - ext4 /dev/sda rw,seclabel,context="system_u:object_r:container_file_t:s0:c1,c2",errors=remount-ro
+37 22 8:16 / /staging/b rw,relatime shared:121 - xfs /dev/sdb rw,seclabel,context=system_u:object_r:container_file_t:s0
+38 22 8:32 / /staging/c rw,relatime shared:122 - ext4 /dev/sdc rw,seclabel
+`
+
+func TestMountContext(t *testing.T) {
+	mountInfoPath := filepath.Join(t.TempDir(), "mountinfo")
+	mustWriteFile(t, mountInfoPath, testSELinuxMountInfo)
+
+	tests := []struct {
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{target: "/staging/a", want: "system_u:object_r:container_file_t:s0:c1,c2"},
+		{target: "/staging/b", want: "system_u:object_r:container_file_t:s0"},
+		{target: "/staging/c", want: ""},
+		{target: "/staging/d", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			got, err := mountContext(mountInfoPath, test.target)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got context %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitMountOptions(t *testing.T) {
+	got := splitMountOptions(`rw,seclabel,context="system_u:object_r:container_file_t:s0:c1,c2",errors=remount-ro`)
+	want := []string{"rw", "seclabel", `context="system_u:object_r:container_file_t:s0:c1,c2"`, "errors=remount-ro"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got options %q, want %q", got, want)
+	}
+}
+
+func TestSplitSELinuxContext(t *testing.T) {
+	context, rest := splitSELinuxContext([]string{"bind", `context="system_u:object_r:container_file_t:s0:c1,c2"`, "noatime"})
+	if want := "system_u:object_r:container_file_t:s0:c1,c2"; context != want {
+		t.Errorf("got context %q, want %q", context, want)
+	}
+	if want := []string{"bind", "noatime"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("got options %q, want %q", rest, want)
+	}
+
+	context, rest = splitSELinuxContext([]string{"bind"})
+	if context != "" {
+		t.Errorf("got context %q, want none", context)
+	}
+	if want := []string{"bind"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("got options %q, want %q", rest, want)
+	}
+}
+
+func TestCheckSELinuxContext(t *testing.T) {
+	const (
+		contextA = "system_u:object_r:container_file_t:s0:c1,c2"
+		contextB = "system_u:object_r:container_file_t:s0:c3,c4"
+	)
+
+	tests := []struct {
+		name      string
+		mounted   string
+		requested string
+		wantErr   bool
+	}{
+		{name: "no context", mounted: "", requested: ""},
+		{name: "same context", mounted: contextA, requested: contextA},
+		{name: "no context requested", mounted: contextA, requested: ""},
+		{name: "conflicting context", mounted: contextA, requested: contextB, wantErr: true},
+		{name: "mounted without context", mounted: "", requested: contextA, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkSELinuxContext(test.mounted, test.requested)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,417 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// parameterTrim is the StorageClass parameter that defines whether the
+	// filesystems of volumes are trimmed periodically. Volumes are trimmed
+	// by default when the node plugin runs with a trim interval.
+	parameterTrim = DefaultDriverName + "/trim"
+
+	// trimOptOutXattr is the extended attribute recording on the parent of a
+	// staging path that the staged volume opted out of trimming. It is kept
+	// outside of the volume's filesystem so that read-only volumes can be
+	// staged, and it survives restarts of the node plugin.
+	trimOptOutXattr = "trusted.dobs.trim-opt-out"
+
+	// defaultTrimChunkSize is the size of the filesystem ranges trimmed by a
+	// single FITRIM call, which bounds how long the call blocks the
+	// filesystem.
+	defaultTrimChunkSize = 1 * giB
+
+	// fitrimIoctl is FITRIM, i.e., _IOWR('X', 121, struct fstrim_range).
+	fitrimIoctl = 0xc0185879
+
+	trimActionTrimmed = "trimmed"
+	trimActionSkipped = "skipped"
+	trimActionFailed  = "failed"
+)
+
+// fstrimRange is struct fstrim_range of linux/fs.h.
+type fstrimRange struct {
+	Start  uint64
+	Len    uint64
+	MinLen uint64
+}
+
+// fitrim discards the unused blocks of the filesystem mounted at the given
+// path within the given range. On return, the length of the range is set to
+// the number of bytes discarded.
+func fitrim(path string, r *fstrimRange) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fitrimIoctl, uintptr(unsafe.Pointer(r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// recordTrimOptOut records whether the volume staged at the given path opted
+// out of trimming. Staging must not fail where the opt-out cannot be
+// recorded, i.e., without support for extended attributes or without
+// CAP_SYS_ADMIN, so the opt-out is skipped with a warning there.
+func recordTrimOptOut(stagingPath string, optOut bool, log *logrus.Entry) error {
+	err := setTrimOptOut(stagingPath, optOut)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+		log.WithError(err).Warn("cannot record trim opt-out, the volume is trimmed if trimming is enabled")
+		return nil
+	}
+	return err
+}
+
+// setTrimOptOut sets or removes the extended attribute recording that the
+// volume staged at the given path opted out of trimming.
+func setTrimOptOut(stagingPath string, optOut bool) error {
+	dir := filepath.Dir(stagingPath)
+	if optOut {
+		if err := unix.Setxattr(dir, trimOptOutXattr, []byte("true"), 0); err != nil {
+			return fmt.Errorf("failed to record trim opt-out on %s: %w", dir, err)
+		}
+		return nil
+	}
+
+	optedOut, err := trimOptedOut(stagingPath)
+	if err != nil || !optedOut {
+		return err
+	}
+	if err := unix.Removexattr(dir, trimOptOutXattr); err != nil && !errors.Is(err, unix.ENODATA) {
+		return fmt.Errorf("failed to remove trim opt-out from %s: %w", dir, err)
+	}
+	return nil
+}
+
+// trimOptedOut checks whether the volume staged at the given path opted out
+// of trimming.
+func trimOptedOut(stagingPath string) (bool, error) {
+	dir := filepath.Dir(stagingPath)
+	_, err := unix.Getxattr(dir, trimOptOutXattr, nil)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, unix.ENODATA), errors.Is(err, unix.ENOTSUP), errors.Is(err, unix.ENOENT):
+		// an opt-out can only be recorded where extended attributes are
+		// supported
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to read trim opt-out of %s: %w", dir, err)
+}
+
+// trimStats describes the trim runs since the node plugin started.
+type trimStats struct {
+	Runs         int         `json:"runs"`
+	TrimmedBytes uint64      `json:"trimmedBytes"`
+	Failures     int         `json:"failures"`
+	LastRun      *trimReport `json:"lastRun,omitempty"`
+}
+
+// trimReport describes the outcome of a single trim run.
+type trimReport struct {
+	StartedAt    time.Time       `json:"startedAt"`
+	FinishedAt   time.Time       `json:"finishedAt"`
+	TrimmedBytes uint64          `json:"trimmedBytes"`
+	Volumes      []trimmedVolume `json:"volumes"`
+	Errors       []string        `json:"errors,omitempty"`
+}
+
+// trimmedVolume describes the outcome of trimming a single staged volume.
+type trimmedVolume struct {
+	VolumeID string `json:"volumeID,omitempty"`
+	Path     string `json:"path"`
+	Source   string `json:"source"`
+	// Action is what the scheduler did about the volume (trimmed, skipped,
+	// or failed).
+	Action       string `json:"action"`
+	Reason       string `json:"reason,omitempty"`
+	TrimmedBytes uint64 `json:"trimmedBytes"`
+	Duration     string `json:"duration"`
+	Error        string `json:"error,omitempty"`
+}
+
+// trimScheduler periodically discards the unused blocks of the filesystems
+// staged by this driver, as volumes are mounted without the `discard` option.
+type trimScheduler struct {
+	log         *logrus.Entry
+	driverName  string
+	interval    time.Duration
+	concurrency int
+	// limiter bounds the number of bytes discarded per second across all
+	// volumes. It is nil if the bandwidth is not limited.
+	limiter   *rate.Limiter
+	chunkSize uint64
+
+	mountInfoPath string
+	kubeletDir    string
+	statfs        func(path string, buf *unix.Statfs_t) error
+	fitrim        func(path string, r *fstrimRange) error
+	optedOut      func(stagingPath string) (bool, error)
+
+	mu    sync.Mutex
+	stats trimStats
+}
+
+// newTrimScheduler returns a new trimScheduler that trims the volumes staged
+// in the host's kubelet directory every interval, trimming up to concurrency
+// volumes at once and discarding at most bandwidth bytes per second. A
+// bandwidth of 0 does not limit trimming.
+func newTrimScheduler(log *logrus.Entry, driverName string, interval time.Duration, concurrency uint, bandwidth uint64) *trimScheduler {
+	s := &trimScheduler{
+		log:           log.WithField("component", "trim_scheduler"),
+		driverName:    driverName,
+		interval:      interval,
+		concurrency:   int(concurrency),
+		chunkSize:     defaultTrimChunkSize,
+		mountInfoPath: procMountInfoPath,
+		kubeletDir:    defaultKubeletDir,
+		statfs:        unix.Statfs,
+		fitrim:        fitrim,
+		optedOut:      trimOptedOut,
+	}
+	if s.concurrency < 1 {
+		s.concurrency = 1
+	}
+
+	if bandwidth > 0 {
+		// a chunk must fit into the burst for the limiter to admit it
+		s.chunkSize = min(s.chunkSize, bandwidth)
+		s.limiter = rate.NewLimiter(rate.Limit(bandwidth), int(bandwidth))
+	}
+	return s
+}
+
+// Run trims the staged volumes every interval until the given context is
+// done.
+func (s *trimScheduler) Run(ctx context.Context) {
+	s.log.WithFields(logrus.Fields{
+		"interval":    s.interval,
+		"concurrency": s.concurrency,
+		"chunk_size":  s.chunkSize,
+	}).Info("starting trim scheduler")
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Info("trim scheduler stopped")
+			return
+		case <-ticker.C:
+			s.Trim(ctx)
+		}
+	}
+}
+
+// Trim trims the filesystems of all staged volumes that did not opt out. The
+// outcome is logged and added to the stats kept for the debug endpoint.
+func (s *trimScheduler) Trim(ctx context.Context) *trimReport {
+	report := &trimReport{
+		StartedAt: time.Now(),
+		Volumes:   []trimmedVolume{},
+	}
+	defer func() {
+		report.FinishedAt = time.Now()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stats.Runs++
+		s.stats.TrimmedBytes += report.TrimmedBytes
+		for _, tv := range report.Volumes {
+			if tv.Action == trimActionFailed {
+				s.stats.Failures++
+			}
+		}
+		s.stats.LastRun = report
+	}()
+
+	s.log.Info("trimming staged volumes")
+
+	infos, err := readMountInfo(s.mountInfoPath)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to read mounts: %s", err))
+		s.log.WithError(err).Error("failed to read mounts, skipping trim run")
+		return report
+	}
+
+	var staged []mountInfo
+	for _, m := range ownedMounts(s.kubeletDir, s.driverName, infos) {
+		if m.kind == mountKindStaging {
+			staged = append(staged, m.info)
+		}
+	}
+
+	results := make([]trimmedVolume, len(staged))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(s.concurrency, len(staged)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = s.trimVolume(ctx, staged[i])
+			}
+		}()
+	}
+	for i := range staged {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, tv := range results {
+		report.TrimmedBytes += tv.TrimmedBytes
+	}
+	report.Volumes = append(report.Volumes, results...)
+
+	counts := map[string]int{}
+	for _, tv := range report.Volumes {
+		counts[tv.Action]++
+	}
+	s.log.WithFields(logrus.Fields{
+		"trimmed_volumes": counts[trimActionTrimmed],
+		"skipped_volumes": counts[trimActionSkipped],
+		"failed_volumes":  counts[trimActionFailed],
+		"trimmed_bytes":   report.TrimmedBytes,
+		"duration":        time.Since(report.StartedAt),
+	}).Info("trimmed staged volumes")
+	return report
+}
+
+// trimVolume trims the filesystem of the given staging mount in chunks,
+// pacing the calls to the configured bandwidth.
+func (s *trimScheduler) trimVolume(ctx context.Context, info mountInfo) trimmedVolume {
+	start := time.Now()
+	tv := trimmedVolume{
+		Path:   info.MountPoint,
+		Source: info.Source,
+	}
+	if data, err := readVolData(filepath.Join(filepath.Dir(info.MountPoint), volDataFileName)); err == nil {
+		tv.VolumeID = data.VolumeHandle
+	}
+
+	log := s.log.WithFields(logrus.Fields{
+		"volume_id": tv.VolumeID,
+		"path":      tv.Path,
+		"source":    tv.Source,
+	})
+
+	skip := func(reason string) trimmedVolume {
+		tv.Action = trimActionSkipped
+		tv.Reason = reason
+		tv.Duration = time.Since(start).String()
+		log.WithField("reason", reason).Info("skipped trimming volume")
+		return tv
+	}
+	fail := func(err error) trimmedVolume {
+		tv.Action = trimActionFailed
+		tv.Error = err.Error()
+		tv.Duration = time.Since(start).String()
+		log.WithError(err).WithField("trimmed_bytes", tv.TrimmedBytes).Error("failed to trim volume")
+		return tv
+	}
+
+	if info.hasOption("ro") {
+		return skip("read-only")
+	}
+
+	optedOut, err := s.optedOut(info.MountPoint)
+	if err != nil {
+		return fail(err)
+	}
+	if optedOut {
+		return skip("opted out")
+	}
+
+	var statfs unix.Statfs_t
+	if err := s.statfs(info.MountPoint, &statfs); err != nil {
+		return fail(fmt.Errorf("failed to determine filesystem size: %w", err))
+	}
+	size := statfs.Blocks * uint64(statfs.Bsize)
+
+	for offset := uint64(0); offset < size; offset += s.chunkSize {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+
+		r := fstrimRange{Start: offset, Len: s.chunkSize}
+		if err := s.fitrim(info.MountPoint, &r); err != nil {
+			switch {
+			case errors.Is(err, unix.EOPNOTSUPP):
+				return skip("discard not supported")
+			case errors.Is(err, unix.EROFS):
+				return skip("read-only")
+			case errors.Is(err, unix.EINVAL) && offset > 0:
+				// some filesystems report a size beyond their last block
+			default:
+				return fail(fmt.Errorf("FITRIM failed at offset %d: %w", offset, err))
+			}
+			break
+		}
+		tv.TrimmedBytes += r.Len
+
+		if s.limiter != nil && r.Len > 0 {
+			if err := s.limiter.WaitN(ctx, int(min(r.Len, s.chunkSize))); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	tv.Action = trimActionTrimmed
+	tv.Duration = time.Since(start).String()
+	log.WithFields(logrus.Fields{
+		"trimmed_bytes": tv.TrimmedBytes,
+		"duration":      tv.Duration,
+	}).Info("trimmed volume")
+	return tv
+}
+
+// Stats returns the stats of the trim runs so far.
+func (s *trimScheduler) Stats() trimStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// ServeHTTP serves the stats of the trim runs so far as JSON.
+func (s *trimScheduler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	stats := s.Stats()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.log.WithError(err).Error("failed to encode trim stats")
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func TestTrimScheduler(t *testing.T) {
+	root := t.TempDir()
+	kubeletDir := filepath.Join(root, "kubelet")
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+
+	staging := func(t *testing.T, name string) string {
+		path := filepath.Join(csiDir, DefaultDriverName, name, "globalmount")
+		mustMkdirAll(t, path)
+		mustWriteFile(t, filepath.Join(filepath.Dir(path), volDataFileName),
+			fmt.Sprintf(`{"driverName":%q,"volumeHandle":%q}`, DefaultDriverName, "vol-"+name))
+		return path
+	}
+
+	trimmedStaging := staging(t, "trimmed")
+	optedOutStaging := staging(t, "opted-out")
+	readOnlyStaging := staging(t, "read-only")
+	noDiscardStaging := staging(t, "no-discard")
+	failingStaging := staging(t, "failing")
+	publish := filepath.Join(kubeletDir, "pods", "pod1", "volumes", "kubernetes.io~csi", "pvc-1", "mount")
+
+	mountInfo := strings.Join([]string{
+		"22 1 252:1 / / rw shared:1 - ext4 /dev/vda1 rw",
+		"30 22 8:0 / " + trimmedStaging + " rw shared:2 - ext4 /dev/sda rw",
+		"31 22 8:16 / " + optedOutStaging + " rw shared:3 - ext4 /dev/sdb rw",
+		"32 22 8:32 / " + readOnlyStaging + " ro shared:4 - ext4 /dev/sdc ro,noload",
+		"33 22 8:48 / " + noDiscardStaging + " rw shared:5 - xfs /dev/sdd rw",
+		"34 22 8:64 / " + failingStaging + " rw shared:6 - ext4 /dev/sde rw",
+		"35 22 8:0 / " + publish + " rw shared:2 - ext4 /dev/sda rw",
+	}, "\n")
+	mountInfoPath := filepath.Join(root, "mountinfo")
+	mustWriteFile(t, mountInfoPath, mountInfo)
+
+	var (
+		mu     sync.Mutex
+		ranges = map[string][]fstrimRange{}
+	)
+
+	s := newTrimScheduler(logrus.New().WithField("test_enabled", true), DefaultDriverName, time.Hour, 2, 0)
+	s.mountInfoPath = mountInfoPath
+	s.kubeletDir = kubeletDir
+	s.chunkSize = 1 * giB
+	s.statfs = func(path string, buf *unix.Statfs_t) error {
+		// a filesystem of 2.5 GiB
+		buf.Bsize = 4096
+		buf.Blocks = 5 * giB / 2 / 4096
+		return nil
+	}
+	s.optedOut = func(stagingPath string) (bool, error) {
+		return stagingPath == optedOutStaging, nil
+	}
+	s.fitrim = func(path string, r *fstrimRange) error {
+		mu.Lock()
+		ranges[path] = append(ranges[path], *r)
+		mu.Unlock()
+
+		switch path {
+		case noDiscardStaging:
+			return unix.EOPNOTSUPP
+		case failingStaging:
+			return unix.EIO
+		}
+		r.Len = 100 * miB
+		return nil
+	}
+
+	report := s.Trim(context.Background())
+
+	actions := map[string]trimmedVolume{}
+	for _, tv := range report.Volumes {
+		actions[tv.Path] = tv
+	}
+	if len(actions) != 5 {
+		t.Fatalf("got %d volumes, want 5", len(actions))
+	}
+
+	tests := []struct {
+		path       string
+		wantAction string
+		wantReason string
+		wantBytes  uint64
+	}{
+		{path: trimmedStaging, wantAction: trimActionTrimmed, wantBytes: 300 * miB},
+		{path: optedOutStaging, wantAction: trimActionSkipped, wantReason: "opted out"},
+		{path: readOnlyStaging, wantAction: trimActionSkipped, wantReason: "read-only"},
+		{path: noDiscardStaging, wantAction: trimActionSkipped, wantReason: "discard not supported"},
+		{path: failingStaging, wantAction: trimActionFailed},
+	}
+	for _, test := range tests {
+		tv := actions[test.path]
+		if tv.Action != test.wantAction {
+			t.Errorf("got action %q for %q, want %q", tv.Action, test.path, test.wantAction)
+		}
+		if tv.Reason != test.wantReason {
+			t.Errorf("got reason %q for %q, want %q", tv.Reason, test.path, test.wantReason)
+		}
+		if tv.TrimmedBytes != test.wantBytes {
+			t.Errorf("got %d trimmed bytes for %q, want %d", tv.TrimmedBytes, test.path, test.wantBytes)
+		}
+		if want := "vol-" + filepath.Base(filepath.Dir(test.path)); tv.VolumeID != want {
+			t.Errorf("got volume ID %q for %q, want %q", tv.VolumeID, test.path, want)
+		}
+	}
+
+	wantRanges := []fstrimRange{
+		{Start: 0, Len: 1 * giB},
+		{Start: 1 * giB, Len: 1 * giB},
+		{Start: 2 * giB, Len: 1 * giB},
+	}
+	if got := ranges[trimmedStaging]; fmt.Sprint(got) != fmt.Sprint(wantRanges) {
+		t.Errorf("got trimmed ranges %v, want %v", got, wantRanges)
+	}
+	for _, path := range []string{optedOutStaging, readOnlyStaging, publish} {
+		if len(ranges[path]) != 0 {
+			t.Errorf("got %q trimmed", path)
+		}
+	}
+
+	if report.TrimmedBytes != 300*miB {
+		t.Errorf("got %d trimmed bytes, want %d", report.TrimmedBytes, 300*miB)
+	}
+
+	s.Trim(context.Background())
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trim", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	var stats trimStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode stats: %s", err)
+	}
+	if stats.Runs != 2 {
+		t.Errorf("got %d runs, want 2", stats.Runs)
+	}
+	if stats.TrimmedBytes != 600*miB {
+		t.Errorf("got %d trimmed bytes in total, want %d", stats.TrimmedBytes, 600*miB)
+	}
+	if stats.Failures != 2 {
+		t.Errorf("got %d failures, want 2", stats.Failures)
+	}
+	if stats.LastRun == nil || len(stats.LastRun.Volumes) != 5 {
+		t.Errorf("got last run %+v, want one with 5 volumes", stats.LastRun)
+	}
+}
+
+func TestNewTrimSchedulerBandwidth(t *testing.T) {
+	log := logrus.New().WithField("test_enabled", true)
+
+	s := newTrimScheduler(log, DefaultDriverName, time.Hour, 1, 0)
+	if s.limiter != nil {
+		t.Error("got bandwidth limiter, want none")
+	}
+	if s.chunkSize != defaultTrimChunkSize {
+		t.Errorf("got chunk size %d, want %d", s.chunkSize, uint64(defaultTrimChunkSize))
+	}
+
+	s = newTrimScheduler(log, DefaultDriverName, time.Hour, 1, 64*miB)
+	if s.limiter == nil {
+		t.Fatal("got no bandwidth limiter")
+	}
+	if s.chunkSize != 64*miB {
+		t.Errorf("got chunk size %d, want %d", s.chunkSize, 64*miB)
+	}
+	if burst := s.limiter.Burst(); uint64(burst) < s.chunkSize {
+		t.Errorf("got burst %d smaller than chunk size %d", burst, s.chunkSize)
+	}
+}
+
+func TestRecordTrimOptOut(t *testing.T) {
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	if err := unix.Setxattr(filepath.Dir(stagingPath), trimOptOutXattr+"-probe", []byte("1"), 0); err != nil {
+		t.Skipf("trusted extended attributes are not supported: %s", err)
+	}
+	log := logrus.New().WithField("test_enabled", true)
+
+	assertOptedOut := func(t *testing.T, want bool) {
+		t.Helper()
+		got, err := trimOptedOut(stagingPath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if got != want {
+			t.Errorf("got opted out %t, want %t", got, want)
+		}
+	}
+
+	assertOptedOut(t, false)
+
+	// removing a missing opt-out is a no-op
+	if err := recordTrimOptOut(stagingPath, false, log); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	assertOptedOut(t, false)
+
+	if err := recordTrimOptOut(stagingPath, true, log); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	assertOptedOut(t, true)
+
+	if err := recordTrimOptOut(stagingPath, false, log); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	assertOptedOut(t, false)
+}
+
+func TestRecordTrimOptOutUnsupported(t *testing.T) {
+	// procfs does not support extended attributes
+	stagingPath := "/proc/globalmount"
+	if err := unix.Setxattr(filepath.Dir(stagingPath), trimOptOutXattr, []byte("true"), 0); !errors.Is(err, unix.ENOTSUP) {
+		t.Skipf("got error %v setting an extended attribute on procfs, want ENOTSUP", err)
+	}
+
+	log := logrus.New().WithField("test_enabled", true)
+	if err := recordTrimOptOut(stagingPath, true, log); err != nil {
+		t.Errorf("got error recording the opt-out: %s", err)
+	}
+	if err := recordTrimOptOut(stagingPath, false, log); err != nil {
+		t.Errorf("got error removing the opt-out: %s", err)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// VolumeHealthChecker determines the condition of mounted volumes.
+type VolumeHealthChecker interface {
+	// Condition returns the condition of the volume mounted at the given
+	// path. isBlock tells whether the path is a block device rather than a
+	// filesystem mount.
+	Condition(volumePath string, isBlock bool) (*csi.VolumeCondition, error)
+}
+
+// sysfsVolumeHealthChecker checks the mount of a volume in mountinfo and its
+// block device in sysfs.
+type sysfsVolumeHealthChecker struct {
+	log *logrus.Entry
+
+	mountInfoPath string
+	sysPath       string
+	stat          func(path string, stat *unix.Stat_t) error
+
+	mu sync.Mutex
+	// ioErrors holds the I/O error counts of the devices seen by the last
+	// check of a volume path, keyed by volume path and device number, to
+	// tell recent errors from old ones. Every volume path has its own
+	// baseline, as the staging and publish paths of a volume share devices.
+	ioErrors map[string]map[string]uint64
+}
+
+// newVolumeHealthChecker returns a new VolumeHealthChecker operating on the
+// host's /sys.
+func newVolumeHealthChecker(log *logrus.Entry) *sysfsVolumeHealthChecker {
+	return &sysfsVolumeHealthChecker{
+		log:           log,
+		mountInfoPath: procMountInfoPath,
+		sysPath:       "/sys",
+		stat:          unix.Stat,
+		ioErrors:      map[string]map[string]uint64{},
+	}
+}
+
+func (c *sysfsVolumeHealthChecker) Condition(volumePath string, isBlock bool) (*csi.VolumeCondition, error) {
+	infos, err := readMountInfo(c.mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %v", err)
+	}
+	c.forgetUnmounted(infos)
+
+	var info *mountInfo
+	for i := range infos {
+		// the last entry is the one visible at the path
+		if infos[i].MountPoint == volumePath {
+			info = &infos[i]
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("volume path %q is not mounted", volumePath)
+	}
+
+	major, minor := info.Major, info.Minor
+	if isBlock {
+		// block volumes are bind mounts of device nodes, whose mounts
+		// carry the device number of devtmpfs
+		var st unix.Stat_t
+		if err := c.stat(volumePath, &st); err != nil {
+			if errors.Is(err, unix.EIO) || errors.Is(err, unix.ENXIO) {
+				return abnormalCondition("device fails with I/O errors: %v", err), nil
+			}
+			return nil, fmt.Errorf("failed to stat volume path %q: %v", volumePath, err)
+		}
+		major, minor = int(unix.Major(st.Rdev)), int(unix.Minor(st.Rdev))
+	} else if !hasOptionIn(info.Options, "ro") && hasOptionIn(info.SuperOptions, "ro") {
+		// the kernel remounts filesystems read-only on errors, which only
+		// shows in the superblock options
+		return abnormalCondition("filesystem %s on %s was remounted read-only, likely after errors", info.FsType, info.Source), nil
+	}
+
+	deviceNumber := fmt.Sprintf("%d:%d", major, minor)
+	devDir := filepath.Join(c.sysPath, "dev", "block", deviceNumber)
+	switch blockDeviceProblem(devDir) {
+	case staleReasonDeviceVanished:
+		// a device attached again starts counting at zero
+		c.mu.Lock()
+		delete(c.ioErrors, volumePath)
+		c.mu.Unlock()
+		return abnormalCondition("device %s of the volume vanished", deviceNumber), nil
+	case staleReasonDeviceOffline:
+		return abnormalCondition("device %s of the volume is not %s", deviceNumber, runningState), nil
+	}
+
+	if newErrors := c.newIOErrors(volumePath, devDir); newErrors > 0 {
+		return abnormalCondition("device %s of the volume reported %d I/O errors since the last check", deviceNumber, newErrors), nil
+	}
+
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}, nil
+}
+
+// newIOErrors returns how many I/O errors the device and, for device mapper
+// devices, its backing devices reported since the last check of the given
+// volume path. The counts of devices no longer backing the volume path are
+// dropped.
+func (c *sysfsVolumeHealthChecker) newIOErrors(volumePath, devDir string) uint64 {
+	slaves, _ := filepath.Glob(filepath.Join(devDir, "slaves", "*"))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last := c.ioErrors[volumePath]
+	seen := map[string]uint64{}
+	var newErrors uint64
+	for _, dir := range append([]string{devDir}, slaves...) {
+		count, err := readIOErrorCount(filepath.Join(dir, "device", "ioerr_cnt"))
+		if err != nil {
+			// only SCSI devices count errors
+			continue
+		}
+
+		key := dir
+		if dev, err := readSysfsString(filepath.Join(dir, "dev")); err == nil {
+			key = dev
+		}
+		// counts start at zero when a device is attached, so errors seen
+		// for the first time are recent as well
+		if count > last[key] {
+			newErrors += count - last[key]
+		}
+		seen[key] = count
+	}
+	c.ioErrors[volumePath] = seen
+	return newErrors
+}
+
+// forgetUnmounted drops the I/O error counts of volume paths that are no
+// longer mounted.
+func (c *sysfsVolumeHealthChecker) forgetUnmounted(infos []mountInfo) {
+	mounted := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		mounted[info.MountPoint] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for volumePath := range c.ioErrors {
+		if !mounted[volumePath] {
+			delete(c.ioErrors, volumePath)
+		}
+	}
+}
+
+// blockDeviceProblem checks the sysfs directory of a block device and, for
+// device mapper devices (e.g., LUKS), of the devices backing it. It returns
+// staleReasonDeviceVanished or staleReasonDeviceOffline, or an empty string
+// if the device is fine.
+func blockDeviceProblem(devDir string) string {
+	if _, err := os.Stat(devDir); os.IsNotExist(err) {
+		return staleReasonDeviceVanished
+	}
+
+	// device mapper devices outlive their backing devices
+	slaves, _ := filepath.Glob(filepath.Join(devDir, "slaves", "*"))
+	for _, dir := range append([]string{devDir}, slaves...) {
+		state, err := readSysfsString(filepath.Join(dir, "device", "state"))
+		if err == nil && state != runningState {
+			return staleReasonDeviceOffline
+		}
+	}
+	if _, err := os.Stat(filepath.Join(devDir, "slaves")); err == nil && len(slaves) == 0 {
+		return staleReasonDeviceVanished
+	}
+
+	return ""
+}
+
+// readIOErrorCount reads a SCSI device's I/O error counter, which sysfs
+// formats in hex.
+func readIOErrorCount(path string) (uint64, error) {
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
+
+func hasOptionIn(options []string, option string) bool {
+	for _, opt := range options {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+func abnormalCondition(format string, a ...interface{}) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf(format, a...),
+	}
+}
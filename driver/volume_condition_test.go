@@ -0,0 +1,280 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func TestVolumeHealthChecker(t *testing.T) {
+	const (
+		stagingPath = "/var/lib/kubelet/plugins/kubernetes.io/csi/dobs.csi.digitalocean.com/abc/globalmount"
+		publishPath = "/var/lib/kubelet/pods/123/volumes/kubernetes.io~csi/pvc-1/mount"
+		blockPath   = "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/123"
+	)
+
+	type device struct {
+		state     string
+		ioErrors  string
+		slaveOf   string
+		noSlaves  bool
+		noDevice  bool
+		blockRdev uint64
+	}
+
+	tests := []struct {
+		name        string
+		mountInfo   string
+		volumePath  string
+		isBlock     bool
+		devices     map[string]device
+		statErr     error
+		checks      int
+		wantErr     bool
+		wantHealthy bool
+		wantMessage string
+	}{
+		{
+			name:        "healthy filesystem",
+			mountInfo:   "30 22 8:16 / " + publishPath + " rw,relatime shared:2 - ext4 /dev/sdb rw",
+			volumePath:  publishPath,
+			devices:     map[string]device{"8:16": {state: "running", ioErrors: "0x0"}},
+			wantHealthy: true,
+		},
+		{
+			name:        "read-only publish of a healthy filesystem",
+			mountInfo:   "30 22 8:16 / " + publishPath + " ro,relatime shared:2 - ext4 /dev/sdb rw",
+			volumePath:  publishPath,
+			devices:     map[string]device{"8:16": {state: "running"}},
+			wantHealthy: true,
+		},
+		{
+			name:        "filesystem remounted read-only",
+			mountInfo:   "30 22 8:16 / " + publishPath + " rw,relatime shared:2 - ext4 /dev/sdb ro",
+			volumePath:  publishPath,
+			devices:     map[string]device{"8:16": {state: "running"}},
+			wantMessage: "remounted read-only",
+		},
+		{
+			name:        "device vanished",
+			mountInfo:   "30 22 8:16 / " + stagingPath + " rw,relatime shared:2 - ext4 /dev/sdb rw",
+			volumePath:  stagingPath,
+			devices:     map[string]device{"8:16": {noDevice: true}},
+			wantMessage: "vanished",
+		},
+		{
+			name:        "device offline",
+			mountInfo:   "30 22 8:16 / " + stagingPath + " rw,relatime shared:2 - ext4 /dev/sdb rw",
+			volumePath:  stagingPath,
+			devices:     map[string]device{"8:16": {state: "offline"}},
+			wantMessage: "is not running",
+		},
+		{
+			name:        "I/O errors",
+			mountInfo:   "30 22 8:16 / " + stagingPath + " rw,relatime shared:2 - ext4 /dev/sdb rw",
+			volumePath:  stagingPath,
+			devices:     map[string]device{"8:16": {state: "running", ioErrors: "0x3"}},
+			wantMessage: "reported 3 I/O errors",
+		},
+		{
+			name:        "old I/O errors",
+			mountInfo:   "30 22 8:16 / " + stagingPath + " rw,relatime shared:2 - ext4 /dev/sdb rw",
+			volumePath:  stagingPath,
+			devices:     map[string]device{"8:16": {state: "running", ioErrors: "0x3"}},
+			checks:      2,
+			wantHealthy: true,
+		},
+		{
+			name:      "LUKS device with offline backing device",
+			mountInfo: "30 22 253:0 / " + stagingPath + " rw,relatime shared:2 - ext4 /dev/mapper/dobs-abc rw",
+			devices: map[string]device{
+				"253:0": {},
+				"8:16":  {state: "offline", slaveOf: "253:0"},
+			},
+			volumePath:  stagingPath,
+			wantMessage: "is not running",
+		},
+		{
+			name:      "LUKS device without backing device",
+			mountInfo: "30 22 253:0 / " + stagingPath + " rw,relatime shared:2 - ext4 /dev/mapper/dobs-abc rw",
+			devices: map[string]device{
+				"253:0": {noSlaves: true},
+			},
+			volumePath:  stagingPath,
+			wantMessage: "vanished",
+		},
+		{
+			name:        "healthy block device",
+			mountInfo:   "30 22 0:5 /sdb " + blockPath + " rw shared:2 - devtmpfs udev rw",
+			volumePath:  blockPath,
+			isBlock:     true,
+			devices:     map[string]device{"8:16": {state: "running", blockRdev: unix.Mkdev(8, 16)}},
+			wantHealthy: true,
+		},
+		{
+			name:        "offline block device",
+			mountInfo:   "30 22 0:5 /sdb " + blockPath + " rw shared:2 - devtmpfs udev rw",
+			volumePath:  blockPath,
+			isBlock:     true,
+			devices:     map[string]device{"8:16": {state: "offline", blockRdev: unix.Mkdev(8, 16)}},
+			wantMessage: "is not running",
+		},
+		{
+			name:        "failing block device",
+			mountInfo:   "30 22 0:5 /sdb " + blockPath + " rw shared:2 - devtmpfs udev rw",
+			volumePath:  blockPath,
+			isBlock:     true,
+			statErr:     unix.EIO,
+			wantMessage: "I/O errors",
+		},
+		{
+			name:       "not mounted",
+			mountInfo:  "30 22 8:16 / " + stagingPath + " rw,relatime shared:2 - ext4 /dev/sdb rw",
+			volumePath: publishPath,
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			c := newVolumeHealthChecker(logrus.New().WithField("test_enabled", true))
+			c.mountInfoPath = filepath.Join(root, "mountinfo")
+			c.sysPath = filepath.Join(root, "sys")
+			mustWriteFile(t, c.mountInfoPath, test.mountInfo+"\n")
+
+			var rdev uint64
+			for number, dev := range test.devices {
+				if dev.noDevice {
+					continue
+				}
+				devDir := filepath.Join(c.sysPath, "dev", "block", number)
+				if dev.slaveOf != "" {
+					devDir = filepath.Join(c.sysPath, "dev", "block", dev.slaveOf, "slaves", number)
+				}
+				mustMkdirAll(t, filepath.Join(devDir, "device"))
+				mustWriteFile(t, filepath.Join(devDir, "dev"), number+"\n")
+				if dev.noSlaves {
+					mustMkdirAll(t, filepath.Join(devDir, "slaves"))
+				}
+				if dev.state != "" {
+					mustWriteFile(t, filepath.Join(devDir, "device", "state"), dev.state+"\n")
+				}
+				if dev.ioErrors != "" {
+					mustWriteFile(t, filepath.Join(devDir, "device", "ioerr_cnt"), dev.ioErrors+"\n")
+				}
+				if dev.blockRdev != 0 {
+					rdev = dev.blockRdev
+				}
+			}
+			c.stat = func(path string, st *unix.Stat_t) error {
+				if test.statErr != nil {
+					return test.statErr
+				}
+				st.Rdev = rdev
+				return nil
+			}
+
+			checks := test.checks
+			if checks == 0 {
+				checks = 1
+			}
+			for i := 0; i < checks; i++ {
+				condition, err := c.Condition(test.volumePath, test.isBlock)
+				if test.wantErr {
+					if err == nil {
+						t.Fatalf("got condition %v, want error", condition)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("got error: %s", err)
+				}
+				if i < checks-1 {
+					continue
+				}
+
+				if condition.Abnormal == test.wantHealthy {
+					t.Errorf("got abnormal %t (%q), want %t", condition.Abnormal, condition.Message, !test.wantHealthy)
+				}
+				if !strings.Contains(condition.Message, test.wantMessage) {
+					t.Errorf("got message %q, want it to contain %q", condition.Message, test.wantMessage)
+				}
+			}
+		})
+	}
+}
+
+func TestVolumeHealthCheckerSharedDevice(t *testing.T) {
+	const (
+		stagingPath = "/var/lib/kubelet/plugins/kubernetes.io/csi/dobs.csi.digitalocean.com/abc/globalmount"
+		publishPath = "/var/lib/kubelet/pods/123/volumes/kubernetes.io~csi/pvc-1/mount"
+	)
+
+	root := t.TempDir()
+	c := newVolumeHealthChecker(logrus.New().WithField("test_enabled", true))
+	c.mountInfoPath = filepath.Join(root, "mountinfo")
+	c.sysPath = filepath.Join(root, "sys")
+
+	devDir := filepath.Join(c.sysPath, "dev", "block", "8:16")
+	mustMkdirAll(t, filepath.Join(devDir, "device"))
+	mustWriteFile(t, filepath.Join(devDir, "dev"), "8:16\n")
+	mustWriteFile(t, filepath.Join(devDir, "device", "state"), "running\n")
+	mustWriteFile(t, filepath.Join(devDir, "device", "ioerr_cnt"), "0x3\n")
+	mustWriteFile(t, c.mountInfoPath,
+		"30 22 8:16 / "+stagingPath+" rw,relatime shared:2 - ext4 /dev/sdb rw\n"+
+			"31 22 8:16 / "+publishPath+" rw,relatime shared:2 - ext4 /dev/sdb rw\n")
+
+	assertAbnormal := func(t *testing.T, volumePath string, want bool) {
+		t.Helper()
+		condition, err := c.Condition(volumePath, false)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if condition.Abnormal != want {
+			t.Errorf("got abnormal %t (%q) for %s, want %t", condition.Abnormal, condition.Message, volumePath, want)
+		}
+	}
+
+	// both paths report the errors, regardless of which is checked first
+	assertAbnormal(t, stagingPath, true)
+	assertAbnormal(t, publishPath, true)
+	assertAbnormal(t, stagingPath, false)
+	assertAbnormal(t, publishPath, false)
+
+	// the counts of unmounted volume paths are dropped
+	mustWriteFile(t, c.mountInfoPath, "30 22 8:16 / "+stagingPath+" rw,relatime shared:2 - ext4 /dev/sdb rw\n")
+	assertAbnormal(t, stagingPath, false)
+	if _, ok := c.ioErrors[publishPath]; ok {
+		t.Errorf("got I/O error counts of unmounted path %s", publishPath)
+	}
+
+	// the counts of vanished devices are dropped
+	if err := os.RemoveAll(devDir); err != nil {
+		t.Fatal(err)
+	}
+	assertAbnormal(t, stagingPath, true)
+	if _, ok := c.ioErrors[stagingPath]; ok {
+		t.Errorf("got I/O error counts of vanished device of %s", stagingPath)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// partitionSuffix matches the suffix of the by-id symlinks of partitions.
+var partitionSuffix = regexp.MustCompile(`-part[0-9]+$`)
+
+// ForeignVolumeLister lists the DO volumes attached to the node that the CO
+// does not account for, i.e., volumes not managed by this driver, e.g.,
+// attached through the control panel, and the volumes of ephemeral inline
+// volumes.
+type ForeignVolumeLister interface {
+	// List returns the names of the DO volumes attached to the node that
+	// are mounted outside of this driver only or back inline volumes.
+	List() ([]string, error)
+}
+
+// sysfsForeignVolumeLister finds the attached DO volumes through the udev
+// by-id symlinks and tells the ones of this driver apart by their mounts.
+type sysfsForeignVolumeLister struct {
+	log        *logrus.Entry
+	driverName string
+
+	diskIDPath    string
+	mountInfoPath string
+	kubeletDir    string
+	sysPath       string
+}
+
+// newForeignVolumeLister returns a new ForeignVolumeLister operating on the
+// host's /dev, /sys, and kubelet directory.
+func newForeignVolumeLister(log *logrus.Entry, driverName string) ForeignVolumeLister {
+	return &sysfsForeignVolumeLister{
+		log:           log.WithField("component", "foreign_volume_lister"),
+		driverName:    driverName,
+		diskIDPath:    diskIDPath,
+		mountInfoPath: procMountInfoPath,
+		kubeletDir:    defaultKubeletDir,
+		sysPath:       "/sys",
+	}
+}
+
+// List considers a DO volume to be foreign if it, one of its partitions, or
+// a device mapper device on top of it is mounted, but none of these mounts
+// belong to this driver. Volumes that are not mounted at all are not counted,
+// as they may have been attached for this driver and await staging. The
+// volumes of inline volumes are attached by the node plugin itself, so they
+// are always counted.
+func (c *sysfsForeignVolumeLister) List() ([]string, error) {
+	links, err := filepath.Glob(filepath.Join(c.diskIDPath, diskDOPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := readMountInfo(c.mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %s", err)
+	}
+
+	owned := map[string]bool{}
+	for _, m := range ownedMounts(c.kubeletDir, c.driverName, infos) {
+		for _, disk := range mountDisks(c.sysPath, m.info) {
+			owned[disk] = true
+		}
+	}
+	mounted := map[string]bool{}
+	for _, info := range infos {
+		for _, disk := range mountDisks(c.sysPath, info) {
+			mounted[disk] = true
+		}
+	}
+
+	var foreign []string
+	for _, link := range links {
+		name := strings.TrimPrefix(filepath.Base(link), diskDOPrefix)
+		// partitions have their own symlinks
+		if partitionSuffix.MatchString(name) {
+			continue
+		}
+
+		resolved, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			c.log.WithError(err).WithField("device_path", link).Warn("failed to resolve device of volume")
+			continue
+		}
+		disk := filepath.Base(resolved)
+		if strings.HasPrefix(name, ephemeralVolumeNamePrefix) || (mounted[disk] && !owned[disk]) {
+			foreign = append(foreign, name)
+		}
+	}
+
+	sort.Strings(foreign)
+	return foreign, nil
+}
+
+// mountDisks returns the names of the disks backing the given mount.
+func mountDisks(sysPath string, info mountInfo) []string {
+	if info.FsType == "devtmpfs" {
+		// block volumes are bind mounted from devtmpfs, with the device as
+		// the root of the mount
+		if info.Root == "/" {
+			return nil
+		}
+		return backingDisks(sysPath, filepath.Join(sysPath, "class", "block", filepath.Base(info.Root)))
+	}
+	return backingDisks(sysPath, filepath.Join(sysPath, "dev", "block", fmt.Sprintf("%d:%d", info.Major, info.Minor)))
+}
+
+// backingDisks returns the names of the disks backing the block device with
+// the given sysfs directory, following partitions to their disk and device
+// mapper devices to their underlying devices.
+func backingDisks(sysPath, devDir string) []string {
+	dir, err := filepath.EvalSymlinks(devDir)
+	if err != nil {
+		// not a block device, e.g., of a pseudo filesystem
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		return []string{filepath.Base(filepath.Dir(dir))}
+	}
+
+	slaves, err := os.ReadDir(filepath.Join(dir, "slaves"))
+	if err != nil || len(slaves) == 0 {
+		return []string{filepath.Base(dir)}
+	}
+	var disks []string
+	for _, slave := range slaves {
+		disks = append(disks, backingDisks(sysPath, filepath.Join(sysPath, "class", "block", slave.Name()))...)
+	}
+	return disks
+}
+
+// nodeVolumeLimit returns the number of volumes this driver can attach to the
+// node, i.e., the configured limit minus the slots taken by foreign volumes.
+func (d *Driver) nodeVolumeLimit() int64 {
+	limit := int64(d.volumeLimit)
+	// a limit of zero means no limit at all
+	if limit == 0 {
+		return limit
+	}
+
+	log := d.log.WithField("volume_limit", limit)
+	foreign, err := d.foreignVolumes.List()
+	if err != nil {
+		log.WithError(err).Warn("failed to count volumes the CO does not account for, reporting configured volume limit")
+		return limit
+	}
+	if len(foreign) == 0 {
+		return limit
+	}
+
+	log = log.WithField("foreign_volumes", foreign)
+	available := limit - int64(len(foreign))
+	if available < 1 {
+		// zero would mean no limit to the CO
+		log.Warn("volumes the CO does not account for take all volume slots of the node, reporting a volume limit of 1")
+		return 1
+	}
+	log.WithField("available_volume_limit", available).Info("reducing volume limit by volumes the CO does not account for")
+	return available
+}
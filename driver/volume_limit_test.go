@@ -0,0 +1,207 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestForeignVolumeLister(t *testing.T) {
+	root := t.TempDir()
+	kubeletDir := filepath.Join(root, "kubelet")
+	sysPath := filepath.Join(root, "sys")
+	devPath := filepath.Join(root, "dev")
+	idPath := filepath.Join(devPath, "disk", "by-id")
+	csiDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi")
+	mustMkdirAll(t, idPath)
+
+	symlink := func(t *testing.T, target, link string) {
+		mustMkdirAll(t, filepath.Dir(link))
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// device creates a block device in sysfs and /dev, optionally as a
+	// partition of the given parent device or on top of the given slaves.
+	device := func(t *testing.T, name, majorMinor, parent string, slaves ...string) {
+		devDir := filepath.Join(sysPath, "devices", "virtual", "block", name)
+		if parent != "" {
+			devDir = filepath.Join(sysPath, "devices", "virtual", "block", parent, name)
+			mustMkdirAll(t, devDir)
+			mustWriteFile(t, filepath.Join(devDir, "partition"), "1\n")
+		}
+		mustMkdirAll(t, filepath.Join(devDir, "slaves"))
+		for _, slave := range slaves {
+			mustWriteFile(t, filepath.Join(devDir, "slaves", slave), "")
+		}
+		symlink(t, devDir, filepath.Join(sysPath, "class", "block", name))
+		symlink(t, devDir, filepath.Join(sysPath, "dev", "block", majorMinor))
+		mustWriteFile(t, filepath.Join(devPath, name), "")
+	}
+	volume := func(t *testing.T, volumeName, name string) {
+		symlink(t, filepath.Join(devPath, name), filepath.Join(idPath, diskDOPrefix+volumeName))
+	}
+	volData := func(t *testing.T, dir string) {
+		mustMkdirAll(t, dir)
+		mustWriteFile(t, filepath.Join(dir, volDataFileName), fmt.Sprintf(`{"driverName":%q}`, DefaultDriverName))
+	}
+
+	// staged filesystem volume, with a subpath mount of the kubelet
+	device(t, "sda", "8:0", "")
+	volume(t, "pvc-fs", "sda")
+	fsStaging := filepath.Join(csiDir, DefaultDriverName, "aaa", "globalmount")
+	volData(t, filepath.Dir(fsStaging))
+
+	// staged encrypted volume
+	device(t, "sdb", "8:16", "")
+	device(t, "dm-0", "252:0", "", "sdb")
+	volume(t, "pvc-encrypted", "sdb")
+	encryptedStaging := filepath.Join(csiDir, DefaultDriverName, "bbb", "globalmount")
+	volData(t, filepath.Dir(encryptedStaging))
+
+	// published block volume
+	device(t, "sdc", "8:32", "")
+	volume(t, "pvc-block", "sdc")
+	blockPublish := filepath.Join(csiDir, "volumeDevices", "publish", "pvc-block", "pod1")
+	volData(t, filepath.Join(csiDir, "volumeDevices", "pvc-block", "data"))
+
+	// attached volume awaiting staging
+	device(t, "sdd", "8:48", "")
+	volume(t, "pvc-unstaged", "sdd")
+
+	// volume mounted by hand
+	device(t, "sde", "8:64", "")
+	volume(t, "volume-manual", "sde")
+
+	// partitioned volume mounted by hand
+	device(t, "sdf", "8:80", "")
+	device(t, "sdf1", "8:81", "sdf")
+	volume(t, "volume-partitioned", "sdf")
+	volume(t, "volume-partitioned-part1", "sdf1")
+
+	// encrypted volume mounted by hand
+	device(t, "sdg", "8:96", "")
+	device(t, "dm-1", "252:1", "", "sdg")
+	volume(t, "volume-encrypted", "sdg")
+
+	// volume of an inline volume
+	device(t, "sdh", "8:112", "")
+	volume(t, "csi-ephemeral-0123456789abcdef", "sdh")
+	ephemeralPublish := filepath.Join(kubeletDir, "pods", "pod3", "volumes", "kubernetes.io~csi", "scratch", "mount")
+	volData(t, filepath.Dir(ephemeralPublish))
+
+	mountInfo := strings.Join([]string{
+		"22 1 252:9 / / rw shared:1 - ext4 /dev/vda1 rw",
+		"23 22 0:5 / /dev rw shared:2 - devtmpfs udev rw",
+		"24 22 0:22 / /proc rw shared:3 - proc proc rw",
+		"30 22 8:0 / " + fsStaging + " rw shared:4 - ext4 /dev/sda rw",
+		"31 22 8:0 /data " + filepath.Join(kubeletDir, "pods", "pod2", "volume-subpaths", "pvc-fs", "app", "0") + " rw shared:4 - ext4 /dev/sda rw",
+		"32 22 252:0 / " + encryptedStaging + " rw shared:5 - ext4 /dev/mapper/luks-pvc-encrypted rw",
+		"33 22 0:5 /sdc " + blockPublish + " rw shared:2 - devtmpfs udev rw",
+		"34 22 8:64 / /mnt/volume_manual rw shared:6 - ext4 /dev/sde rw",
+		"35 22 8:81 / /mnt/volume_partitioned rw shared:7 - ext4 /dev/sdf1 rw",
+		"36 22 252:1 / /mnt/volume_encrypted rw shared:8 - xfs /dev/mapper/secret rw",
+		"37 22 8:112 / " + ephemeralPublish + " rw shared:9 - ext4 /dev/sdh rw",
+	}, "\n")
+	mountInfoPath := filepath.Join(root, "mountinfo")
+	mustWriteFile(t, mountInfoPath, mountInfo)
+
+	l := newForeignVolumeLister(logrus.New().WithField("test_enabled", true), DefaultDriverName).(*sysfsForeignVolumeLister)
+	l.diskIDPath = idPath
+	l.mountInfoPath = mountInfoPath
+	l.kubeletDir = kubeletDir
+	l.sysPath = sysPath
+
+	got, err := l.List()
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	want := []string{"csi-ephemeral-0123456789abcdef", "volume-encrypted", "volume-manual", "volume-partitioned"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got foreign volumes %v, want %v", got, want)
+	}
+}
+
+type staticForeignVolumeLister struct {
+	volumes []string
+	err     error
+}
+
+func (l *staticForeignVolumeLister) List() ([]string, error) {
+	return l.volumes, l.err
+}
+
+func TestNodeVolumeLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		volumeLimit uint
+		lister      *staticForeignVolumeLister
+		want        int64
+	}{
+		{
+			name:        "no foreign volumes",
+			volumeLimit: 7,
+			lister:      &staticForeignVolumeLister{},
+			want:        7,
+		},
+		{
+			name:        "foreign volumes",
+			volumeLimit: 7,
+			lister:      &staticForeignVolumeLister{volumes: []string{"volume-1", "volume-2"}},
+			want:        5,
+		},
+		{
+			name:        "foreign volumes take all slots",
+			volumeLimit: 2,
+			lister:      &staticForeignVolumeLister{volumes: []string{"volume-1", "volume-2", "volume-3"}},
+			want:        1,
+		},
+		{
+			name:        "no limit",
+			volumeLimit: 0,
+			lister:      &staticForeignVolumeLister{volumes: []string{"volume-1"}},
+			want:        0,
+		},
+		{
+			name:        "listing fails",
+			volumeLimit: 7,
+			lister:      &staticForeignVolumeLister{err: errors.New("no mountinfo")},
+			want:        7,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &Driver{
+				volumeLimit:    test.volumeLimit,
+				foreignVolumes: test.lister,
+				log:            logrus.New().WithField("test_enabled", true),
+			}
+			if got := d.nodeVolumeLimit(); got != test.want {
+				t.Errorf("got volume limit %d, want %d", got, test.want)
+			}
+		})
+	}
+}
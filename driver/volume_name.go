@@ -0,0 +1,180 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/digitalocean/godo"
+)
+
+const (
+	// parameterVolumeNameTemplate is the StorageClass parameter that defines
+	// a Go template used to derive the DO volume name from the PVC metadata
+	// passed by the external-provisioner (--extra-create-metadata).
+	parameterVolumeNameTemplate = DefaultDriverName + "/volume-name-template"
+
+	// The keys under which the external-provisioner passes PVC and PV
+	// metadata as CreateVolume parameters.
+	parameterPVCName      = "csi.storage.k8s.io/pvc/name"
+	parameterPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	parameterPVName       = "csi.storage.k8s.io/pv/name"
+
+	// volumeIDTagPrefix prefixes the tag that identifies volumes with a
+	// templated name by the name of the CreateVolume request.
+	volumeIDTagPrefix = "csi-volume-name:"
+
+	// maxVolumeNameLength is the maximum length of DO volume names.
+	maxVolumeNameLength = 64
+
+	// maxTagLength is the maximum length of DO tag names.
+	maxTagLength = 255
+
+	// volumeNameSuffixLength is the number of hex characters of the request
+	// name hash appended to templated volume names to keep them unique.
+	volumeNameSuffixLength = 8
+)
+
+// volumeNameTemplateData is the data volume name templates are executed with.
+type volumeNameTemplateData struct {
+	PVCName      string
+	PVCNamespace string
+	PVName       string
+}
+
+// volumeNameFromTemplate renders the volume name template from the given
+// CreateVolume parameters. The result is sanitized to satisfy the DO naming
+// rules, suffixed with a hash of the request name to keep it unique, and
+// capped at the maximum volume name length.
+func volumeNameFromTemplate(reqName string, params map[string]string) (string, error) {
+	tmplStr := params[parameterVolumeNameTemplate]
+
+	data := volumeNameTemplateData{
+		PVCName:      params[parameterPVCName],
+		PVCNamespace: params[parameterPVCNamespace],
+		PVName:       params[parameterPVName],
+	}
+	if data.PVCName == "" || data.PVCNamespace == "" {
+		return "", fmt.Errorf("parameter %q requires the external-provisioner to pass PVC metadata (--extra-create-metadata)", parameterVolumeNameTemplate)
+	}
+
+	tmpl, err := template.New("volume-name").Parse(tmplStr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse parameter %q: %s", parameterVolumeNameTemplate, err)
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("failed to execute parameter %q: %s", parameterVolumeNameTemplate, err)
+	}
+
+	hash := sha256.Sum256([]byte(reqName))
+	suffix := hex.EncodeToString(hash[:])[:volumeNameSuffixLength]
+
+	name := sanitizeVolumeName(sb.String())
+	if name == "" {
+		return "", fmt.Errorf("parameter %q rendered to %q which does not contain any valid volume name characters", parameterVolumeNameTemplate, sb.String())
+	}
+
+	if maxLen := maxVolumeNameLength - len(suffix) - 1; len(name) > maxLen {
+		name = strings.TrimRight(name[:maxLen], "-")
+	}
+
+	return name + "-" + suffix, nil
+}
+
+// sanitizeVolumeName converts the given name into a valid DO volume name,
+// which must start with a letter and only consist of lowercase letters,
+// numbers, and dashes. Invalid characters are replaced by dashes.
+func sanitizeVolumeName(name string) string {
+	var sb strings.Builder
+	lastDash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+			lastDash = false
+			continue
+		}
+
+		if !lastDash {
+			sb.WriteByte('-')
+			lastDash = true
+		}
+	}
+
+	return strings.TrimRight(strings.TrimLeft(sb.String(), "0123456789-"), "-")
+}
+
+// volumeIDTag returns the tag that identifies the volume created for the
+// CreateVolume request with the given name.
+func volumeIDTag(reqName string) string {
+	tag := volumeIDTagPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == ':', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, reqName)
+
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	return tag
+}
+
+// getVolumeByIDTag returns the volume carrying the given ID tag. It returns
+// nil if no such volume exists.
+func (d *Driver) getVolumeByIDTag(ctx context.Context, idTag string) (*godo.Volume, error) {
+	tag, resp, err := d.tags.Get(ctx, idTag)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get tag %q: %s", idTag, err)
+	}
+
+	if tag.Resources == nil || tag.Resources.Volumes == nil || tag.Resources.Volumes.Count == 0 {
+		return nil, nil
+	}
+
+	if tag.Resources.Volumes.Count > 1 {
+		return nil, fmt.Errorf("fatal issue: %d volumes carry ID tag %q", tag.Resources.Volumes.Count, idTag)
+	}
+
+	volumeID := path.Base(tag.Resources.Volumes.LastTaggedURI)
+	vol, resp, err := d.storage.GetVolume(ctx, volumeID)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get volume %q carrying ID tag %q: %s", volumeID, idTag, err)
+	}
+
+	if !hasTag(vol.Tags, idTag) {
+		return nil, nil
+	}
+
+	return vol, nil
+}
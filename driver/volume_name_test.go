@@ -0,0 +1,233 @@
+/*
+Copyright 2022 DigitalOcean
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/digitalocean/godo"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeNameFromTemplate(t *testing.T) {
+	const reqName = "pvc-0b6d5d5f-6b3b-4cbe-a6f2-f8a3e3fd0a4e"
+	suffix := "-" + mustVolumeNameSuffix(t, reqName)
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		wantName string
+		wantErr  bool
+	}{
+		{
+			name: "namespace and PVC name",
+			params: map[string]string{
+				parameterVolumeNameTemplate: "{{ .PVCNamespace }}-{{ .PVCName }}",
+				parameterPVCName:            "data-postgres-0",
+				parameterPVCNamespace:       "db",
+			},
+			wantName: "db-data-postgres-0" + suffix,
+		},
+		{
+			name: "PV name",
+			params: map[string]string{
+				parameterVolumeNameTemplate: "k8s-{{ .PVName }}",
+				parameterPVCName:            "data",
+				parameterPVCNamespace:       "default",
+				parameterPVName:             "pvc-1234",
+			},
+			wantName: "k8s-pvc-1234" + suffix,
+		},
+		{
+			name: "invalid characters are sanitized",
+			params: map[string]string{
+				parameterVolumeNameTemplate: "{{ .PVCNamespace }}.{{ .PVCName }}",
+				parameterPVCName:            "Data__Elastic..Search",
+				parameterPVCNamespace:       "1-Logging",
+			},
+			wantName: "logging-data-elastic-search" + suffix,
+		},
+		{
+			name: "long names are truncated",
+			params: map[string]string{
+				parameterVolumeNameTemplate: "{{ .PVCNamespace }}-{{ .PVCName }}",
+				parameterPVCName:            strings.Repeat("a", 100),
+				parameterPVCNamespace:       "default",
+			},
+			wantName: "default-" + strings.Repeat("a", maxVolumeNameLength-len(suffix)-len("default-")) + suffix,
+		},
+		{
+			name: "missing PVC metadata",
+			params: map[string]string{
+				parameterVolumeNameTemplate: "{{ .PVCName }}",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown template field",
+			params: map[string]string{
+				parameterVolumeNameTemplate: "{{ .StorageClass }}",
+				parameterPVCName:            "data",
+				parameterPVCNamespace:       "default",
+			},
+			wantErr: true,
+		},
+		{
+			name: "no valid characters",
+			params: map[string]string{
+				parameterVolumeNameTemplate: "___",
+				parameterPVCName:            "data",
+				parameterPVCNamespace:       "default",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, err := volumeNameFromTemplate(reqName, test.params)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got name %q, want error", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if name != test.wantName {
+				t.Errorf("got name %q, want %q", name, test.wantName)
+			}
+			if len(name) > maxVolumeNameLength {
+				t.Errorf("name %q exceeds maximum length of %d", name, maxVolumeNameLength)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeWithNameTemplate(t *testing.T) {
+	volumes := map[string]*godo.Volume{}
+	d := &Driver{
+		region: "nyc3",
+		storage: &fakeStorageDriver{
+			volumes: volumes,
+		},
+		tags: &fakeTagsDriver{
+			volumes: volumes,
+		},
+		log: logrus.New().WithField("test_enabled", true),
+	}
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-0b6d5d5f-6b3b-4cbe-a6f2-f8a3e3fd0a4e",
+		Parameters: map[string]string{
+			parameterVolumeNameTemplate: "{{ .PVCNamespace }}-{{ .PVCName }}",
+			parameterPVCName:            "data",
+			parameterPVCNamespace:       "default",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	resp, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	vol := volumes[resp.Volume.VolumeId]
+	wantName := "default-data-" + mustVolumeNameSuffix(t, req.Name)
+	if vol.Name != wantName {
+		t.Errorf("got volume name %q, want %q", vol.Name, wantName)
+	}
+	if !hasTag(vol.Tags, volumeIDTag(req.Name)) {
+		t.Errorf("volume tags %v do not contain ID tag %q", vol.Tags, volumeIDTag(req.Name))
+	}
+
+	// Idempotency must hold even if the display name changes, e.g. because
+	// the template was changed in between.
+	req.Parameters[parameterVolumeNameTemplate] = "renamed-{{ .PVCName }}"
+	resp2, err := d.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("got error on second call: %s", err)
+	}
+	if resp2.Volume.VolumeId != resp.Volume.VolumeId {
+		t.Errorf("got volume ID %q on second call, want %q", resp2.Volume.VolumeId, resp.Volume.VolumeId)
+	}
+	if len(volumes) != 1 {
+		t.Errorf("got %d volumes, want 1", len(volumes))
+	}
+
+	// Missing PVC metadata must be rejected.
+	delete(req.Parameters, parameterPVCName)
+	_, err = d.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got error %v, want code %s", err, codes.InvalidArgument)
+	}
+}
+
+func TestVolumeIDTag(t *testing.T) {
+	tests := []struct {
+		reqName string
+		want    string
+	}{
+		{
+			reqName: "pvc-0b6d5d5f-6b3b-4cbe-a6f2-f8a3e3fd0a4e",
+			want:    "csi-volume-name:pvc-0b6d5d5f-6b3b-4cbe-a6f2-f8a3e3fd0a4e",
+		},
+		{
+			reqName: "sanity/volume.1",
+			want:    "csi-volume-name:sanity_volume_1",
+		},
+		{
+			reqName: strings.Repeat("a", 300),
+			want:    "csi-volume-name:" + strings.Repeat("a", maxTagLength-len(volumeIDTagPrefix)),
+		},
+	}
+
+	for _, test := range tests {
+		if got := volumeIDTag(test.reqName); got != test.want {
+			t.Errorf("got tag %q for request name %q, want %q", got, test.reqName, test.want)
+		}
+	}
+}
+
+func mustVolumeNameSuffix(t *testing.T, reqName string) string {
+	t.Helper()
+	name, err := volumeNameFromTemplate(reqName, map[string]string{
+		parameterVolumeNameTemplate: "x",
+		parameterPVCName:            "x",
+		parameterPVCNamespace:       "x",
+	})
+	if err != nil {
+		t.Fatalf("failed to compute volume name suffix: %s", err)
+	}
+	return strings.TrimPrefix(name, "x-")
+}